@@ -2,155 +2,242 @@ package coreactions
 
 import (
 	"fmt"
-	"os"
-	"os/exec"
+	"io"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
 )
 
+// Dump engines selectable with --engine. The tool engine runs the
+// database's own dump tool; the native engine is built into dbutility for
+// drivers that implement NativeDumper.
+const (
+	EngineTool   = "tool"
+	EngineNative = "native"
+)
+
+// DumpEngine selects how logical backups are taken. It is empty unless
+// --engine is given, which means the tool engine, so backups that can only
+// be taken one way can tell an explicit choice from the default.
+var DumpEngine string
+
 func BackupDatabase(dbType, host string, port int, username, password, dbName, outputFile string) error {
 	logger.Info(fmt.Sprintf("Starting full backup of database %s", dbName))
 
-	if outputFile == "" {
-		timestamp := time.Now().Format("20060102_150405")
-		outputFile = fmt.Sprintf("%s_backup_%s.sql", dbName, timestamp)
+	driver, err := lookupDriver(dbType)
+	if err != nil {
+		return err
 	}
 
-	dir := filepath.Dir(outputFile)
-	if dir != "." && dir != "/" {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			logger.Error(fmt.Sprintf("Failed to create directory %s: %v", dir, err))
-			return err
-		}
+	timestamp := time.Now().Format("20060102_150405")
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	if Parallel > 1 {
+		outputFile, err = backupSet(dbType, driver, conn, KindFull, nil, outputFile, fmt.Sprintf("%s_backup_%s", backupBaseName(dbName), timestamp))
+	} else {
+		manifest := newManifest(dbType, KindFull, driver, conn, nil)
+		outputFile, err = writeBackup(outputFile, fmt.Sprintf("%s_backup_%s%s", backupBaseName(dbName), timestamp, fileExtension(driver, KindFull)), manifest, func(out io.Writer) error {
+			return dumpDatabase(driver, conn, out, nil, manifest)
+		})
 	}
-
-	var cmd *exec.Cmd
-
-	switch strings.ToLower(dbType) {
-	case "mysql", "mariadb":
-		cmd = exec.Command(
-			"mysqldump",
-			fmt.Sprintf("-h%s", host),
-			fmt.Sprintf("-P%d", port),
-			fmt.Sprintf("-u%s", username),
-			fmt.Sprintf("-p%s", password),
-			"--single-transaction",
-			"--routines",
-			"--triggers",
-			"--databases",
-			dbName,
-		)
-
-	case "postgresql", "postgres":
-		os.Setenv("PGPASSWORD", password)
-		cmd = exec.Command(
-			"pg_dump",
-			fmt.Sprintf("--host=%s", host),
-			fmt.Sprintf("--port=%d", port),
-			fmt.Sprintf("--username=%s", username),
-			"--format=plain",
-			"--create",
-			"--clean",
-			dbName,
-		)
-
-	default:
-		err := fmt.Errorf("unsupported database type: %s", dbType)
-		logger.Error(err.Error())
+	if err != nil {
+		logger.Error(fmt.Sprintf("Database backup failed: %v", err))
 		return err
 	}
 
-	// Redirect output to file
-	outFile, err := os.Create(outputFile)
+	logger.Info(fmt.Sprintf("Database backup completed successfully to %s", outputFile))
+	return nil
+}
+
+func BackupDatabaseTables(dbType, host string, port int, username, password, dbName, outputFile string, tables []string) error {
+	logger.Info(fmt.Sprintf("Starting backup of selected tables in database %s", dbName))
+
+	driver, err := lookupDriver(dbType)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to create output file: %v", err))
 		return err
 	}
-	defer outFile.Close()
-
-	cmd.Stdout = outFile
-	cmd.Stderr = os.Stderr
+	if !driver.Capabilities().TableBackup {
+		err := fmt.Errorf("table backup is not supported for database type: %s", dbType)
+		logger.Error(err.Error())
+		return err
+	}
 
-	if err := cmd.Run(); err != nil {
-		logger.Error(fmt.Sprintf("Database backup failed: %v", err))
+	timestamp := time.Now().Format("20060102_150405")
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	if Parallel > 1 {
+		outputFile, err = backupSet(dbType, driver, conn, KindTables, tables, outputFile, fmt.Sprintf("%s_tables_backup_%s", backupBaseName(dbName), timestamp))
+	} else {
+		manifest := newManifest(dbType, KindTables, driver, conn, tables)
+		outputFile, err = writeBackup(outputFile, fmt.Sprintf("%s_tables_backup_%s%s", backupBaseName(dbName), timestamp, fileExtension(driver, KindTables)), manifest, func(out io.Writer) error {
+			return dumpDatabase(driver, conn, out, tables, manifest)
+		})
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Database tables backup failed: %v", err))
 		return err
 	}
 
-	logger.Info(fmt.Sprintf("Database backup completed successfully to %s", outputFile))
+	logger.Info(fmt.Sprintf("Database tables backup completed successfully to %s", outputFile))
 	return nil
 }
 
-func BackupDatabaseTables(dbType, host string, port int, username, password, dbName, outputFile string, tables []string) error {
-	logger.Info(fmt.Sprintf("Starting backup of selected tables in database %s", dbName))
+// backupBaseName is the database name used in default backup file names.
+// Engines that name databases by file path only contribute the file name.
+func backupBaseName(dbName string) string {
+	if dbName == "" {
+		return dbName
+	}
+	return filepath.Base(dbName)
+}
 
-	if outputFile == "" {
-		timestamp := time.Now().Format("20060102_150405")
-		outputFile = fmt.Sprintf("%s_tables_backup_%s.sql", dbName, timestamp)
+// fileExtension returns the extension of backups of the given kind taken
+// with driver.
+func fileExtension(driver Driver, kind string) string {
+	if extensioner, ok := driver.(FileExtensioner); ok {
+		return extensioner.FileExtension(kind)
 	}
+	return ".sql"
+}
 
-	dir := filepath.Dir(outputFile)
-	if dir != "." && dir != "/" {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			logger.Error(fmt.Sprintf("Failed to create directory %s: %v", dir, err))
-			return err
+// dumpDatabase writes a full backup, or a backup of the given tables, to
+// out. Drivers that can record the binlog coordinates of the snapshot
+// store them in manifest.
+func dumpDatabase(driver Driver, conn Connection, out io.Writer, tables []string, manifest *Manifest) error {
+	if DumpEngine == EngineNative {
+		dumper, ok := driver.(NativeDumper)
+		if !ok {
+			return fmt.Errorf("the native engine is not available for database type %s", manifest.Engine)
 		}
+		return dumper.NativeDump(conn, out, tables, manifest)
 	}
+	if recorder, ok := driver.(BinlogRecorder); ok {
+		return recorder.BackupWithBinlog(conn, out, tables, manifest)
+	}
+	if len(tables) > 0 {
+		return driver.BackupTables(conn, out, tables)
+	}
+	return driver.Backup(conn, out)
+}
 
-	var cmd *exec.Cmd
-
-	switch strings.ToLower(dbType) {
-	case "mysql", "mariadb":
-		args := []string{
-			fmt.Sprintf("-h%s", host),
-			fmt.Sprintf("-P%d", port),
-			fmt.Sprintf("-u%s", username),
-			fmt.Sprintf("-p%s", password),
-			"--single-transaction",
-			dbName,
-		}
-		// Add tables to arguments
-		args = append(args, tables...)
-		cmd = exec.Command("mysqldump", args...)
-
-	case "postgresql", "postgres":
-
-		os.Setenv("PGPASSWORD", password)
-		args := []string{
-			fmt.Sprintf("--host=%s", host),
-			fmt.Sprintf("--port=%d", port),
-			fmt.Sprintf("--username=%s", username),
-			"--format=plain",
-			dbName,
-		}
+// writeBackup streams the output of dump through the configured compression
+// and encryption into outputFile and returns the location the backup was
+// written to. The backup is only committed to the store if every step
+// succeeds, so a failed run never leaves a partial file behind. The
+// manifest is completed with the size and checksum of the stored file and
+// written next to it.
+func writeBackup(outputFile, defaultName string, manifest *Manifest, dump func(out io.Writer) error) (string, error) {
+	if err := BackupEncryption.Validate(); err != nil {
+		return "", err
+	}
 
-		for _, table := range tables {
-			args = append(args, fmt.Sprintf("--table=%s", table))
-		}
-		cmd = exec.Command("pg_dump", args...)
+	st, key, out, err := createOutput(outputFile, defaultName+backupExtension())
+	if err != nil {
+		return "", err
+	}
+	if err := storeBackup(st, key, out, manifest, dump); err != nil {
+		return "", err
+	}
+	return st.URI(key), nil
+}
 
-	default:
-		err := fmt.Errorf("unsupported database type: %s", dbType)
-		logger.Error(err.Error())
-		return err
+// backupExtension is the extension the configured compression and
+// encryption add to backup file names.
+func backupExtension() string {
+	extension := BackupCompression.Extension()
+	if BackupEncryption.Enabled() {
+		extension += ".enc"
 	}
+	return extension
+}
 
-	outFile, err := os.Create(outputFile)
+// storeBackup writes the output of dump to out, which stores key in st,
+// and writes the manifest next to it. out is aborted on failure.
+func storeBackup(st store.Store, key string, out store.Writer, manifest *Manifest, dump func(out io.Writer) error) error {
+	// The checksum covers the bytes as stored, so it can be checked before
+	// anything is decrypted or decompressed.
+	hashed := newHashingWriter(out)
+	encoded, err := newEncodedWriter(hashed)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to create output file: %v", err))
+		out.Abort()
 		return err
 	}
-	defer outFile.Close()
-
-	cmd.Stdout = outFile
-	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
-		logger.Error(fmt.Sprintf("Database tables backup failed: %v", err))
+	if err := dump(encoded); err != nil {
+		encoded.Close()
+		out.Abort()
+		return err
+	}
+	if err := encoded.Close(); err != nil {
+		out.Abort()
+		return err
+	}
+	if err := out.Close(); err != nil {
 		return err
 	}
 
-	logger.Info(fmt.Sprintf("Database tables backup completed successfully to %s", outputFile))
+	manifest.File = path.Base(filepath.ToSlash(key))
+	manifest.EndTime = time.Now().UTC()
+	manifest.Size = hashed.size
+	manifest.SHA256 = hashed.Sum()
+	if err := writeManifest(st, key, manifest); err != nil {
+		logger.Error(fmt.Sprintf("Failed to write backup manifest: %v", err))
+		return err
+	}
 	return nil
 }
+
+// encodedWriter compresses what is written to it with BackupCompression and
+// encrypts the result with BackupEncryption.
+type encodedWriter struct {
+	io.Writer
+	layers []io.Closer
+}
+
+func newEncodedWriter(w io.Writer) (*encodedWriter, error) {
+	encrypted, err := encryptWriter(w, BackupEncryption)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressWriter(encrypted, BackupCompression)
+	if err != nil {
+		encrypted.Close()
+		return nil, err
+	}
+	return &encodedWriter{Writer: compressed, layers: []io.Closer{compressed, encrypted}}, nil
+}
+
+// Close flushes both layers. They are always closed, even after a failed
+// write, so the encoders release their goroutines and buffers.
+func (e *encodedWriter) Close() error {
+	var first error
+	for _, layer := range e.layers {
+		if err := layer.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// createOutput opens the destination for a backup through the store that
+// outputFile belongs to. outputFile may be a local path or an s3:// or
+// vultr:// URI; when it is empty or names a directory the defaultName is
+// used for the file.
+func createOutput(outputFile, defaultName string) (store.Store, string, store.Writer, error) {
+	st, key, err := store.Open(outputFile)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, "", nil, err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += defaultName
+	}
+
+	w, err := st.Put(key)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create output file: %v", err))
+		return nil, "", nil, err
+	}
+	return st, key, w, nil
+}
@@ -0,0 +1,246 @@
+package coreactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// Parallel is the number of tables a backup dumps at once. Above one,
+// backups are written as backup sets.
+var Parallel = 1
+
+// AllowInconsistent lets a parallel backup go on when its tables cannot be
+// read from one snapshot, each table then being read at its own point in
+// time.
+var AllowInconsistent bool
+
+// A backup set is a directory in the store holding a backup split into
+// parts: the schema, the rows of every table in a file of its own, and what
+// is created after the rows are loaded. Every part is compressed, encrypted
+// and given a manifest like a single-file backup. The set's index lists
+// the parts and is written last, so an incomplete set has none.
+const backupSetIndex = "backup-set.json"
+
+// Sections of a backup set, in restore order.
+const (
+	SectionSchema   = "schema"
+	SectionData     = "data"
+	SectionPostData = "post-data"
+)
+
+// BackupPart is a file of a backup set.
+type BackupPart struct {
+	Section string `json:"section"`
+	// Table is the table whose rows a data part holds.
+	Table string `json:"table,omitempty"`
+	// File is the location of the part relative to the set.
+	File string `json:"file"`
+}
+
+// backupSet backs up the database, or the given tables, as a backup set
+// with Parallel tables dumped at once from one snapshot. The set is
+// written under outputFile, or under defaultName when outputFile is empty
+// or names a directory. Every table is attempted even when some fail, and
+// all failures are reported together.
+func backupSet(dbType string, driver Driver, conn Connection, kind string, tables []string, outputFile, defaultName string) (string, error) {
+	backupper, ok := driver.(ParallelBackupper)
+	if !ok {
+		return "", fmt.Errorf("parallel backups are not supported for database type: %s", dbType)
+	}
+	if err := BackupEncryption.Validate(); err != nil {
+		return "", err
+	}
+
+	st, prefix, err := store.Open(outputFile)
+	if err != nil {
+		return "", err
+	}
+	if prefix == "" || strings.HasSuffix(prefix, "/") {
+		prefix += defaultName
+	}
+	prefix += "/"
+
+	manifest := newManifest(dbType, kind, driver, conn, tables)
+	snapshot, err := backupper.OpenSnapshot(conn, Parallel, manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to take a snapshot: %w", err)
+	}
+	defer snapshot.Close()
+
+	dataTables, err := snapshot.Tables(tables)
+	if err != nil {
+		return "", fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	w := &setWriter{st: st, prefix: prefix, manifest: manifest}
+	parts, err := w.writeParts(snapshot, tables, dataTables)
+	if err != nil {
+		w.discard()
+		return "", err
+	}
+
+	manifest.Parts = parts
+	manifest.EndTime = time.Now().UTC()
+	if err := writeJSON(st, prefix+backupSetIndex, manifest); err != nil {
+		w.discard()
+		return "", fmt.Errorf("failed to write backup set index: %w", err)
+	}
+	return st.URI(prefix), nil
+}
+
+// setWriter writes the parts of a backup set and remembers them, so a
+// failed set can be removed again.
+type setWriter struct {
+	st       store.Store
+	prefix   string
+	manifest *Manifest
+
+	mu      sync.Mutex
+	written []string
+}
+
+// writeParts writes the schema, the rows of every table with Parallel
+// workers, and the post-data part.
+func (w *setWriter) writeParts(snapshot TableSnapshot, selected, dataTables []string) ([]BackupPart, error) {
+	schema, err := w.writePart(SectionSchema, "", "schema.sql", func(out io.Writer) error {
+		return snapshot.Schema(out, selected)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up the schema: %w", err)
+	}
+
+	data := make([]BackupPart, len(dataTables))
+	failures := make([]error, len(dataTables))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < Parallel; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				table := dataTables[i]
+				name := fmt.Sprintf("data/%04d_%s.sql", i+1, partName(table))
+				data[i], failures[i] = w.writePart(SectionData, table, name, func(out io.Writer) error {
+					return snapshot.TableData(out, table)
+				})
+				if failures[i] != nil {
+					logger.Error(fmt.Sprintf("Backup of table %s failed: %v", table, failures[i]))
+					failures[i] = fmt.Errorf("table %s: %w", table, failures[i])
+				} else {
+					logger.Info(fmt.Sprintf("Backed up table %s", table))
+				}
+			}
+		}()
+	}
+	for i := range dataTables {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err := errors.Join(failures...); err != nil {
+		failed := 0
+		for _, failure := range failures {
+			if failure != nil {
+				failed++
+			}
+		}
+		return nil, fmt.Errorf("%d of %d tables failed:\n%w", failed, len(dataTables), err)
+	}
+
+	postData, err := w.writePart(SectionPostData, "", "post-data.sql", func(out io.Writer) error {
+		return snapshot.PostData(out, selected)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to back up indexes, constraints and triggers: %w", err)
+	}
+
+	parts := append([]BackupPart{schema}, data...)
+	return append(parts, postData), nil
+}
+
+// writePart writes one part of the set, with its manifest.
+func (w *setWriter) writePart(section, table, name string, dump func(out io.Writer) error) (BackupPart, error) {
+	name += backupExtension()
+	key := w.prefix + name
+	out, err := w.st.Put(key)
+	if err != nil {
+		return BackupPart{}, err
+	}
+
+	m := &Manifest{
+		ToolVersion:     w.manifest.ToolVersion,
+		Engine:          w.manifest.Engine,
+		Kind:            section,
+		Format:          w.manifest.Format,
+		ServerVersion:   w.manifest.ServerVersion,
+		DumpToolVersion: w.manifest.DumpToolVersion,
+		Database:        w.manifest.Database,
+		StartTime:       time.Now().UTC(),
+		Compression:     w.manifest.Compression,
+		Encryption:      w.manifest.Encryption,
+	}
+	if table != "" {
+		m.Tables = []string{table}
+	}
+	if err := storeBackup(w.st, key, out, m, dump); err != nil {
+		return BackupPart{}, err
+	}
+
+	w.mu.Lock()
+	w.written = append(w.written, key)
+	w.mu.Unlock()
+	return BackupPart{Section: section, Table: table, File: name}, nil
+}
+
+// discard removes the parts written so far.
+func (w *setWriter) discard() {
+	for _, key := range w.written {
+		for _, k := range []string{key, key + manifestSuffix} {
+			if err := w.st.Delete(k); err != nil {
+				logger.Warning(fmt.Sprintf("Failed to remove %s of the incomplete backup set: %v", w.st.URI(k), err))
+			}
+		}
+	}
+}
+
+// partName turns a table name into a safe file name.
+func partName(table string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, table)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	return name
+}
+
+// writeJSON stores v as indented JSON under key.
+func writeJSON(st store.Store, key string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := st.Put(key)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
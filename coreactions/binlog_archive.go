@@ -0,0 +1,267 @@
+package coreactions
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// binlogUploadInterval is how often the spool directory is checked for
+// completed binlogs while streaming.
+const binlogUploadInterval = 10 * time.Second
+
+// binlogRetryInterval is the wait before streaming is restarted after the
+// connection to the server was lost.
+const binlogRetryInterval = 30 * time.Second
+
+// BinlogStreamer is implemented by drivers that can stream the binary logs
+// of a server as they are written.
+type BinlogStreamer interface {
+	// BinaryLogs lists the binlog files the server still has, oldest first.
+	BinaryLogs(conn Connection) ([]string, error)
+	// StreamBinlogs copies binlogs from first onwards into dir, under their
+	// server names, until the connection is lost or ctx is cancelled.
+	StreamBinlogs(ctx context.Context, conn Connection, first, dir string) error
+}
+
+// ArchiveBinlogs runs until interrupted, streaming the binary logs of the
+// server into Recovery.BinlogSpool and uploading every completed file to
+// Recovery.BinlogArchive with the configured compression and encryption.
+// The file being written is only uploaded once the server has moved on to
+// the next one. After a restart streaming resumes at the first binlog that
+// is not in the archive yet.
+func ArchiveBinlogs(dbType, host string, port int, username, password string) error {
+	if Recovery.BinlogArchive == "" {
+		err := fmt.Errorf("no binlog archive configured: set --binlog-archive")
+		logger.Error(err.Error())
+		return err
+	}
+	if err := BackupEncryption.Validate(); err != nil {
+		return err
+	}
+
+	driver, err := lookupDriver(dbType)
+	if err != nil {
+		return err
+	}
+	streamer, ok := driver.(BinlogStreamer)
+	if !ok {
+		err := fmt.Errorf("binlog archiving is not supported for database type: %s", dbType)
+		logger.Error(err.Error())
+		return err
+	}
+
+	st, prefix, err := store.Open(Recovery.BinlogArchive)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	if err := os.MkdirAll(Recovery.BinlogSpool, 0700); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create binlog spool directory: %v", err))
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	conn := Connection{Host: host, Port: port, Username: username, Password: password}
+	for {
+		if err := streamBinlogsOnce(ctx, streamer, conn, st, prefix); err != nil {
+			logger.Error(fmt.Sprintf("Binlog archiving interrupted: %v", err))
+		}
+		if ctx.Err() != nil {
+			logger.Info("Binlog archiving stopped")
+			return nil
+		}
+
+		logger.Info(fmt.Sprintf("Restarting binlog streaming in %s", binlogRetryInterval))
+		select {
+		case <-ctx.Done():
+			logger.Info("Binlog archiving stopped")
+			return nil
+		case <-time.After(binlogRetryInterval):
+		}
+	}
+}
+
+// streamBinlogsOnce streams from the first binlog missing from the archive
+// until the stream ends, uploading completed files along the way.
+func streamBinlogsOnce(ctx context.Context, streamer BinlogStreamer, conn Connection, st store.Store, prefix string) error {
+	first, err := firstUnarchivedBinlog(streamer, conn, st, prefix)
+	if err != nil {
+		return err
+	}
+
+	// Anything left in the spool is either archived already or is streamed
+	// again from the server.
+	if err := clearSpool(Recovery.BinlogSpool); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Streaming binlogs from %s into %s", first, Recovery.BinlogSpool))
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- streamer.StreamBinlogs(streamCtx, conn, first, Recovery.BinlogSpool)
+	}()
+
+	ticker := time.NewTicker(binlogUploadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if uploadErr := uploadCompletedBinlogs(st, prefix); uploadErr != nil {
+				return uploadErr
+			}
+			if err == nil {
+				err = fmt.Errorf("binlog stream ended")
+			}
+			return err
+		case <-ticker.C:
+			if err := uploadCompletedBinlogs(st, prefix); err != nil {
+				cancel()
+				<-done
+				return err
+			}
+		}
+	}
+}
+
+// firstUnarchivedBinlog picks the server binlog to resume streaming at: the
+// one after the newest archived file, or the oldest the server has when the
+// archive is empty.
+func firstUnarchivedBinlog(streamer BinlogStreamer, conn Connection, st store.Store, prefix string) (string, error) {
+	serverLogs, err := streamer.BinaryLogs(conn)
+	if err != nil {
+		return "", fmt.Errorf("failed to list server binlogs: %w", err)
+	}
+	if len(serverLogs) == 0 {
+		return "", fmt.Errorf("the server has no binlogs, is binary logging enabled?")
+	}
+
+	last, err := lastArchivedBinlog(st, prefix)
+	if err != nil {
+		return "", fmt.Errorf("failed to list archived binlogs: %w", err)
+	}
+	if last == nil {
+		return serverLogs[0], nil
+	}
+
+	for _, name := range serverLogs {
+		match := binlogName.FindStringSubmatch(name)
+		if match == nil || match[1] != last.base {
+			continue
+		}
+		sequence, _ := strconv.Atoi(match[2])
+		if sequence <= last.sequence {
+			continue
+		}
+		if sequence != last.sequence+1 {
+			logger.Warning(fmt.Sprintf("Binlogs after %s were purged before they were archived, resuming at %s", last.name, name))
+		}
+		return name, nil
+	}
+
+	// The archive is ahead of the server, e.g. after the binlogs were reset.
+	logger.Warning(fmt.Sprintf("Archive already holds %s, resuming at the server's newest binlog", last.name))
+	return serverLogs[len(serverLogs)-1], nil
+}
+
+// lastArchivedBinlog returns the binlog with the highest sequence number in
+// the archive, or nil if it holds none.
+func lastArchivedBinlog(st store.Store, prefix string) (*binlogFile, error) {
+	if prefix != "" && prefix[len(prefix)-1] != '/' {
+		prefix += "/"
+	}
+	objects, err := st.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *binlogFile
+	for _, object := range objects {
+		name := archivedName(path.Base(filepath.ToSlash(object.Key)))
+		match := binlogName.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		sequence, _ := strconv.Atoi(match[2])
+		if last == nil || sequence > last.sequence {
+			last = &binlogFile{name: name, base: match[1], sequence: sequence}
+		}
+	}
+	return last, nil
+}
+
+// spooledBinlogs lists the binlogs in dir ordered by sequence number.
+func spooledBinlogs(dir string) ([]binlogFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []binlogFile
+	for _, entry := range entries {
+		match := binlogName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		sequence, _ := strconv.Atoi(match[2])
+		files = append(files, binlogFile{
+			name:     entry.Name(),
+			path:     filepath.Join(dir, entry.Name()),
+			base:     match[1],
+			sequence: sequence,
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].sequence < files[j].sequence })
+	return files, nil
+}
+
+func clearSpool(dir string) error {
+	files, err := spooledBinlogs(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadCompletedBinlogs archives every spooled binlog except the newest,
+// which is still being written, and removes it from the spool.
+func uploadCompletedBinlogs(st store.Store, prefix string) error {
+	files, err := spooledBinlogs(Recovery.BinlogSpool)
+	if err != nil {
+		return err
+	}
+	if len(files) < 2 {
+		return nil
+	}
+
+	for _, file := range files[:len(files)-1] {
+		key, err := uploadArchiveFile(st, prefix, file.path)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to archive binlog %s: %v", file.name, err))
+			return err
+		}
+		if err := os.Remove(file.path); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Archived binlog %s to %s", file.name, st.URI(key)))
+	}
+	return nil
+}
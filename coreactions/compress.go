@@ -0,0 +1,169 @@
+package coreactions
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Supported compression algorithms.
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+	CompressLz4  = "lz4"
+)
+
+// Magic bytes at the start of each compressed stream, used to detect the
+// compression of a backup during restore.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+)
+
+var lz4Levels = []lz4.CompressionLevel{
+	lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4,
+	lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// Compression selects how backups are compressed while they are written.
+// A zero Level means the algorithm's default.
+type Compression struct {
+	Algorithm string
+	Level     int
+}
+
+// BackupCompression is applied to every new backup. main sets it from the
+// --compress flag; restores detect the compression on their own.
+var BackupCompression = Compression{Algorithm: CompressNone}
+
+// ParseCompression parses an "algorithm[:level]" specification such as
+// "gzip", "zstd:19" or "lz4:9".
+func ParseCompression(spec string) (Compression, error) {
+	algorithm, levelStr, hasLevel := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	if algorithm == "" {
+		algorithm = CompressNone
+	}
+
+	c := Compression{Algorithm: algorithm}
+	if hasLevel {
+		level, err := strconv.Atoi(levelStr)
+		if err != nil {
+			return Compression{}, fmt.Errorf("invalid compression level %q", levelStr)
+		}
+		c.Level = level
+	}
+
+	var minLevel, maxLevel int
+	switch c.Algorithm {
+	case CompressNone:
+		return c, nil
+	case CompressGzip:
+		minLevel, maxLevel = gzip.BestSpeed, gzip.BestCompression
+	case CompressZstd:
+		minLevel, maxLevel = 1, 22
+	case CompressLz4:
+		minLevel, maxLevel = 1, len(lz4Levels)-1
+	default:
+		return Compression{}, fmt.Errorf("unsupported compression algorithm: %s", c.Algorithm)
+	}
+
+	if hasLevel && (c.Level < minLevel || c.Level > maxLevel) {
+		return Compression{}, fmt.Errorf("%s compression level must be between %d and %d", c.Algorithm, minLevel, maxLevel)
+	}
+	return c, nil
+}
+
+// Extension returns the file name suffix for backups using c.
+func (c Compression) Extension() string {
+	switch c.Algorithm {
+	case CompressGzip:
+		return ".gz"
+	case CompressZstd:
+		return ".zst"
+	case CompressLz4:
+		return ".lz4"
+	}
+	return ""
+}
+
+func (c Compression) String() string {
+	if c.Level == 0 || c.Algorithm == CompressNone {
+		return c.Algorithm
+	}
+	return fmt.Sprintf("%s:%d", c.Algorithm, c.Level)
+}
+
+// compressWriter wraps w so everything written is compressed with c. Close
+// flushes the compressor but leaves w open.
+func compressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c.Algorithm {
+	case CompressNone, "":
+		return nopWriteCloser{w}, nil
+
+	case CompressGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+
+	case CompressZstd:
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+
+	case CompressLz4:
+		zw := lz4.NewWriter(w)
+		if c.Level != 0 {
+			if err := zw.Apply(lz4.CompressionLevelOption(lz4Levels[c.Level])); err != nil {
+				return nil, err
+			}
+		}
+		return zw, nil
+	}
+	return nil, fmt.Errorf("unsupported compression algorithm: %s", c.Algorithm)
+}
+
+// decompressReader detects the compression of r from its magic bytes and
+// returns a reader over the uncompressed data. Uncompressed input is passed
+// through unchanged.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+
+	case bytes.HasPrefix(magic, lz4Magic):
+		return io.NopCloser(lz4.NewReader(br)), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
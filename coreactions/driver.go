@@ -0,0 +1,224 @@
+package coreactions
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"yohan/databaseutilities/logger"
+)
+
+// Connection holds everything a driver needs to reach a database server.
+type Connection struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Database string
+	// Scratch marks a database the tool created to test-restore a
+	// backup into. Dumps that switch to the database they were taken
+	// from are restored into it all the same.
+	Scratch bool
+	// Backup is the manifest of the backup being restored, nil when it
+	// has none.
+	Backup *Manifest
+}
+
+// Capabilities describes which operations a driver supports, so callers can
+// reject an action up front instead of failing half way through.
+type Capabilities struct {
+	TableBackup        bool
+	TableRestore       bool
+	PointInTimeRestore bool
+}
+
+// Driver is implemented by every database engine the tool can back up and
+// restore. Backups are written to out and restores are read from in, so the
+// driver never has to know where the dump is stored.
+type Driver interface {
+	Backup(conn Connection, out io.Writer) error
+	BackupTables(conn Connection, out io.Writer, tables []string) error
+	Restore(conn Connection, in io.Reader) error
+	RestoreTables(conn Connection, in io.Reader, tables []string) error
+	PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error
+	Capabilities() Capabilities
+}
+
+// VersionReporter is implemented by drivers that can report the server and
+// dump tool versions recorded in backup manifests.
+type VersionReporter interface {
+	ServerVersion(conn Connection) (string, error)
+	ToolVersion() (string, error)
+}
+
+// Verifier is implemented by drivers that support the verify action. The
+// connection's Database is the one the statement runs in; CreateDatabase and
+// DropDatabase run from it against another database.
+type Verifier interface {
+	CreateDatabase(conn Connection, name string) error
+	DropDatabase(conn Connection, name string) error
+	// TableRowCounts returns the exact number of rows of every table.
+	TableRowCounts(conn Connection) (map[string]int64, error)
+	// QueryValue runs a query and returns the single value it selects.
+	QueryValue(conn Connection, query string) (string, error)
+}
+
+// BinlogRecorder is implemented by drivers that can record in the manifest
+// the binary log coordinates of the snapshot a backup is taken from, which
+// point-in-time restores start replaying at. tables is nil for a full
+// backup.
+type BinlogRecorder interface {
+	BackupWithBinlog(conn Connection, out io.Writer, tables []string, m *Manifest) error
+}
+
+// NativeDumper is implemented by drivers that can write a logical dump
+// themselves, without the engine's dump tool, for --engine=native. tables
+// is nil for a full backup.
+type NativeDumper interface {
+	NativeDump(conn Connection, out io.Writer, tables []string, m *Manifest) error
+}
+
+// ParallelBackupper is implemented by drivers that can dump several tables
+// at once from one consistent snapshot, for --parallel backups.
+type ParallelBackupper interface {
+	// OpenSnapshot takes a snapshot of the database that up to workers
+	// tables can be read from concurrently, and records its details,
+	// such as binlog coordinates, in m.
+	OpenSnapshot(conn Connection, workers int, m *Manifest) (TableSnapshot, error)
+}
+
+// TableSnapshot is a consistent snapshot of a database taken by a
+// ParallelBackupper. selected is nil for the whole database.
+type TableSnapshot interface {
+	// Tables returns the tables among selected that hold rows, largest
+	// first.
+	Tables(selected []string) ([]string, error)
+	// Schema writes what has to exist before the rows are loaded.
+	Schema(out io.Writer, selected []string) error
+	// TableData writes the rows of one table. It is called concurrently
+	// from up to workers goroutines.
+	TableData(out io.Writer, table string) error
+	// PostData writes what is created once the rows are loaded, such as
+	// indexes, constraints and triggers.
+	PostData(out io.Writer, selected []string) error
+	Close() error
+}
+
+// PartRestorer is implemented by drivers that restore the parts of a
+// backup set differently from single-file backups.
+type PartRestorer interface {
+	// StartSetRestore is called once before the first part of a set is
+	// restored, so every part sees the database as it was before the
+	// restore. tables is nil unless only the given tables are restored.
+	StartSetRestore(conn Connection, tables []string) (SetRestore, error)
+}
+
+// SetRestore restores the parts of one backup set. section is one of the
+// Section constants; the data parts are restored concurrently.
+type SetRestore interface {
+	RestorePart(in io.Reader, section string) error
+}
+
+// FileExtensioner is implemented by drivers whose backups are not SQL
+// text, to give default backup file names the right extension. kind is
+// the Kind of the backup, such as KindFull or KindTables.
+type FileExtensioner interface {
+	FileExtension(kind string) string
+}
+
+// ManifestAnnotator is implemented by drivers that add engine specific
+// details, such as the kind of backup, to new manifests.
+type ManifestAnnotator interface {
+	AnnotateManifest(m *Manifest)
+}
+
+// registeredDriver remembers the first name a driver was registered under,
+// which is the engine name written to backup manifests.
+type registeredDriver struct {
+	Driver
+	engine string
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]registeredDriver)
+)
+
+// Register makes a driver available under the given database type names.
+// The first name is the canonical engine name. It panics if a name is
+// registered twice, like database/sql does.
+func Register(driver Driver, names ...string) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if driver == nil || len(names) == 0 {
+		panic("coreactions: Register driver is nil or has no name")
+	}
+	entry := registeredDriver{Driver: driver, engine: strings.ToLower(names[0])}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, dup := drivers[name]; dup {
+			panic("coreactions: Register called twice for driver " + name)
+		}
+		drivers[name] = entry
+	}
+}
+
+// Drivers returns the sorted list of registered database type names.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Engines returns the sorted canonical names of the registered drivers,
+// one per engine, without the aliases Drivers also lists.
+func Engines() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	seen := map[string]bool{}
+	var names []string
+	for _, entry := range drivers {
+		if !seen[entry.engine] {
+			seen[entry.engine] = true
+			names = append(names, entry.engine)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupDriver returns the driver registered for dbType and logs an error if
+// there is none.
+func lookupDriver(dbType string) (Driver, error) {
+	driversMu.RLock()
+	entry, ok := drivers[strings.ToLower(dbType)]
+	driversMu.RUnlock()
+
+	if !ok {
+		err := fmt.Errorf("unsupported database type: %s", dbType)
+		logger.Error(err.Error())
+		return nil, err
+	}
+	return entry.Driver, nil
+}
+
+// engineName returns the canonical engine name for dbType, e.g. "postgres"
+// for "postgresql".
+func engineName(dbType string) string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	if entry, ok := drivers[strings.ToLower(dbType)]; ok {
+		return entry.engine
+	}
+	return strings.ToLower(dbType)
+}
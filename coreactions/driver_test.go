@@ -0,0 +1,26 @@
+package coreactions
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEnginesListsCanonicalNames(t *testing.T) {
+	engines := Engines()
+	for _, engine := range []string{"postgres", "mysql", "mongodb", "mssql"} {
+		if !slices.Contains(engines, engine) {
+			t.Errorf("Engines() = %q, missing %s", engines, engine)
+		}
+	}
+	for _, alias := range []string{"postgresql", "mongo"} {
+		if slices.Contains(engines, alias) {
+			t.Errorf("Engines() = %q, lists alias %s", engines, alias)
+		}
+		if !slices.Contains(Drivers(), alias) {
+			t.Errorf("Drivers() lacks alias %s", alias)
+		}
+	}
+	if !slices.IsSorted(engines) {
+		t.Errorf("Engines() = %q, not sorted", engines)
+	}
+}
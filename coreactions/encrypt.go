@@ -0,0 +1,404 @@
+package coreactions
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Backups encrypted with AES-256-GCM start with this header, followed by
+// the key source, the scrypt salt for passphrase keys and the nonce prefix.
+// The payload is split into chunks that are sealed separately (the STREAM
+// construction), so files of any size can be encrypted and decrypted in
+// constant memory and a truncated file is detected.
+var aesMagic = []byte("DBUAES\x00\x01")
+
+// ageMagic is the first line of every binary age file.
+var ageMagic = []byte("age-encryption.org/v1\n")
+
+const (
+	aesKeyFromFile       = 1
+	aesKeyFromPassphrase = 2
+
+	aesKeySize      = 32
+	aesSaltSize     = 16
+	aesNoncePrefix  = 7
+	aesChunkSize    = 64 * 1024
+	aesScryptLogN   = 15
+	aesLastChunkBit = 1
+)
+
+// Encryption holds the keys used to encrypt new backups and to decrypt them
+// during restore. For encryption exactly one of KeyFile, Passphrase or
+// Recipients is used; AgeIdentityFile is only needed to decrypt backups
+// encrypted to age recipients.
+type Encryption struct {
+	KeyFile         string
+	Passphrase      string
+	Recipients      []string
+	AgeIdentityFile string
+}
+
+// BackupEncryption is the encryption configuration for this run. main sets
+// it from the command-line flags.
+var BackupEncryption Encryption
+
+// AllowPlaintextTemp lets runs with encryption keys write the plaintext of
+// a backup to a temporary file where an engine can only read or write
+// files, such as SQL Server's staging directory. main sets it from
+// --allow-plaintext-temp.
+var AllowPlaintextTemp bool
+
+// plaintextTempRefused reports whether plaintext must stay off the disk:
+// encryption keys are configured and AllowPlaintextTemp is not set.
+func plaintextTempRefused() bool {
+	e := BackupEncryption
+	return !AllowPlaintextTemp && (e.Enabled() || e.AgeIdentityFile != "")
+}
+
+// plaintextTemp returns an error when what would write plaintext to a
+// temporary file and plaintextTempRefused.
+func plaintextTemp(what string) error {
+	if !plaintextTempRefused() {
+		return nil
+	}
+	return fmt.Errorf("%s writes the plaintext to a temporary file, which is refused when encryption is used: pass --allow-plaintext-temp to accept it", what)
+}
+
+// Enabled reports whether new backups should be encrypted.
+func (e Encryption) Enabled() bool {
+	return e.KeyFile != "" || e.Passphrase != "" || len(e.Recipients) > 0
+}
+
+// Validate checks that at most one way of encrypting has been configured.
+func (e Encryption) Validate() error {
+	configured := 0
+	for _, set := range []bool{e.KeyFile != "", e.Passphrase != "", len(e.Recipients) > 0} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return fmt.Errorf("use only one of an encryption key file, a passphrase or age recipients")
+	}
+	return nil
+}
+
+// String describes the encryption method without revealing any key.
+func (e Encryption) String() string {
+	switch {
+	case len(e.Recipients) > 0:
+		return "age-x25519"
+	case e.KeyFile != "":
+		return "aes-256-gcm"
+	case e.Passphrase != "":
+		return "aes-256-gcm-scrypt"
+	}
+	return "none"
+}
+
+// encryptWriter wraps w so everything written is encrypted with e. Close
+// seals the final chunk but leaves w open.
+func encryptWriter(w io.Writer, e Encryption) (io.WriteCloser, error) {
+	if len(e.Recipients) > 0 {
+		recipients := make([]age.Recipient, 0, len(e.Recipients))
+		for _, r := range e.Recipients {
+			recipient, err := age.ParseX25519Recipient(strings.TrimSpace(r))
+			if err != nil {
+				return nil, fmt.Errorf("invalid age recipient %q: %w", r, err)
+			}
+			recipients = append(recipients, recipient)
+		}
+		return age.Encrypt(w, recipients...)
+	}
+
+	header := append([]byte{}, aesMagic...)
+	var key []byte
+	switch {
+	case e.KeyFile != "":
+		k, err := readKeyFile(e.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+		header = append(header, aesKeyFromFile)
+
+	case e.Passphrase != "":
+		salt := make([]byte, aesSaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		k, err := deriveKey(e.Passphrase, salt, aesScryptLogN)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+		header = append(header, aesKeyFromPassphrase)
+		header = append(header, salt...)
+		header = append(header, aesScryptLogN)
+
+	default:
+		return nopWriteCloser{w}, nil
+	}
+
+	prefix := make([]byte, aesNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &aesWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, aesChunkSize)}, nil
+}
+
+// decryptReader detects whether r is encrypted and returns a reader over the
+// plaintext. Unencrypted input is passed through unchanged.
+func decryptReader(r io.Reader, e Encryption) (io.Reader, error) {
+	br := bufio.NewReaderSize(r, aesChunkSize+aes.BlockSize*2)
+	magic, err := br.Peek(len(ageMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, ageMagic):
+		identities, err := ageIdentities(e)
+		if err != nil {
+			return nil, err
+		}
+		return age.Decrypt(br, identities...)
+
+	case bytes.HasPrefix(magic, aesMagic):
+		return newAESReader(br, e)
+	}
+	return br, nil
+}
+
+func newAESReader(br *bufio.Reader, e Encryption) (io.Reader, error) {
+	header := make([]byte, len(aesMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+
+	var key []byte
+	switch header[len(aesMagic)] {
+	case aesKeyFromFile:
+		if e.KeyFile == "" {
+			return nil, fmt.Errorf("backup is encrypted with a key file: provide it with --encryption-key-file")
+		}
+		k, err := readKeyFile(e.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+
+	case aesKeyFromPassphrase:
+		if e.Passphrase == "" {
+			return nil, fmt.Errorf("backup is encrypted with a passphrase: provide it with --encryption-passphrase")
+		}
+		params := make([]byte, aesSaltSize+1)
+		if _, err := io.ReadFull(br, params); err != nil {
+			return nil, fmt.Errorf("failed to read encryption header: %w", err)
+		}
+		k, err := deriveKey(e.Passphrase, params[:aesSaltSize], params[aesSaltSize])
+		if err != nil {
+			return nil, err
+		}
+		key = k
+
+	default:
+		return nil, fmt.Errorf("unknown encryption key source %d", header[len(aesMagic)])
+	}
+
+	prefix := make([]byte, aesNoncePrefix)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{r: br, aead: aead, prefix: prefix, chunk: make([]byte, aesChunkSize+aead.Overhead())}, nil
+}
+
+// readKeyFile loads a 256-bit key stored as raw bytes, hex or base64.
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+	}
+	if len(data) == aesKeySize {
+		return data, nil
+	}
+
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == aesKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == aesKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key file %s must hold a 32-byte key as raw bytes, hex or base64", path)
+}
+
+func deriveKey(passphrase string, salt []byte, logN byte) ([]byte, error) {
+	if logN < 10 || logN > 22 {
+		return nil, fmt.Errorf("invalid scrypt work factor %d", logN)
+	}
+	return scrypt.Key([]byte(passphrase), salt, 1<<logN, 8, 1, aesKeySize)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ageIdentities loads the identities able to decrypt an age backup: the
+// X25519 keys from the identity file, or the passphrase for backups that
+// were encrypted with age -p.
+func ageIdentities(e Encryption) ([]age.Identity, error) {
+	if e.AgeIdentityFile != "" {
+		f, err := os.Open(e.AgeIdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open age identity file: %w", err)
+		}
+		defer f.Close()
+		return age.ParseIdentities(f)
+	}
+	if e.Passphrase != "" {
+		identity, err := age.NewScryptIdentity(e.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+	return nil, fmt.Errorf("backup is encrypted with age: provide an identity file with --age-identity")
+}
+
+// aesNonce builds the nonce for chunk n: the random prefix, the big-endian
+// chunk counter and a flag marking the last chunk.
+func aesNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 0, aesNoncePrefix+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, n)
+	if last {
+		return append(nonce, aesLastChunkBit)
+	}
+	return append(nonce, 0)
+}
+
+type aesWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte
+	n      uint32
+}
+
+func (a *aesWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, so the last
+		// chunk is always sealed by Close with the last-chunk flag set.
+		if len(a.buf) == aesChunkSize {
+			if err := a.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(a.buf[len(a.buf):aesChunkSize], p)
+		a.buf = a.buf[:len(a.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (a *aesWriter) Close() error {
+	return a.seal(true)
+}
+
+func (a *aesWriter) seal(last bool) error {
+	if a.n == ^uint32(0) {
+		return errors.New("encrypted stream is too large")
+	}
+	sealed := a.aead.Seal(nil, aesNonce(a.prefix, a.n, last), a.buf, nil)
+	a.n++
+	a.buf = a.buf[:0]
+	_, err := a.w.Write(sealed)
+	return err
+}
+
+type aesReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	chunk   []byte
+	plain   []byte
+	n       uint32
+	done    bool
+	lastErr error
+}
+
+func (a *aesReader) Read(p []byte) (int, error) {
+	for len(a.plain) == 0 {
+		if a.lastErr != nil {
+			return 0, a.lastErr
+		}
+		if a.done {
+			return 0, io.EOF
+		}
+		a.lastErr = a.open()
+	}
+	n := copy(p, a.plain)
+	a.plain = a.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk. A short chunk, or a full one
+// followed by end of file, must be the last one.
+func (a *aesReader) open() error {
+	n, err := io.ReadFull(a.r, a.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, peekErr := a.r.Peek(1); peekErr == io.EOF {
+			last = true
+		}
+	}
+
+	plain, openErr := a.aead.Open(a.chunk[:0], aesNonce(a.prefix, a.n, last), a.chunk[:n], nil)
+	if openErr != nil {
+		return fmt.Errorf("failed to decrypt backup: wrong key or corrupted file")
+	}
+	a.n++
+	a.plain = plain
+	a.done = last
+	return nil
+}
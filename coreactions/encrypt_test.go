@@ -0,0 +1,202 @@
+package coreactions
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// aesHeaderSize is the length of the header of a backup encrypted with a
+// key file; sealed chunks of aesSealedChunk bytes follow it.
+var aesHeaderSize = len(aesMagic) + 1 + aesNoncePrefix
+
+const aesSealedChunk = aesChunkSize + 16
+
+func writeKeyFile(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return keyFile
+}
+
+func encrypt(t *testing.T, e Encryption, plain []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := encryptWriter(&out, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func decrypt(e Encryption, sealed []byte) ([]byte, error) {
+	r, err := decryptReader(bytes.NewReader(sealed), e)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys := map[string]Encryption{
+		"key file":   {KeyFile: writeKeyFile(t)},
+		"passphrase": {Passphrase: "correct horse battery staple"},
+	}
+	for name, e := range keys {
+		for _, size := range []int{0, 100, aesChunkSize, 2*aesChunkSize + 1} {
+			plain := randomBytes(t, size)
+			sealed := encrypt(t, e, plain)
+			if bytes.Contains(sealed, plain) && size > 0 {
+				t.Fatalf("%s, %d bytes: the plaintext is stored as is", name, size)
+			}
+			got, err := decrypt(e, sealed)
+			if err != nil {
+				t.Fatalf("%s, %d bytes: %v", name, size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Fatalf("%s, %d bytes: decrypted %d different bytes", name, size, len(got))
+			}
+		}
+	}
+}
+
+func TestDecryptRejectsTamperedStreams(t *testing.T) {
+	e := Encryption{KeyFile: writeKeyFile(t)}
+	sealed := encrypt(t, e, randomBytes(t, 3*aesChunkSize+10))
+	header, chunks := sealed[:aesHeaderSize], sealed[aesHeaderSize:]
+	chunk := func(i int) []byte {
+		end := min((i+1)*aesSealedChunk, len(chunks))
+		return chunks[i*aesSealedChunk : end]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(append([][]byte{header}, parts...), nil)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[aesHeaderSize+aesSealedChunk] ^= 1
+
+	tests := map[string][]byte{
+		"truncated final chunk": sealed[:len(sealed)-5],
+		"dropped final chunk":   join(chunk(0), chunk(1), chunk(2)),
+		"reordered chunks":      join(chunk(1), chunk(0), chunk(2), chunk(3)),
+		"duplicated chunk":      join(chunk(0), chunk(0), chunk(1), chunk(2), chunk(3)),
+		"flipped byte":          flipped,
+	}
+	for name, data := range tests {
+		if _, err := decrypt(e, data); err == nil || !strings.Contains(err.Error(), "wrong key or corrupted file") {
+			t.Errorf("%s: got error %v", name, err)
+		}
+	}
+}
+
+func TestDecryptWithWrongKey(t *testing.T) {
+	sealed := encrypt(t, Encryption{KeyFile: writeKeyFile(t)}, []byte("INSERT INTO users VALUES (1);\n"))
+	if _, err := decrypt(Encryption{KeyFile: writeKeyFile(t)}, sealed); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Fatalf("got error %v", err)
+	}
+
+	sealed = encrypt(t, Encryption{Passphrase: "right"}, []byte("INSERT INTO users VALUES (1);\n"))
+	if _, err := decrypt(Encryption{Passphrase: "wrong"}, sealed); err == nil || !strings.Contains(err.Error(), "wrong key") {
+		t.Fatalf("got error %v", err)
+	}
+	if _, err := decrypt(Encryption{}, sealed); err == nil || !strings.Contains(err.Error(), "--encryption-passphrase") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestEncryptToAgeRecipients(t *testing.T) {
+	identityFile := func(identity *age.X25519Identity) string {
+		path := filepath.Join(t.TempDir(), "identity.txt")
+		if err := os.WriteFile(path, []byte(identity.String()+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := randomBytes(t, aesChunkSize+1)
+	sealed := encrypt(t, Encryption{Recipients: []string{first.Recipient().String(), second.Recipient().String()}}, plain)
+	for _, identity := range []*age.X25519Identity{first, second} {
+		got, err := decrypt(Encryption{AgeIdentityFile: identityFile(identity)}, sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatal("age round trip changed the backup")
+		}
+	}
+	if _, err := decrypt(Encryption{AgeIdentityFile: identityFile(other)}, sealed); err == nil {
+		t.Fatal("decrypted with an identity that is not a recipient")
+	}
+	if _, err := encryptWriter(io.Discard, Encryption{Recipients: []string{"age1invalid"}}); err == nil {
+		t.Fatal("accepted an invalid recipient")
+	}
+}
+
+func TestDecryptPassesPlainBackupsThrough(t *testing.T) {
+	plain := []byte("CREATE TABLE users (id int);\n")
+	got, err := decrypt(Encryption{KeyFile: writeKeyFile(t)}, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestPlaintextTempRefusedWithEncryption(t *testing.T) {
+	saved, savedAllow := BackupEncryption, AllowPlaintextTemp
+	t.Cleanup(func() { BackupEncryption, AllowPlaintextTemp = saved, savedAllow })
+
+	BackupEncryption, AllowPlaintextTemp = Encryption{}, false
+	if err := plaintextTemp("a SQL Server backup"); err != nil {
+		t.Fatalf("refused without encryption: %v", err)
+	}
+	BackupEncryption = Encryption{Passphrase: "secret"}
+	if err := plaintextTemp("a SQL Server backup"); err == nil || !strings.Contains(err.Error(), "--allow-plaintext-temp") {
+		t.Fatalf("got error %v", err)
+	}
+	AllowPlaintextTemp = true
+	if err := plaintextTemp("a SQL Server backup"); err != nil {
+		t.Fatalf("refused with --allow-plaintext-temp: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package coreactions
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// Backup modes, chosen with --mode. Incremental backups hold the changes
+// since the previous backup of a chain, differential backups the changes
+// since the full backup the chain starts with.
+const (
+	ModeFull         = "full"
+	ModeIncremental  = "incremental"
+	ModeDifferential = "differential"
+)
+
+// BackupMode selects the kind of backup the backup action takes.
+var BackupMode = ModeFull
+
+// IncrementalBackupper is implemented by drivers that can back up the
+// changes made since an earlier backup, from the binlog coordinates
+// recorded in its manifest.
+type IncrementalBackupper interface {
+	// BackupIncremental writes the changes made since from and records
+	// the coordinates the backup ends at in m.
+	BackupIncremental(conn Connection, out io.Writer, from BinlogPosition, m *Manifest) error
+	// ApplyIncremental applies a backup written by BackupIncremental, with
+	// manifest m, on top of the restored earlier backups of its chain.
+	ApplyIncremental(conn Connection, in io.Reader, m *Manifest) error
+}
+
+// IncrementalBackupDatabase backs up the changes made to the database since
+// the backup at previous, in the given mode. The new backup's manifest
+// points at the backup it follows, so restoring it restores the whole
+// chain.
+func IncrementalBackupDatabase(dbType, host string, port int, username, password, dbName, outputFile, previous, mode string) error {
+	logger.Info(fmt.Sprintf("Starting %s backup of database %s", mode, dbName))
+
+	driver, err := lookupDriver(dbType)
+	if err != nil {
+		return err
+	}
+	backupper, ok := driver.(IncrementalBackupper)
+	if !ok {
+		err := fmt.Errorf("%s backups are not supported for database type: %s", mode, dbType)
+		logger.Error(err.Error())
+		return err
+	}
+
+	parent, parentManifest, err := chainParent(dbType, previous, mode)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+
+	kind := KindIncremental
+	if mode == ModeDifferential {
+		kind = KindDifferential
+	}
+	timestamp := time.Now().Format("20060102_150405")
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	manifest := newManifest(dbType, kind, driver, conn, nil)
+	manifest.Parent = parent
+	manifest.FromBinlogFile = parentManifest.BinlogFile
+	manifest.FromBinlogPosition = parentManifest.BinlogPosition
+
+	from := BinlogPosition{File: parentManifest.BinlogFile, Position: parentManifest.BinlogPosition}
+	outputFile, err = writeBackup(outputFile, fmt.Sprintf("%s_%s_backup_%s%s", backupBaseName(dbName), kind, timestamp, fileExtension(driver, kind)), manifest, func(out io.Writer) error {
+		return backupper.BackupIncremental(conn, out, from, manifest)
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Database %s backup failed: %v", mode, err))
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Database %s backup completed successfully to %s", mode, outputFile))
+	return nil
+}
+
+// chainParent returns the location and manifest of the backup a new
+// backup in the given mode follows: previous itself for an incremental
+// backup, the full backup of its chain for a differential one.
+func chainParent(dbType, previous, mode string) (string, *Manifest, error) {
+	switch mode {
+	case ModeIncremental, ModeDifferential:
+	default:
+		return "", nil, fmt.Errorf("unknown backup mode %q: use full, incremental or differential", mode)
+	}
+	if previous == "" {
+		return "", nil, fmt.Errorf("no previous backup given: set --previous to the backup the %s backup follows", mode)
+	}
+
+	location := chainLocation(previous)
+	m, err := readManifestAt(location)
+	if err != nil {
+		return "", nil, err
+	}
+	if m.Engine != engineName(dbType) {
+		return "", nil, fmt.Errorf("previous backup %s was taken from a %s database", previous, m.Engine)
+	}
+	if m.Kind == KindTables {
+		return "", nil, fmt.Errorf("previous backup %s is a table backup: a chain must start with a full backup", previous)
+	}
+
+	if mode == ModeDifferential {
+		links, err := backupChain(location, m)
+		if err != nil {
+			return "", nil, err
+		}
+		location, m = links[0].location, links[0].manifest
+	}
+	if m.BinlogFile == "" {
+		return "", nil, fmt.Errorf("backup %s has no recorded binlog coordinates to continue from", location)
+	}
+	return location, m, nil
+}
+
+// chainLocation makes local backup paths absolute, so the chain can be
+// followed from any working directory.
+func chainLocation(location string) string {
+	if strings.Contains(location, "://") {
+		return location
+	}
+	if abs, err := filepath.Abs(location); err == nil {
+		return abs
+	}
+	return location
+}
+
+// readManifestAt reads the manifest of the backup at location, which must
+// exist.
+func readManifestAt(location string) (*Manifest, error) {
+	st, key, err := store.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readManifest(st, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s: %w", location, err)
+	}
+	if m == nil {
+		return nil, fmt.Errorf("backup %s has no manifest", location)
+	}
+	return m, nil
+}
+
+// chainLink is a backup of a chain.
+type chainLink struct {
+	location string
+	manifest *Manifest
+}
+
+// backupChain follows the parents of the backup at location back to the
+// full backup the chain starts with and returns the chain in restore
+// order. Every backup must start where its parent ends.
+func backupChain(location string, m *Manifest) ([]chainLink, error) {
+	links := []chainLink{{location: location, manifest: m}}
+	seen := map[string]bool{location: true}
+	for m.Parent != "" {
+		if seen[m.Parent] {
+			return nil, fmt.Errorf("backup chain of %s loops back to %s", location, m.Parent)
+		}
+		seen[m.Parent] = true
+
+		parent, err := readManifestAt(m.Parent)
+		if err != nil {
+			return nil, fmt.Errorf("backup chain is broken: %w", err)
+		}
+		if m.FromBinlogFile != parent.BinlogFile || m.FromBinlogPosition != parent.BinlogPosition {
+			return nil, fmt.Errorf("backup chain is broken: %s starts at %s:%d but %s ends at %s:%d",
+				links[0].location, m.FromBinlogFile, m.FromBinlogPosition, m.Parent, parent.BinlogFile, parent.BinlogPosition)
+		}
+		links = append([]chainLink{{location: m.Parent, manifest: parent}}, links...)
+		m = parent
+	}
+	return links, nil
+}
+
+// restoreChain restores the full backup a chain starts with and applies
+// every later backup of the chain up to the one in, which was opened from
+// location.
+func restoreChain(driver Driver, conn Connection, location string, manifest *Manifest, in io.Reader) error {
+	applier, ok := driver.(IncrementalBackupper)
+	if !ok {
+		return fmt.Errorf("backup %s is part of a chain, which database type %s cannot restore", location, manifest.Engine)
+	}
+	links, err := backupChain(chainLocation(location), manifest)
+	if err != nil {
+		return err
+	}
+	logger.Info(fmt.Sprintf("Restoring a chain of %d backups starting with %s", len(links), links[0].location))
+
+	for i, link := range links {
+		var err error
+		if i == len(links)-1 {
+			err = applyChainLink(driver, applier, conn, i, link, in)
+		} else {
+			err = openChainLink(driver, applier, conn, i, link)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", link.location, err)
+		}
+	}
+	return nil
+}
+
+func openChainLink(driver Driver, applier IncrementalBackupper, conn Connection, i int, link chainLink) error {
+	in, _, err := openInput(link.location)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return applyChainLink(driver, applier, conn, i, link, in)
+}
+
+// applyChainLink restores the full backup at the start of a chain, or
+// applies a later backup.
+func applyChainLink(driver Driver, applier IncrementalBackupper, conn Connection, i int, link chainLink, in io.Reader) error {
+	if i == 0 {
+		return driver.Restore(conn, in)
+	}
+	logger.Info(fmt.Sprintf("Applying %s backup %s", link.manifest.Kind, link.location))
+	return applier.ApplyIncremental(conn, in, link.manifest)
+}
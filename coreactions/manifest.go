@@ -0,0 +1,183 @@
+package coreactions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// ToolVersion is recorded in every manifest. Release builds set it with
+// -ldflags "-X yohan/databaseutilities/coreactions.ToolVersion=v1.2.3".
+var ToolVersion = "dev"
+
+// manifestSuffix is appended to the backup key to name its manifest.
+const manifestSuffix = ".manifest.json"
+
+// Kinds of backup recorded in the manifest.
+const (
+	KindFull   = "full"
+	KindTables = "tables"
+	KindBase   = "base"
+
+	// SQL Server differential and transaction log backups, and MySQL
+	// binlog backups in a chain.
+	KindDifferential = "differential"
+	KindLog          = "log"
+	KindIncremental  = "incremental"
+)
+
+// Manifest describes a backup. It is written next to the backup file once
+// the backup has been committed and is used during restore to pick the
+// engine and to check the file has not been corrupted.
+type Manifest struct {
+	ToolVersion     string           `json:"tool_version"`
+	Engine          string           `json:"engine"`
+	Kind            string           `json:"kind,omitempty"`
+	Format          string           `json:"format,omitempty"`
+	ServerVersion   string           `json:"server_version,omitempty"`
+	DumpToolVersion string           `json:"dump_tool_version,omitempty"`
+	Database        string           `json:"database"`
+	Tables          []string         `json:"tables,omitempty"`
+	RowCounts       map[string]int64 `json:"row_counts,omitempty"`
+	File            string           `json:"file"`
+	StartTime       time.Time        `json:"start_time"`
+	EndTime         time.Time        `json:"end_time"`
+	Size            int64            `json:"size"`
+	SHA256          string           `json:"sha256"`
+	Compression     string           `json:"compression"`
+	Encryption      string           `json:"encryption"`
+
+	// Binary log coordinates of the snapshot, for MySQL point-in-time
+	// restores.
+	BinlogFile     string `json:"binlog_file,omitempty"`
+	BinlogPosition int64  `json:"binlog_position,omitempty"`
+	GTIDExecuted   string `json:"gtid_executed,omitempty"`
+
+	// Incremental and differential backups: the backup they follow and
+	// the binlog coordinates they start at, which are the coordinates
+	// that backup ends at.
+	Parent             string `json:"parent,omitempty"`
+	FromBinlogFile     string `json:"from_binlog_file,omitempty"`
+	FromBinlogPosition int64  `json:"from_binlog_position,omitempty"`
+
+	// Parts lists the files of a backup set.
+	Parts []BackupPart `json:"parts,omitempty"`
+}
+
+// newManifest starts a manifest for a backup of conn.Database taken with
+// the driver registered for dbType. Version lookups are best effort: a
+// failure is logged and leaves the field empty.
+func newManifest(dbType, kind string, driver Driver, conn Connection, tables []string) *Manifest {
+	m := &Manifest{
+		ToolVersion: ToolVersion,
+		Engine:      engineName(dbType),
+		Kind:        kind,
+		Database:    conn.Database,
+		Tables:      tables,
+		StartTime:   time.Now().UTC(),
+		Compression: BackupCompression.String(),
+		Encryption:  BackupEncryption.String(),
+	}
+
+	if reporter, ok := driver.(VersionReporter); ok {
+		if version, err := reporter.ServerVersion(conn); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to read server version: %v", err))
+		} else {
+			m.ServerVersion = version
+		}
+		if _, native := driver.(NativeDumper); native && DumpEngine == EngineNative {
+			m.DumpToolVersion = "dbutility native " + ToolVersion
+		} else if version, err := reporter.ToolVersion(); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to read dump tool version: %v", err))
+		} else {
+			m.DumpToolVersion = version
+		}
+	}
+
+	if annotator, ok := driver.(ManifestAnnotator); ok {
+		annotator.AnnotateManifest(m)
+	}
+
+	// Counts are taken just before the dump starts, so they only match
+	// the backup for tables that are not written to meanwhile.
+	if verifier, ok := driver.(Verifier); ok && RecordRowCounts {
+		if counts, err := verifier.TableRowCounts(conn); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to count table rows: %v", err))
+		} else if len(tables) > 0 {
+			m.RowCounts = filterRowCounts(counts, tables)
+		} else {
+			m.RowCounts = counts
+		}
+	}
+	return m
+}
+
+// writeManifest stores m as the sidecar of the backup at key.
+func writeManifest(st store.Store, key string, m *Manifest) error {
+	return writeJSON(st, key+manifestSuffix, m)
+}
+
+// readManifest loads the sidecar of the backup at key. It returns a nil
+// manifest without error for backups taken before manifests existed.
+func readManifest(st store.Store, key string) (*Manifest, error) {
+	if _, err := st.Stat(key + manifestSuffix); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	r, err := st.Get(key + manifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", st.URI(key+manifestSuffix), err)
+	}
+	return &m, nil
+}
+
+// verifyChecksum reads a stored backup to its end and compares its size
+// and SHA-256 with the manifest.
+func verifyChecksum(stored io.Reader, m *Manifest, uri string) error {
+	hash := newHashingWriter(io.Discard)
+	if _, err := io.Copy(hash, stored); err != nil {
+		return err
+	}
+	if hash.size != m.Size || hash.Sum() != m.SHA256 {
+		return fmt.Errorf("backup %s is corrupted: checksum does not match its manifest", uri)
+	}
+	return nil
+}
+
+// hashingWriter passes writes through to w while counting the bytes and
+// computing their SHA-256.
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	size int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, hash: sha256.New()}
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.size += int64(n)
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 of everything written so far.
+func (h *hashingWriter) Sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
@@ -0,0 +1,251 @@
+package coreactions
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// mongoDriver wraps mongodump and mongorestore. Backups are single archive
+// streams; compression is left to --compress rather than mongodump's own
+// --gzip so the archive is handled like any other backup. The mongosh
+// shell is needed for multi-collection backups and for verify.
+type mongoDriver struct{}
+
+func init() {
+	Register(mongoDriver{}, "mongodb", "mongo")
+}
+
+func (mongoDriver) Capabilities() Capabilities {
+	return Capabilities{
+		TableBackup:        true,
+		TableRestore:       true,
+		PointInTimeRestore: true,
+	}
+}
+
+// FileExtension names backups after the mongodump archive format.
+func (mongoDriver) FileExtension(kind string) string {
+	return ".archive"
+}
+
+// command builds a MongoDB tool command with the connection arguments
+// placed before the caller's own arguments. Users are authenticated
+// against the admin database.
+func (mongoDriver) command(conn Connection, name string, args ...string) *exec.Cmd {
+	connArgs := []string{
+		fmt.Sprintf("--host=%s", conn.Host),
+		fmt.Sprintf("--port=%d", conn.Port),
+	}
+	if conn.Username != "" {
+		connArgs = append(connArgs,
+			fmt.Sprintf("--username=%s", conn.Username),
+			fmt.Sprintf("--password=%s", conn.Password),
+			"--authenticationDatabase=admin",
+		)
+	}
+	cmd := exec.Command(name, append(connArgs, args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// eval runs a mongosh script against the connection's database and returns
+// what it printed.
+func (d mongoDriver) eval(conn Connection, script string) (string, error) {
+	args := []string{"--quiet", "--norc", fmt.Sprintf("--eval=%s", script)}
+	if conn.Database != "" {
+		args = append(args, conn.Database)
+	}
+	out, err := d.command(conn, "mongosh", args...).Output()
+	return strings.TrimRight(string(out), "\n"), err
+}
+
+func (d mongoDriver) ServerVersion(conn Connection) (string, error) {
+	return d.eval(conn, "print(db.version())")
+}
+
+func (mongoDriver) ToolVersion() (string, error) {
+	out, err := exec.Command("mongodump", "--version").Output()
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return version, err
+}
+
+// Backup dumps the database as an archive. Without a database name the
+// whole deployment is dumped together with the oplog written during the
+// dump, which makes the archive a consistent snapshot and allows
+// point-in-time restores; this needs a replica set.
+func (d mongoDriver) Backup(conn Connection, out io.Writer) error {
+	args := []string{"--archive"}
+	if conn.Database == "" {
+		args = append(args, "--oplog")
+	} else {
+		args = append(args, fmt.Sprintf("--db=%s", conn.Database))
+	}
+	cmd := d.command(conn, "mongodump", args...)
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+// BackupTables dumps the given collections. mongodump takes a single
+// --collection, so for several collections every other one is excluded.
+func (d mongoDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	args := []string{"--archive", fmt.Sprintf("--db=%s", conn.Database)}
+	if len(tables) == 1 {
+		args = append(args, fmt.Sprintf("--collection=%s", tables[0]))
+	} else {
+		collections, err := d.collections(conn)
+		if err != nil {
+			return fmt.Errorf("failed to list collections: %w", err)
+		}
+		wanted := make(map[string]bool, len(tables))
+		for _, table := range tables {
+			wanted[table] = true
+		}
+		for _, collection := range collections {
+			if !wanted[collection] {
+				args = append(args, fmt.Sprintf("--excludeCollection=%s", collection))
+			}
+		}
+	}
+
+	cmd := d.command(conn, "mongodump", args...)
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+func (d mongoDriver) collections(conn Connection) ([]string, error) {
+	out, err := d.eval(conn, `db.getCollectionNames().forEach(c => print(c))`)
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(out), nil
+}
+
+// mongoSystemDatabases hold the users, roles, sharding metadata and oplog
+// of a deployment, which are never restored into a user database.
+var mongoSystemDatabases = []string{"admin", "config", "local"}
+
+// sourceDatabase returns the database of the archive a restore into
+// conn.Database reads: the database a single-database backup was taken
+// from, the same database in a deployment backup, or "" for every user
+// database when that is not known. Test restores into a scratch database
+// take every user database of a deployment backup.
+func (mongoDriver) sourceDatabase(conn Connection) string {
+	switch {
+	case conn.Backup == nil:
+		return ""
+	case conn.Backup.Database != "":
+		return conn.Backup.Database
+	case conn.Scratch:
+		return ""
+	default:
+		return conn.Database
+	}
+}
+
+// renameArgs returns the mongorestore options restoring the collections
+// of the source database, or the given ones, into conn.Database.
+func (d mongoDriver) renameArgs(conn Connection, collections []string) []string {
+	source := d.sourceDatabase(conn)
+	var args []string
+	if source == "" {
+		for _, db := range mongoSystemDatabases {
+			args = append(args, fmt.Sprintf("--nsExclude=%s.*", db))
+		}
+	}
+	if len(collections) == 0 {
+		collections = []string{"*"}
+	}
+	for _, collection := range collections {
+		from, to := collection, collection
+		if collection == "*" {
+			from, to = "$collection$", "$collection$"
+		}
+		if source == "" {
+			args = append(args, fmt.Sprintf("--nsInclude=*.%s", collection), fmt.Sprintf("--nsFrom=$db$.%s", from))
+		} else {
+			args = append(args, fmt.Sprintf("--nsInclude=%s.%s", source, collection), fmt.Sprintf("--nsFrom=%s.%s", source, from))
+		}
+		args = append(args, fmt.Sprintf("--nsTo=%s.%s", conn.Database, to))
+	}
+	return args
+}
+
+// Restore restores an archive, dropping existing collections first. With a
+// database name the collections of the database the backup was taken from
+// are restored into that database, so a backup can be restored under
+// another name; from a deployment backup only the database of that name
+// is restored. Otherwise namespaces are kept.
+func (d mongoDriver) Restore(conn Connection, in io.Reader) error {
+	args := []string{"--archive", "--drop"}
+	if conn.Database != "" {
+		args = append(args, d.renameArgs(conn, nil)...)
+	}
+	cmd := d.command(conn, "mongorestore", args...)
+	cmd.Stdin = in
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// RestoreTables restores the given collections of an archive into the
+// connection's database.
+func (d mongoDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	args := append([]string{"--archive", "--drop"}, d.renameArgs(conn, tables)...)
+	cmd := d.command(conn, "mongorestore", args...)
+	cmd.Stdin = in
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// PointInTimeRestore restores a deployment archive taken with the oplog
+// and replays the oplog up to and including the second of the target time.
+// The target must fall within the time the dump was running.
+func (d mongoDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	if target.Time.IsZero() || target.StopPosition != nil || target.StopGTIDs != "" {
+		return fmt.Errorf("MongoDB point-in-time recovery only supports a target time")
+	}
+	if conn.Backup != nil && conn.Backup.Database != "" {
+		return fmt.Errorf("backup of database %s holds no oplog: point-in-time recovery needs a backup of the whole deployment, taken without --dbname", conn.Backup.Database)
+	}
+
+	cmd := d.command(conn, "mongorestore",
+		"--archive",
+		"--drop",
+		"--oplogReplay",
+		fmt.Sprintf("--oplogLimit=%d:0", target.Time.Unix()+1),
+	)
+	cmd.Stdin = in
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// MongoDB creates databases on first write, so there is nothing to do
+// until the restore.
+func (mongoDriver) CreateDatabase(conn Connection, name string) error {
+	return nil
+}
+
+func (d mongoDriver) DropDatabase(conn Connection, name string) error {
+	_, err := d.eval(conn, fmt.Sprintf("db.getSiblingDB(%q).dropDatabase()", name))
+	return err
+}
+
+// QueryValue evaluates a mongosh expression, e.g.
+// db.users.countDocuments() > 0, and returns what it prints.
+func (d mongoDriver) QueryValue(conn Connection, query string) (string, error) {
+	return d.eval(conn, query)
+}
+
+// TableRowCounts counts the documents of every collection, system
+// collections excluded.
+func (d mongoDriver) TableRowCounts(conn Connection) (map[string]int64, error) {
+	out, err := d.eval(conn, `db.getCollectionNames()
+		.filter(c => !c.startsWith("system."))
+		.forEach(c => print(c + "\t" + db.getCollection(c).countDocuments()))`)
+	if err != nil {
+		return nil, err
+	}
+	return parseRowCounts(out)
+}
@@ -0,0 +1,55 @@
+package coreactions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMongoRenameArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		conn        Connection
+		collections []string
+		want        []string
+	}{
+		{
+			name: "database backup",
+			conn: Connection{Database: "copy", Backup: &Manifest{Database: "shop"}},
+			want: []string{"--nsInclude=shop.*", "--nsFrom=shop.$collection$", "--nsTo=copy.$collection$"},
+		},
+		{
+			name: "deployment backup",
+			conn: Connection{Database: "shop", Backup: &Manifest{}},
+			want: []string{"--nsInclude=shop.*", "--nsFrom=shop.$collection$", "--nsTo=shop.$collection$"},
+		},
+		{
+			name:        "collections of a database backup",
+			conn:        Connection{Database: "copy", Backup: &Manifest{Database: "shop"}},
+			collections: []string{"orders"},
+			want:        []string{"--nsInclude=shop.orders", "--nsFrom=shop.orders", "--nsTo=copy.orders"},
+		},
+		{
+			name: "no manifest",
+			conn: Connection{Database: "copy"},
+			want: []string{
+				"--nsExclude=admin.*", "--nsExclude=config.*", "--nsExclude=local.*",
+				"--nsInclude=*.*", "--nsFrom=$db$.$collection$", "--nsTo=copy.$collection$",
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := (mongoDriver{}).renameArgs(test.conn, test.collections); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMongoPointInTimeRestoreNeedsDeploymentBackup(t *testing.T) {
+	conn := Connection{Backup: &Manifest{Database: "shop"}}
+	err := mongoDriver{}.PointInTimeRestore(conn, strings.NewReader(""), RecoveryTarget{Time: time.Now()})
+	if err == nil || !strings.Contains(err.Error(), "holds no oplog") {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -0,0 +1,510 @@
+package coreactions
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"yohan/databaseutilities/logger"
+
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+// SQL Server backup types, chosen with --mssql-backup-type.
+const (
+	MSSQLFull         = "full"
+	MSSQLDifferential = "differential"
+	MSSQLLog          = "log"
+)
+
+// MSSQLOptions configures the SQL Server driver. BACKUP and RESTORE read
+// and write files on the server, so backups go through a directory both
+// the server and this tool can reach. main fills MSSQL from the flags.
+type MSSQLOptions struct {
+	// BackupDirectory is the staging directory as seen by the server,
+	// e.g. /var/opt/mssql/backup or D:\Backup.
+	BackupDirectory string
+	// LocalDirectory is the same directory as seen by this tool. It
+	// defaults to BackupDirectory, for a tool running on the server.
+	LocalDirectory string
+	// BackupType is full, differential or log.
+	BackupType string
+	// NoRecovery leaves a restored database in the restoring state so
+	// further differential or log backups can be applied.
+	NoRecovery bool
+}
+
+var MSSQL = MSSQLOptions{BackupType: MSSQLFull}
+
+// RESTORE HEADERONLY backup types.
+const (
+	mssqlHeaderFull         = 1
+	mssqlHeaderLog          = 2
+	mssqlHeaderDifferential = 5
+)
+
+type mssqlDriver struct{}
+
+func init() {
+	Register(mssqlDriver{}, "mssql", "sqlserver")
+}
+
+func (mssqlDriver) Capabilities() Capabilities {
+	return Capabilities{PointInTimeRestore: true}
+}
+
+// FileExtension names backups after SQL Server backup files.
+func (mssqlDriver) FileExtension(kind string) string {
+	return ".bak"
+}
+
+// AnnotateManifest records the kind of SQL Server backup being taken.
+func (mssqlDriver) AnnotateManifest(m *Manifest) {
+	switch MSSQL.BackupType {
+	case MSSQLDifferential:
+		m.Kind = KindDifferential
+	case MSSQLLog:
+		m.Kind = KindLog
+	}
+}
+
+// open connects to the given database of the server.
+func (mssqlDriver) open(conn Connection, database string) (*sql.DB, error) {
+	query := url.Values{}
+	query.Set("database", database)
+	query.Set("app name", "dbutility")
+	dsn := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(conn.Username, conn.Password),
+		Host:     fmt.Sprintf("%s:%d", conn.Host, conn.Port),
+		RawQuery: query.Encode(),
+	}
+	return sql.Open("sqlserver", dsn.String())
+}
+
+// exec runs statements in the master database.
+func (d mssqlDriver) exec(conn Connection, statements ...string) error {
+	db, err := d.open(conn, "master")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d mssqlDriver) ServerVersion(conn Connection) (string, error) {
+	db, err := d.open(conn, "master")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var version string
+	err = db.QueryRow("SELECT @@VERSION").Scan(&version)
+	version, _, _ = strings.Cut(version, "\n")
+	return strings.TrimSpace(version), err
+}
+
+func (mssqlDriver) ToolVersion() (string, error) {
+	return "T-SQL BACKUP through go-mssqldb", nil
+}
+
+// stagingFile returns the path of a new staging file as seen by the server
+// and by this tool. Names end in a random string, like those of
+// os.CreateTemp, so concurrent runs never share a file; the file is not
+// created, as the server may have to write it with its own account.
+func stagingFile(database string) (serverPath, localPath string, err error) {
+	if MSSQL.BackupDirectory == "" {
+		return "", "", fmt.Errorf("no SQL Server staging directory configured: set --mssql-backup-dir")
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", "", err
+	}
+	name := fmt.Sprintf("dbutility_%s_%s.bak", database, hex.EncodeToString(random))
+
+	separator := "/"
+	if strings.Contains(MSSQL.BackupDirectory, `\`) {
+		separator = `\`
+	}
+	serverPath = strings.TrimRight(MSSQL.BackupDirectory, separator) + separator + name
+
+	localDir := MSSQL.LocalDirectory
+	if localDir == "" {
+		localDir = MSSQL.BackupDirectory
+	}
+	return serverPath, filepath.Join(localDir, name), nil
+}
+
+// Backup has the server write a full, differential or log backup into the
+// staging directory, then streams the file to out and removes it.
+func (d mssqlDriver) Backup(conn Connection, out io.Writer) error {
+	if err := plaintextTemp("a SQL Server backup"); err != nil {
+		return err
+	}
+	serverPath, localPath, err := stagingFile(conn.Database)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+
+	target := fmt.Sprintf("%s TO DISK = %s WITH INIT, FORMAT, CHECKSUM", mssqlIdentifier(conn.Database), mssqlLiteral(serverPath))
+	var statement string
+	switch MSSQL.BackupType {
+	case MSSQLFull:
+		statement = "BACKUP DATABASE " + target
+	case MSSQLDifferential:
+		statement = "BACKUP DATABASE " + target + ", DIFFERENTIAL"
+	case MSSQLLog:
+		statement = "BACKUP LOG " + target
+	default:
+		return fmt.Errorf("unknown SQL Server backup type %q: use full, differential or log", MSSQL.BackupType)
+	}
+	if err := d.exec(conn, statement); err != nil {
+		return err
+	}
+
+	in, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("backup written by the server is not readable from %s: %w", localPath, err)
+	}
+	defer in.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (mssqlDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	return fmt.Errorf("table backup is not supported for SQL Server")
+}
+
+func (mssqlDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	return fmt.Errorf("table restore is not supported for SQL Server")
+}
+
+// Restore applies a full, differential or log backup to the database. Full
+// backups replace the database and have their files moved to the server's
+// default data and log directories, so a backup can be restored under
+// another name. With --mssql-no-recovery the database is left restoring
+// for the next backup of the chain.
+func (d mssqlDriver) Restore(conn Connection, in io.Reader) error {
+	return d.restore(conn, in, time.Time{})
+}
+
+// PointInTimeRestore applies a log backup up to the target time and
+// recovers the database. The full backup, and any differential and
+// earlier log backups, must have been restored with --mssql-no-recovery.
+func (d mssqlDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	if target.Time.IsZero() || target.StopPosition != nil || target.StopGTIDs != "" {
+		return fmt.Errorf("SQL Server point-in-time recovery only supports a target time")
+	}
+	return d.restore(conn, in, target.Time)
+}
+
+func (d mssqlDriver) restore(conn Connection, in io.Reader, stopAt time.Time) (err error) {
+	if err := plaintextTemp("a SQL Server restore"); err != nil {
+		return err
+	}
+	serverPath, localPath, err := stagingFile(conn.Database)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+
+	// The server reads the file with its own account.
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	db, err := d.open(conn, "master")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	disk := mssqlLiteral(serverPath)
+	var backupType int
+	if err := queryColumn(db, "RESTORE HEADERONLY FROM DISK = "+disk, "BackupType", &backupType); err != nil {
+		return fmt.Errorf("failed to read backup header: %w", err)
+	}
+
+	options := []string{"RECOVERY"}
+	if MSSQL.NoRecovery {
+		options = []string{"NORECOVERY"}
+	}
+	if !stopAt.IsZero() {
+		if backupType != mssqlHeaderLog {
+			return fmt.Errorf("point-in-time recovery needs a log backup")
+		}
+		serverTime, err := serverLocalTime(db, stopAt)
+		if err != nil {
+			return err
+		}
+		options = []string{"RECOVERY", fmt.Sprintf("STOPAT = %s", mssqlLiteral(serverTime))}
+	}
+
+	name := mssqlIdentifier(conn.Database)
+	var statement string
+	switch backupType {
+	case mssqlHeaderFull:
+		moves, err := d.moveOptions(db, disk, conn.Database)
+		if err != nil {
+			return err
+		}
+		options = append(append([]string{"REPLACE"}, moves...), options...)
+		statement = fmt.Sprintf("RESTORE DATABASE %s FROM DISK = %s WITH %s", name, disk, strings.Join(options, ", "))
+
+		// REPLACE waits for every connection to the database to go away.
+		// A restored database takes the access mode of the backup, but
+		// one that failed to restore is opened to everyone again.
+		kick := fmt.Sprintf("IF EXISTS (SELECT 1 FROM sys.databases WHERE name = %s AND state_desc = 'ONLINE') ALTER DATABASE %s SET SINGLE_USER WITH ROLLBACK IMMEDIATE",
+			mssqlLiteral(conn.Database), name)
+		if _, err := db.Exec(kick); err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			reopen := fmt.Sprintf("IF EXISTS (SELECT 1 FROM sys.databases WHERE name = %s AND state_desc = 'ONLINE' AND user_access_desc = 'SINGLE_USER') ALTER DATABASE %s SET MULTI_USER",
+				mssqlLiteral(conn.Database), name)
+			if _, reopenErr := db.Exec(reopen); reopenErr != nil {
+				logger.Warning(fmt.Sprintf("Failed to set database %s back to MULTI_USER: %v", conn.Database, reopenErr))
+			}
+		}()
+	case mssqlHeaderDifferential:
+		statement = fmt.Sprintf("RESTORE DATABASE %s FROM DISK = %s WITH %s", name, disk, strings.Join(options, ", "))
+	case mssqlHeaderLog:
+		statement = fmt.Sprintf("RESTORE LOG %s FROM DISK = %s WITH %s", name, disk, strings.Join(options, ", "))
+	default:
+		return fmt.Errorf("unsupported SQL Server backup type %d", backupType)
+	}
+
+	logger.Info(fmt.Sprintf("Running %s", statement))
+	_, err = db.Exec(statement)
+	return err
+}
+
+// serverLocalTime converts t to the local time of the server, which STOPAT
+// is read in. The conversion uses the rules of the server's time zone at
+// t, so a target on the other side of a daylight saving change gets that
+// side's offset.
+func serverLocalTime(db *sql.DB, t time.Time) (string, error) {
+	var zone sql.NullString
+	// CURRENT_TIMEZONE_ID() is new in SQL Server 2022; older servers keep
+	// their zone in the registry, which SQL Server on Linux emulates.
+	if err := db.QueryRow("SELECT CURRENT_TIMEZONE_ID()").Scan(&zone); err != nil {
+		err := db.QueryRow(`DECLARE @zone nvarchar(256);
+			EXEC master.dbo.xp_regread N'HKEY_LOCAL_MACHINE', N'SYSTEM\CurrentControlSet\Control\TimeZoneInformation', N'TimeZoneKeyName', @zone OUTPUT;
+			SELECT @zone`).Scan(&zone)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the server's time zone: %w", err)
+		}
+	}
+	if zone.String == "" {
+		return "", fmt.Errorf("failed to read the server's time zone")
+	}
+
+	var local string
+	err := db.QueryRow("SELECT CONVERT(char(19), CAST(@at AS datetimeoffset) AT TIME ZONE @zone, 126)",
+		sql.Named("at", t.UTC().Format("2006-01-02T15:04:05Z")), sql.Named("zone", zone.String)).Scan(&local)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert %s to the server's time zone %s: %w", t.Format(time.RFC3339), zone.String, err)
+	}
+	return local, nil
+}
+
+// moveOptions places every file of the backup in the server's default data
+// or log directory, named after the target database.
+func (d mssqlDriver) moveOptions(db *sql.DB, disk, database string) ([]string, error) {
+	var dataPath, logPath string
+	err := db.QueryRow(`SELECT CAST(SERVERPROPERTY('InstanceDefaultDataPath') AS nvarchar(4000)),
+		CAST(SERVERPROPERTY('InstanceDefaultLogPath') AS nvarchar(4000))`).Scan(&dataPath, &logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("RESTORE FILELISTONLY FROM DISK = " + disk)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var moves []string
+	for rows.Next() {
+		file, err := scanColumns(rows, "LogicalName", "PhysicalName", "Type")
+		if err != nil {
+			return nil, err
+		}
+		logical, physical, fileType := file[0], file[1], file[2]
+
+		dir := dataPath
+		if fileType == "L" {
+			dir = logPath
+		}
+		// The server may run on Windows, so take the extension after
+		// either kind of separator.
+		extension := path.Ext(strings.ReplaceAll(physical, `\`, "/"))
+		target := dir + database + "_" + logical + extension
+		moves = append(moves, fmt.Sprintf("MOVE %s TO %s", mssqlLiteral(logical), mssqlLiteral(target)))
+	}
+	return moves, rows.Err()
+}
+
+// queryColumn reads one column of the first row of a statement, such as
+// RESTORE HEADERONLY, that returns more columns than are needed.
+func queryColumn(db *sql.DB, query, column string, dest *int) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s returned no rows", query)
+	}
+	values, err := scanColumns(rows, column)
+	if err != nil {
+		return err
+	}
+	*dest, err = strconv.Atoi(values[0])
+	return err
+}
+
+// scanColumns returns the named columns of the current row as strings.
+func scanColumns(rows *sql.Rows, names ...string) ([]string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	result := make([]string, len(names))
+	for i, name := range names {
+		found := false
+		for j, column := range columns {
+			if strings.EqualFold(column, name) {
+				result[i], found = values[j].String, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("column %s not found", name)
+		}
+	}
+	return result, nil
+}
+
+func (d mssqlDriver) CreateDatabase(conn Connection, name string) error {
+	return d.exec(conn, "CREATE DATABASE "+mssqlIdentifier(name))
+}
+
+func (d mssqlDriver) DropDatabase(conn Connection, name string) error {
+	return d.exec(conn,
+		fmt.Sprintf("IF DB_ID(%s) IS NOT NULL ALTER DATABASE %s SET SINGLE_USER WITH ROLLBACK IMMEDIATE", mssqlLiteral(name), mssqlIdentifier(name)),
+		fmt.Sprintf("DROP DATABASE IF EXISTS %s", mssqlIdentifier(name)),
+	)
+}
+
+func (d mssqlDriver) QueryValue(conn Connection, query string) (string, error) {
+	db, err := d.open(conn, conn.Database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var value sql.NullString
+	err = db.QueryRow(query).Scan(&value)
+	return value.String, err
+}
+
+// TableRowCounts counts the rows of every user table, keyed by
+// schema.table.
+func (d mssqlDriver) TableRowCounts(conn Connection) (map[string]int64, error) {
+	db, err := d.open(conn, conn.Database)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT s.name, t.name FROM sys.tables t
+		JOIN sys.schemas s ON s.schema_id = t.schema_id
+		WHERE t.is_ms_shipped = 0 ORDER BY s.name, t.name`)
+	if err != nil {
+		return nil, err
+	}
+	var counts []string
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts = append(counts, fmt.Sprintf("SELECT %s, COUNT_BIG(*) FROM %s.%s",
+			mssqlLiteral(schema+"."+table), mssqlIdentifier(schema), mssqlIdentifier(table)))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int64, len(counts))
+	if len(counts) == 0 {
+		return result, nil
+	}
+	rows, err = db.Query(strings.Join(counts, " UNION ALL "))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var count int64
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		result[name] = count
+	}
+	return result, rows.Err()
+}
+
+// mssqlIdentifier quotes a T-SQL identifier with brackets.
+func mssqlIdentifier(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// mssqlLiteral quotes a Unicode string literal.
+func mssqlLiteral(value string) string {
+	return "N" + quoteLiteral(value)
+}
@@ -0,0 +1,153 @@
+package coreactions
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"yohan/databaseutilities/logger"
+)
+
+type mysqlDriver struct{}
+
+func init() {
+	Register(mysqlDriver{}, "mysql", "mariadb")
+}
+
+func (mysqlDriver) Capabilities() Capabilities {
+	return Capabilities{
+		TableBackup:        true,
+		TableRestore:       true,
+		PointInTimeRestore: true,
+	}
+}
+
+// FileExtension names incremental and differential backups, which hold raw
+// binlogs, after their format. Dumps are SQL text.
+func (mysqlDriver) FileExtension(kind string) string {
+	if kind == KindIncremental || kind == KindDifferential {
+		return ".binlog.tar"
+	}
+	return ".sql"
+}
+
+// command builds a MySQL client command with the connection arguments
+// placed before the caller's own arguments.
+func (mysqlDriver) command(conn Connection, name string, args ...string) *exec.Cmd {
+	args = append([]string{
+		fmt.Sprintf("-h%s", conn.Host),
+		fmt.Sprintf("-P%d", conn.Port),
+		fmt.Sprintf("-u%s", conn.Username),
+		fmt.Sprintf("-p%s", conn.Password),
+	}, args...)
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func (d mysqlDriver) ServerVersion(conn Connection) (string, error) {
+	cmd := d.command(conn, "mysql", "--batch", "--skip-column-names", "--execute=SELECT VERSION()")
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (mysqlDriver) ToolVersion() (string, error) {
+	out, err := exec.Command("mysqldump", "--version").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (d mysqlDriver) Backup(conn Connection, out io.Writer) error {
+	return d.dump(conn, out, nil)
+}
+
+func (d mysqlDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	return d.dump(conn, out, tables)
+}
+
+// dump runs mysqldump for the whole database, or for the given tables
+// only, with extra options placed before the database name.
+func (d mysqlDriver) dump(conn Connection, out io.Writer, tables []string, extra ...string) error {
+	args := append([]string{"--single-transaction"}, extra...)
+	if len(tables) == 0 {
+		args = append(args, "--routines", "--triggers", "--databases", conn.Database)
+	} else {
+		args = append(args, conn.Database)
+		args = append(args, tables...)
+	}
+	cmd := d.command(conn, "mysqldump", args...)
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+func (d mysqlDriver) Restore(conn Connection, in io.Reader) error {
+	if conn.Scratch {
+		in = stripDatabaseSwitch(in, mysqlDialect)
+	}
+	cmd := d.command(conn, "mysql", conn.Database)
+	cmd.Stdin = in
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// RestoreTables restores the given tables, with their rows and triggers,
+// from a full or table backup.
+func (d mysqlDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	filter := newMySQLTableFilter(in, tables)
+	cmd := d.command(conn, "mysql", conn.Database)
+	cmd.Stdin = filter
+	cmd.Stdout = os.Stdout
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	for _, table := range filter.Missing() {
+		logger.Warning(fmt.Sprintf("Table %s not found in backup file", table))
+	}
+	return nil
+}
+
+// query runs a single statement with the mysql client and returns its
+// tab-separated output without column names.
+func (d mysqlDriver) query(conn Connection, query string) (string, error) {
+	cmd := d.command(conn, "mysql", "--batch", "--skip-column-names", fmt.Sprintf("--execute=%s", query), conn.Database)
+	out, err := cmd.Output()
+	return strings.TrimRight(string(out), "\n"), err
+}
+
+func (d mysqlDriver) CreateDatabase(conn Connection, name string) error {
+	_, err := d.query(conn, fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(name, '`')))
+	return err
+}
+
+func (d mysqlDriver) DropDatabase(conn Connection, name string) error {
+	_, err := d.query(conn, fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(name, '`')))
+	return err
+}
+
+func (d mysqlDriver) QueryValue(conn Connection, query string) (string, error) {
+	return d.query(conn, query)
+}
+
+// TableRowCounts counts the rows of every base table in the database.
+func (d mysqlDriver) TableRowCounts(conn Connection) (map[string]int64, error) {
+	out, err := d.query(conn, `SELECT table_name FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_type = 'BASE TABLE'
+		ORDER BY table_name`)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []string
+	for _, name := range splitLines(out) {
+		counts = append(counts, fmt.Sprintf("SELECT %s, COUNT(*) FROM %s", quoteLiteral(name), quoteIdentifier(name, '`')))
+	}
+	if len(counts) == 0 {
+		return map[string]int64{}, nil
+	}
+
+	out, err = d.query(conn, strings.Join(counts, " UNION ALL "))
+	if err != nil {
+		return nil, err
+	}
+	return parseRowCounts(out)
+}
@@ -0,0 +1,127 @@
+package coreactions
+
+import (
+	"io"
+	"strings"
+)
+
+// mysqlTableFilter is a streaming reader that keeps the statements of a
+// mysqldump belonging to the requested tables: their structure, the
+// LOCK TABLES section with their rows, and their triggers. Every statement
+// naming a table starts that table's part of the dump; statements that
+// name none, such as UNLOCK TABLES, belong to the table before them.
+// Settings and DELIMITER are always kept; routines, events and views that
+// were not requested are not.
+type mysqlTableFilter struct {
+	sqlFilter
+	tableSelection
+	keep bool
+}
+
+func newMySQLTableFilter(in io.Reader, tables []string) *mysqlTableFilter {
+	f := &mysqlTableFilter{tableSelection: newTableSelection(tables), keep: true}
+	f.sqlFilter = sqlFilter{s: newSQLScanner(in, mysqlDialect), filter: f.filter}
+	return f
+}
+
+func (f *mysqlTableFilter) filter(st *sqlStatement) {
+	if len(st.Text) == 0 {
+		// The comments ending the dump.
+		f.emit(st)
+		return
+	}
+
+	tokens := sqlTokens(st.Text, 48)
+	switch {
+	case switchesDatabase(st, mysqlDialect):
+	case len(tokens) == 0, hasKeywords(tokens, "SET"), hasKeywords(tokens, "DELIMITER"), hasKeywords(tokens, "COMMIT"):
+		f.emit(st)
+	default:
+		switch table, object := mysqlStatementObject(tokens); {
+		case table != "":
+			f.keep = f.selected(table)
+		case object:
+			f.keep = false
+		}
+		if f.keep {
+			f.emit(st)
+		}
+	}
+}
+
+// mysqlStatementObject returns the table or view a statement of a dump
+// works on. object is true for statements creating or dropping something
+// else, such as a routine or an event.
+func mysqlStatementObject(tokens []string) (table string, object bool) {
+	switch {
+	case hasKeywords(tokens, "LOCK", "TABLES"):
+		table, _ = qualifiedName(tokens, 2)
+		return table, true
+	case hasKeywords(tokens, "INSERT"), hasKeywords(tokens, "REPLACE"):
+		i := skipKeywords(tokens, 1, "LOW_PRIORITY", "DELAYED", "HIGH_PRIORITY", "IGNORE", "INTO")
+		table, _ = qualifiedName(tokens, i)
+		return table, true
+	case hasKeywords(tokens, "CREATE"), hasKeywords(tokens, "DROP"), hasKeywords(tokens, "ALTER"):
+	default:
+		return "", false
+	}
+
+	// CREATE [ALGORITHM = ...] [DEFINER = user@host] [SQL SECURITY ...]
+	// VIEW, CREATE TRIGGER name ... ON table, and the like.
+	for i := 1; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i]) {
+		case "TABLE", "VIEW":
+			i = skipKeywords(tokens, i+1, "IF EXISTS", "IF", "NOT", "EXISTS")
+			table, _ = qualifiedName(tokens, i)
+			return table, true
+		case "TRIGGER":
+			if !hasKeywords(tokens, "CREATE") {
+				return "", true
+			}
+			for i++; i < len(tokens)-1; i++ {
+				if strings.EqualFold(tokens[i], "ON") {
+					table, _ = qualifiedName(tokens, i+1)
+					return table, true
+				}
+			}
+			return "", true
+		case "PROCEDURE", "FUNCTION", "EVENT", "DATABASE", "SCHEMA", "USER", "SERVER", "TABLESPACE":
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// tableSelection matches the tables of a dump against the requested ones
+// and remembers which were found.
+type tableSelection struct {
+	tables []string
+	found  map[string]bool
+}
+
+func newTableSelection(tables []string) tableSelection {
+	return tableSelection{tables: tables, found: map[string]bool{}}
+}
+
+// selected reports whether table is one of the requested tables, and
+// records that it was seen.
+func (s tableSelection) selected(table string) bool {
+	for _, name := range s.tables {
+		if containsTable([]string{name}, table) {
+			s.found[name] = true
+			return true
+		}
+	}
+	return false
+}
+
+// Missing returns the requested tables the dump did not contain.
+func (s tableSelection) Missing() []string {
+	var missing []string
+	for _, table := range s.tables {
+		if !s.found[table] {
+			missing = append(missing, table)
+		}
+	}
+	return missing
+}
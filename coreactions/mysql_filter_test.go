@@ -0,0 +1,158 @@
+package coreactions
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mysqlTestDump is shaped like mysqldump output: a header of settings,
+// then every table's structure, rows and triggers, then views and
+// routines.
+const mysqlTestDump = "-- MySQL dump 10.13\n" +
+	"/*!40101 SET NAMES utf8mb4 */;\n" +
+	"/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;\n" +
+	"\n" +
+	"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `shop`;\n" +
+	"USE `shop`;\n" +
+	"\n" +
+	"--\n-- Table structure for table `users`\n--\n\n" +
+	"DROP TABLE IF EXISTS `users`;\n" +
+	"CREATE TABLE `users` (\n  `id` int NOT NULL,\n  `note` text,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n" +
+	"\n" +
+	"LOCK TABLES `users` WRITE;\n" +
+	"/*!40000 ALTER TABLE `users` DISABLE KEYS */;\n" +
+	"INSERT INTO `users` VALUES (1,'DROP TABLE `users_archive`;'),(2,'it\\'s; fine');\n" +
+	"/*!40000 ALTER TABLE `users` ENABLE KEYS */;\n" +
+	"UNLOCK TABLES;\n" +
+	"\n" +
+	"DELIMITER ;;\n" +
+	"/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER `users_audit` AFTER INSERT ON `users_archive` FOR EACH ROW BEGIN INSERT INTO `users` VALUES (NEW.id, NULL); END */;;\n" +
+	"/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER `users_stamp` BEFORE INSERT ON `users` FOR EACH ROW BEGIN SET NEW.note = 'new'; END */;;\n" +
+	"DELIMITER ;\n" +
+	"\n" +
+	"--\n-- Table structure for table `users_archive`\n--\n\n" +
+	"DROP TABLE IF EXISTS `users_archive`;\n" +
+	"CREATE TABLE `users_archive` (\n  `id` int NOT NULL\n) ENGINE=InnoDB;\n" +
+	"\n" +
+	"LOCK TABLES `users_archive` WRITE;\n" +
+	"INSERT INTO `users_archive` VALUES (3);\n" +
+	"UNLOCK TABLES;\n" +
+	"\n" +
+	"--\n-- Final view structure for view `active_users`\n--\n\n" +
+	"/*!50001 DROP VIEW IF EXISTS `active_users`*/;\n" +
+	"/*!50001 CREATE ALGORITHM=UNDEFINED */ /*!50013 DEFINER=`root`@`%` SQL SECURITY DEFINER */ /*!50001 VIEW `active_users` AS select `users`.`id` AS `id` from `users` */;\n" +
+	"\n" +
+	"DELIMITER ;;\n" +
+	"CREATE DEFINER=`root`@`%` PROCEDURE `purge_users`()\nBEGIN\n  DELETE FROM `users`;\nEND ;;\n" +
+	"DELIMITER ;\n" +
+	"/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;\n" +
+	"\n-- Dump completed\n"
+
+func TestMySQLTableFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		tables  []string
+		keep    []string
+		drop    []string
+		missing []string
+	}{
+		{
+			name:   "prefix-named tables are told apart",
+			tables: []string{"users"},
+			keep: []string{
+				"CREATE TABLE `users` (",
+				"LOCK TABLES `users` WRITE;",
+				"/*!40000 ALTER TABLE `users` DISABLE KEYS */;",
+				"INSERT INTO `users` VALUES (1,'DROP TABLE `users_archive`;'),(2,'it\\'s; fine');",
+				"/*!40000 ALTER TABLE `users` ENABLE KEYS */;\nUNLOCK TABLES;",
+				"TRIGGER `users_stamp` BEFORE INSERT ON `users`",
+			},
+			drop: []string{
+				"CREATE TABLE `users_archive`",
+				"INSERT INTO `users_archive`",
+				"TRIGGER `users_audit`",
+				"`active_users`",
+				"PROCEDURE",
+				"CREATE DATABASE",
+				"USE `shop`",
+			},
+		},
+		{
+			name:   "LOCK TABLES and INSERT sections of the longer name",
+			tables: []string{"users_archive"},
+			keep: []string{
+				"CREATE TABLE `users_archive` (",
+				"LOCK TABLES `users_archive` WRITE;\nINSERT INTO `users_archive` VALUES (3);\nUNLOCK TABLES;",
+				"TRIGGER `users_audit` AFTER INSERT ON `users_archive`",
+			},
+			drop: []string{
+				"CREATE TABLE `users` (",
+				"LOCK TABLES `users` WRITE",
+				"INSERT INTO `users` VALUES (1,",
+				"TRIGGER `users_stamp`",
+			},
+		},
+		{
+			name:   "views are restored when named",
+			tables: []string{"active_users", "orders"},
+			keep: []string{
+				"/*!50001 DROP VIEW IF EXISTS `active_users`*/;",
+				"VIEW `active_users` AS select",
+			},
+			drop:    []string{"CREATE TABLE", "INSERT INTO", "TRIGGER", "PROCEDURE"},
+			missing: []string{"orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newMySQLTableFilter(strings.NewReader(mysqlTestDump), tt.tables)
+			out, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(out)
+
+			// Settings and DELIMITER lines are always kept, so the
+			// statements around them still parse.
+			for _, want := range append(tt.keep, "SET NAMES utf8mb4", "SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS", "DELIMITER ;\n") {
+				if !strings.Contains(got, want) {
+					t.Errorf("filtered dump lacks %q:\n%s", want, got)
+				}
+			}
+			for _, unwanted := range tt.drop {
+				if strings.Contains(got, unwanted) {
+					t.Errorf("filtered dump holds %q:\n%s", unwanted, got)
+				}
+			}
+			if missing := f.Missing(); !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("Missing() = %q, want %q", missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestMySQLStatementObject(t *testing.T) {
+	tests := []struct {
+		statement string
+		table     string
+		object    bool
+	}{
+		{"LOCK TABLES `users` WRITE;", "users", true},
+		{"INSERT IGNORE INTO `shop`.`users` VALUES (1);", "shop.users", true},
+		{"REPLACE INTO `users` VALUES (1);", "users", true},
+		{"DROP TABLE IF EXISTS `users_archive`;", "users_archive", true},
+		{"/*!50001 CREATE ALGORITHM=UNDEFINED */ /*!50013 DEFINER=`root`@`%` SQL SECURITY DEFINER */ /*!50001 VIEW `v` AS select 1 */;", "v", true},
+		{"/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER `t` BEFORE INSERT ON `users` FOR EACH ROW SET NEW.id = 1 */;;", "users", true},
+		{"/*!50003 DROP TRIGGER IF EXISTS `t` */;", "", true},
+		{"CREATE DEFINER=`root`@`%` PROCEDURE `p`() SELECT 1;", "", true},
+		{"UNLOCK TABLES;", "", false},
+	}
+	for _, tt := range tests {
+		table, object := mysqlStatementObject(sqlTokens([]byte(tt.statement), 48))
+		if table != tt.table || object != tt.object {
+			t.Errorf("mysqlStatementObject(%q) = %q, %v, want %q, %v", tt.statement, table, object, tt.table, tt.object)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package coreactions
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"yohan/databaseutilities/logger"
+)
+
+// binlogStatusVersion is the first MySQL release with SHOW BINARY LOG
+// STATUS; 8.4 removed the SHOW MASTER STATUS it replaces.
+var binlogStatusVersion = []int{8, 2, 0}
+
+// BackupIncremental reads the binlogs written since from off the server
+// and stores them, as raw binlog files, in a tar. The backup ends at the
+// binlog position the server reports when it starts, which is recorded in
+// m for the next backup of the chain. Raw events keep the backup free of
+// the source database's name and GTIDs, which are dealt with when the
+// backup is applied.
+func (d mysqlDriver) BackupIncremental(conn Connection, out io.Writer, from BinlogPosition, m *Manifest) error {
+	end, gtidSet, err := d.binlogStatus(conn, m.ServerVersion)
+	if err != nil {
+		return fmt.Errorf("failed to read the current binlog position: %w", err)
+	}
+
+	logs, err := d.BinaryLogs(conn)
+	if err != nil {
+		return fmt.Errorf("failed to list binlogs: %w", err)
+	}
+	first, last := -1, -1
+	for i, name := range logs {
+		if name == from.File {
+			first = i
+		}
+		if name == end.File {
+			last = i
+		}
+	}
+	if first == -1 {
+		return fmt.Errorf("binlog %s is no longer on the server: take a new full backup", from.File)
+	}
+	if last < first {
+		return fmt.Errorf("the server's binlog position %s is before %s", end, from)
+	}
+
+	if err := plaintextTemp("an incremental backup"); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "dbutility_binlogs_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	logger.Info(fmt.Sprintf("Backing up binlog events from %s to %s", from, end))
+	// --start-position applies to the first file given to mysqlbinlog;
+	// --stop-position is ignored in raw mode, so the last file is cut at
+	// the end position afterwards.
+	args := []string{
+		"--read-from-remote-server",
+		"--raw",
+		fmt.Sprintf("--result-file=%s%c", dir, filepath.Separator),
+		fmt.Sprintf("--start-position=%d", from.Position),
+	}
+	args = append(args, logs[first:last+1]...)
+	if err := d.command(conn, "mysqlbinlog", args...).Run(); err != nil {
+		return err
+	}
+	if err := trimBinlog(filepath.Join(dir, end.File), end.Position); err != nil {
+		return fmt.Errorf("failed to cut binlog %s at %s: %w", end.File, end, err)
+	}
+	if err := writeBinlogTar(out, dir, logs[first:last+1]); err != nil {
+		return err
+	}
+
+	m.BinlogFile = end.File
+	m.BinlogPosition = end.Position
+	m.GTIDExecuted = gtidSet
+	return nil
+}
+
+// trimBinlog truncates a raw binlog file after the event ending at
+// position. Every event header records the position the event ends at in
+// the server's file, whatever offset it has in this copy.
+func trimBinlog(path string, position int64) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(binlogMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, binlogMagic) {
+		return fmt.Errorf("not a binlog file")
+	}
+	offset := int64(len(binlogMagic))
+	// timestamp, type, server id, event size, end position, flags
+	header := make([]byte, 19)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.LittleEndian.Uint32(header[9:13]))
+		if int64(binary.LittleEndian.Uint32(header[13:17])) > position {
+			return f.Truncate(offset)
+		}
+		if size < int64(len(header)) {
+			return fmt.Errorf("invalid event at offset %d", offset)
+		}
+		if _, err := r.Discard(int(size) - len(header)); err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+// writeBinlogTar writes the named binlog files of dir to out as a tar.
+func writeBinlogTar(out io.Writer, dir string, names []string) error {
+	tw := tar.NewWriter(out)
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ApplyIncremental replays the binlogs of an incremental or differential
+// backup into the connection's database. The events of m's database are
+// rewritten to it, so a chain can be restored under another name, and on
+// MySQL they get new GTIDs, so a server that already executed them does
+// not skip them.
+func (d mysqlDriver) ApplyIncremental(conn Connection, in io.Reader, m *Manifest) error {
+	if err := plaintextTemp("applying an incremental backup"); err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "dbutility_binlogs_*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractTar(in, dir); err != nil {
+		return fmt.Errorf("backup is not a binlog archive: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []binlogFile
+	for _, entry := range entries {
+		match := binlogName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		sequence, _ := strconv.Atoi(match[2])
+		files = append(files, binlogFile{name: entry.Name(), path: filepath.Join(dir, entry.Name()), base: match[1], sequence: sequence})
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("backup holds no binlogs")
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].base != files[j].base {
+			return files[i].base < files[j].base
+		}
+		return files[i].sequence < files[j].sequence
+	})
+
+	// --database matches the rewritten name
+	args := []string{"--database", conn.Database}
+	if m.Database != "" && m.Database != conn.Database {
+		args = append(args, fmt.Sprintf("--rewrite-db=%s->%s", m.Database, conn.Database))
+	}
+	if !mariadbBinlogTool() {
+		args = append(args, "--skip-gtids")
+	}
+	for _, file := range files {
+		args = append(args, file.path)
+	}
+	return d.replayBinlogs(conn, args)
+}
+
+// mariadbBinlogTool reports whether the installed mysqlbinlog is MariaDB's,
+// which takes different options.
+func mariadbBinlogTool() bool {
+	version, err := exec.Command("mysqlbinlog", "--version").Output()
+	return err == nil && strings.Contains(string(version), "MariaDB")
+}
+
+// binlogStatus returns the position the server's binlog has reached and,
+// on MySQL, the executed GTID set.
+func (d mysqlDriver) binlogStatus(conn Connection, serverVersion string) (BinlogPosition, string, error) {
+	statement := "SHOW MASTER STATUS"
+	if !strings.Contains(serverVersion, "MariaDB") && versionAtLeast(serverVersion, binlogStatusVersion) {
+		statement = "SHOW BINARY LOG STATUS"
+	}
+	out, err := d.query(conn, statement)
+	if err != nil {
+		return BinlogPosition{}, "", err
+	}
+	lines := splitLines(out)
+	if len(lines) == 0 {
+		return BinlogPosition{}, "", fmt.Errorf("binary logging is disabled on the server")
+	}
+
+	// File, Position, Binlog_Do_DB, Binlog_Ignore_DB and, on MySQL,
+	// Executed_Gtid_Set, which is wrapped over several lines for long
+	// sets.
+	fields := strings.Split(lines[0], "\t")
+	if len(fields) < 2 {
+		return BinlogPosition{}, "", fmt.Errorf("unexpected binlog status %q", lines[0])
+	}
+	position, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return BinlogPosition{}, "", fmt.Errorf("unexpected binlog status %q", lines[0])
+	}
+	var gtidSet string
+	if len(fields) >= 5 {
+		gtidSet = strings.ReplaceAll(fields[4], `\n`, "")
+	}
+	return BinlogPosition{File: fields[0], Position: position}, gtidSet, nil
+}
+
+// versionAtLeast reports whether a server version such as 8.0.36-log is
+// at least minimum.
+func versionAtLeast(version string, minimum []int) bool {
+	parts := strings.FieldsFunc(version, func(r rune) bool { return r < '0' || r > '9' })
+	for i, want := range minimum {
+		if i >= len(parts) {
+			return false
+		}
+		part, _ := strconv.Atoi(parts[i])
+		if part != want {
+			return part > want
+		}
+	}
+	return true
+}
@@ -0,0 +1,639 @@
+package coreactions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"yohan/databaseutilities/logger"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The native MySQL dumper talks to the server directly, so mysqldump does
+// not need to be installed. Its output follows mysqldump's layout: the
+// mysql client restores it, the table filter of RestoreTables finds its
+// tables, and the binlog coordinates are written as the same commented
+// CHANGE MASTER statement --master-data=2 writes.
+//
+// It dumps tables, views, stored procedures and functions, and triggers.
+// Events are not dumped, as with mysqldump's defaults.
+
+// nativeInsertSize is the size extended INSERT statements are cut at, well
+// below the default max_allowed_packet.
+const nativeInsertSize = 1 << 20
+
+// openMySQL connects with go-sql-driver. TIMESTAMP values are read and
+// written in UTC, as mysqldump does.
+func openMySQL(conn Connection) (*sql.DB, error) {
+	cfg := mysql.NewConfig()
+	cfg.User = conn.Username
+	cfg.Passwd = conn.Password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))
+	cfg.DBName = conn.Database
+	cfg.Params = map[string]string{"time_zone": "'+00:00'"}
+	return sql.Open("mysql", cfg.FormatDSN())
+}
+
+// NativeDump writes a dump of the database, or of the given tables and
+// views, read from a single consistent snapshot. With binary logging
+// enabled the snapshot is taken under FLUSH TABLES WITH READ LOCK, as
+// mysqldump --master-data does, and its binlog coordinates are recorded
+// in m.
+func (mysqlDriver) NativeDump(conn Connection, out io.Writer, tables []string, m *Manifest) error {
+	db, err := openMySQL(conn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if m.ServerVersion == "" {
+		c.QueryRowContext(ctx, "SELECT VERSION()").Scan(&m.ServerVersion)
+	}
+
+	d := &mysqlDumper{ctx: ctx, c: c, w: bufio.NewWriterSize(out, 256*1024), database: conn.Database}
+	if err := d.snapshot(m); err != nil {
+		return err
+	}
+	defer c.ExecContext(ctx, "ROLLBACK")
+
+	if err := d.dump(tables); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// mysqlDumper writes a dump from one connection holding the snapshot.
+type mysqlDumper struct {
+	ctx      context.Context
+	c        *sql.Conn
+	w        *bufio.Writer
+	database string
+	// position is the binlog position of the snapshot, if known.
+	position *BinlogPosition
+	gtidSet  string
+}
+
+// snapshot starts the consistent snapshot transaction and reads the binlog
+// coordinates it was taken at. The global read lock needs the RELOAD
+// privilege; without it the dump is taken without coordinates.
+func (d *mysqlDumper) snapshot(m *Manifest) error {
+	var logBin sql.NullString
+	if err := d.c.QueryRowContext(d.ctx, "SELECT @@log_bin").Scan(&logBin); err != nil {
+		return err
+	}
+
+	locked := false
+	if logBin.String == "1" {
+		if err := d.lockTables(); err != nil {
+			logger.Warning(fmt.Sprintf("Failed to lock tables to read the binlog position, the backup will not record binlog coordinates: %v", err))
+		} else {
+			locked = true
+		}
+	} else {
+		logger.Warning("Binary logging is disabled on the server, the backup will not record binlog coordinates")
+	}
+
+	if err := d.beginSnapshot(); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	return d.unlockTables(m)
+}
+
+// lockTables blocks writes to every table until unlockTables, so
+// snapshots started meanwhile all see the same data.
+func (d *mysqlDumper) lockTables() error {
+	_, err := d.c.ExecContext(d.ctx, "FLUSH TABLES WITH READ LOCK")
+	return err
+}
+
+// beginSnapshot starts the transaction the dump is read in.
+func (d *mysqlDumper) beginSnapshot() error {
+	for _, statement := range []string{
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT",
+	} {
+		if _, err := d.c.ExecContext(d.ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlockTables reads the binlog position while writes are still blocked,
+// records it in m and releases the lock.
+func (d *mysqlDumper) unlockTables(m *Manifest) error {
+	err := d.readBinlogStatus()
+	if _, unlockErr := d.c.ExecContext(d.ctx, "UNLOCK TABLES"); err == nil {
+		err = unlockErr
+	}
+	if err != nil {
+		return err
+	}
+	if d.position != nil {
+		m.BinlogFile = d.position.File
+		m.BinlogPosition = d.position.Position
+		m.GTIDExecuted = d.gtidSet
+		logger.Info(fmt.Sprintf("Backup snapshot taken at binlog position %s", d.position))
+	}
+	return nil
+}
+
+// readBinlogStatus reads the current binlog position. MySQL 8.2 renamed
+// SHOW MASTER STATUS and 8.4 removed the old name.
+func (d *mysqlDumper) readBinlogStatus() error {
+	status, err := d.showRow("SHOW BINARY LOG STATUS")
+	if err != nil {
+		status, err = d.showRow("SHOW MASTER STATUS")
+	}
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return nil
+	}
+	position, err := strconv.ParseInt(status["Position"].String, 10, 64)
+	if err != nil {
+		return fmt.Errorf("unexpected binlog position %q", status["Position"].String)
+	}
+	d.position = &BinlogPosition{File: status["File"].String, Position: position}
+	d.gtidSet = strings.ReplaceAll(status["Executed_Gtid_Set"].String, "\n", "")
+	return nil
+}
+
+// showRow runs a SHOW statement and returns its first row by column name,
+// or nil if it returned none.
+func (d *mysqlDumper) showRow(query string, args ...any) (map[string]sql.NullString, error) {
+	rows, err := d.c.QueryContext(d.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+	row := make(map[string]sql.NullString, len(columns))
+	for i, column := range columns {
+		row[column] = values[i]
+	}
+	return row, nil
+}
+
+// queryStrings runs a query returning one string per row.
+func (d *mysqlDumper) queryStrings(query string, args ...any) ([]string, error) {
+	rows, err := d.c.QueryContext(d.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// dump writes the whole database, with its CREATE DATABASE statement and
+// routines, or only the given tables and views. The data and triggers of
+// every table follow its structure, as in mysqldump's output.
+func (d *mysqlDumper) dump(selected []string) error {
+	baseTables, views, err := d.objects(selected)
+	if err != nil {
+		return err
+	}
+
+	d.writeHeader()
+	if len(selected) == 0 {
+		if err := d.createDatabase(); err != nil {
+			return err
+		}
+	}
+
+	// Views may select from each other, so every view is first created as
+	// a placeholder with its columns and replaced by the real view at the
+	// end, as mysqldump does.
+	for _, view := range views {
+		if err := d.viewPlaceholder(view); err != nil {
+			return err
+		}
+	}
+	for _, table := range baseTables {
+		if err := d.table(table); err != nil {
+			return fmt.Errorf("failed to dump %s: %w", table, err)
+		}
+	}
+	if len(selected) == 0 {
+		if err := d.routines(); err != nil {
+			return err
+		}
+	}
+	for _, view := range views {
+		if err := d.view(view); err != nil {
+			return err
+		}
+	}
+
+	d.writeFooter()
+	return nil
+}
+
+// objects splits the tables of the database, or the selected ones, into
+// base tables and views.
+func (d *mysqlDumper) objects(selected []string) (baseTables, views []string, err error) {
+	rows, err := d.c.QueryContext(d.ctx, `SELECT TABLE_NAME, TABLE_TYPE FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = DATABASE() ORDER BY TABLE_NAME`)
+	if err != nil {
+		return nil, nil, err
+	}
+	kinds := make(map[string]string)
+	for rows.Next() {
+		var name, kind string
+		if err := rows.Scan(&name, &kind); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		kinds[name] = kind
+		if len(selected) == 0 {
+			if kind == "VIEW" {
+				views = append(views, name)
+			} else {
+				baseTables = append(baseTables, name)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range selected {
+		switch kind, ok := kinds[name]; {
+		case !ok:
+			return nil, nil, fmt.Errorf("table %s does not exist", name)
+		case kind == "VIEW":
+			views = append(views, name)
+		default:
+			baseTables = append(baseTables, name)
+		}
+	}
+	return baseTables, views, nil
+}
+
+func (d *mysqlDumper) writeHeader() {
+	fmt.Fprintf(d.w, "-- MySQL dump of %s written by dbutility\n", d.database)
+	d.w.WriteString(`
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET @OLD_CHARACTER_SET_RESULTS=@@CHARACTER_SET_RESULTS */;
+/*!40101 SET @OLD_COLLATION_CONNECTION=@@COLLATION_CONNECTION */;
+/*!50503 SET NAMES utf8mb4 */;
+/*!40103 SET @OLD_TIME_ZONE=@@TIME_ZONE */;
+/*!40103 SET TIME_ZONE='+00:00' */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;
+/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;
+/*!40111 SET @OLD_SQL_NOTES=@@SQL_NOTES, SQL_NOTES=0 */;
+
+`)
+	if d.position != nil {
+		d.w.WriteString("--\n-- Position to start replication or point-in-time recovery from\n--\n\n")
+		fmt.Fprintf(d.w, "-- CHANGE MASTER TO MASTER_LOG_FILE=%s, MASTER_LOG_POS=%d;\n\n", quoteLiteral(d.position.File), d.position.Position)
+		if d.gtidSet != "" {
+			fmt.Fprintf(d.w, "-- %s%s;\n\n", gtidPurgedPrefix, quoteLiteral(d.gtidSet))
+		}
+	}
+}
+
+func (d *mysqlDumper) writeFooter() {
+	d.w.WriteString(`/*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
+
+/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
+/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;
+/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;
+/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
+/*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;
+/*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;
+/*!40111 SET SQL_NOTES=@OLD_SQL_NOTES */;
+
+-- Dump completed
+`)
+}
+
+func (d *mysqlDumper) createDatabase() error {
+	quoted := quoteIdentifier(d.database, '`')
+	row, err := d.showRow("SHOW CREATE DATABASE " + quoted)
+	if err != nil {
+		return err
+	}
+	create := row["Create Database"].String
+	create = strings.Replace(create, "CREATE DATABASE "+quoted, "CREATE DATABASE /*!32312 IF NOT EXISTS*/ "+quoted, 1)
+	fmt.Fprintf(d.w, "--\n-- Current Database: %s\n--\n\n%s;\n\nUSE %s;\n\n", quoted, create, quoted)
+	return nil
+}
+
+func (d *mysqlDumper) table(name string) error {
+	if err := d.tableStructure(name); err != nil {
+		return err
+	}
+	if err := d.tableData(name); err != nil {
+		return err
+	}
+	return d.triggers(name)
+}
+
+func (d *mysqlDumper) tableStructure(name string) error {
+	create, err := d.createTable(name)
+	if err != nil {
+		return err
+	}
+	d.writeTableStructure(name, create)
+	return nil
+}
+
+// createTable returns the CREATE TABLE statement of a table.
+func (d *mysqlDumper) createTable(name string) (string, error) {
+	row, err := d.showRow("SHOW CREATE TABLE " + quoteIdentifier(name, '`'))
+	if err != nil {
+		return "", err
+	}
+	return row["Create Table"].String, nil
+}
+
+func (d *mysqlDumper) writeTableStructure(name, create string) {
+	quoted := quoteIdentifier(name, '`')
+	fmt.Fprintf(d.w, "--\n-- Table structure for table %s\n--\n\n", quoted)
+	fmt.Fprintf(d.w, "DROP TABLE IF EXISTS %s;\n", quoted)
+	d.w.WriteString("/*!40101 SET @saved_cs_client     = @@character_set_client */;\n/*!50503 SET character_set_client = utf8mb4 */;\n")
+	fmt.Fprintf(d.w, "%s;\n", create)
+	d.w.WriteString("/*!40101 SET character_set_client = @saved_cs_client */;\n\n")
+}
+
+// tableData writes the rows of a table as extended INSERT statements.
+// Generated columns are computed again on restore and left out.
+func (d *mysqlDumper) tableData(name string) error {
+	quoted := quoteIdentifier(name, '`')
+	columns, err := d.queryStrings(`SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+			AND EXTRA NOT LIKE '%VIRTUAL GENERATED%' AND EXTRA NOT LIKE '%STORED GENERATED%' AND EXTRA NOT LIKE '%PERSISTENT GENERATED%'
+		ORDER BY ORDINAL_POSITION`, name)
+	if err != nil {
+		return err
+	}
+	for i, column := range columns {
+		columns[i] = quoteIdentifier(column, '`')
+	}
+	columnList := strings.Join(columns, ",")
+
+	rows, err := d.c.QueryContext(d.ctx, fmt.Sprintf("SELECT %s FROM %s", columnList, quoted))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	encoders := make([]func(*bytes.Buffer, []byte), len(types))
+	for i, t := range types {
+		encoders[i] = mysqlValueEncoder(t.DatabaseTypeName())
+	}
+
+	fmt.Fprintf(d.w, "--\n-- Dumping data for table %s\n--\n\n", quoted)
+	fmt.Fprintf(d.w, "LOCK TABLES %s WRITE;\n/*!40000 ALTER TABLE %s DISABLE KEYS */;\n", quoted, quoted)
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoted, columnList)
+	values := make([]sql.RawBytes, len(types))
+	dest := make([]any, len(types))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	var row bytes.Buffer
+	written := 0
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if written == 0 {
+			d.w.WriteString(insert)
+		} else {
+			d.w.WriteByte(',')
+		}
+
+		row.Reset()
+		row.WriteByte('(')
+		for i, value := range values {
+			if i > 0 {
+				row.WriteByte(',')
+			}
+			if value == nil {
+				row.WriteString("NULL")
+			} else {
+				encoders[i](&row, value)
+			}
+		}
+		row.WriteByte(')')
+		d.w.Write(row.Bytes())
+
+		written += row.Len()
+		if written >= nativeInsertSize {
+			d.w.WriteString(";\n")
+			written = 0
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if written > 0 {
+		d.w.WriteString(";\n")
+	}
+	fmt.Fprintf(d.w, "/*!40000 ALTER TABLE %s ENABLE KEYS */;\nUNLOCK TABLES;\n\n", quoted)
+	return nil
+}
+
+// mysqlValueEncoder returns how values of a column type are written:
+// numbers as they are, binary strings and bit values in hex and everything
+// else as escaped string literals.
+func mysqlValueEncoder(databaseType string) func(*bytes.Buffer, []byte) {
+	switch strings.TrimPrefix(databaseType, "UNSIGNED ") {
+	case "TINYINT", "SMALLINT", "MEDIUMINT", "INT", "BIGINT", "DECIMAL", "FLOAT", "DOUBLE", "YEAR":
+		return func(w *bytes.Buffer, value []byte) { w.Write(value) }
+	case "BINARY", "VARBINARY", "TINYBLOB", "BLOB", "MEDIUMBLOB", "LONGBLOB", "BIT", "GEOMETRY":
+		return writeMySQLHex
+	default:
+		return writeMySQLString
+	}
+}
+
+func writeMySQLHex(w *bytes.Buffer, value []byte) {
+	if len(value) == 0 {
+		w.WriteString("''")
+		return
+	}
+	w.WriteString("0x")
+	w.WriteString(hex.EncodeToString(value))
+}
+
+// writeMySQLString writes a string literal escaped like
+// mysql_real_escape_string.
+func writeMySQLString(w *bytes.Buffer, value []byte) {
+	w.WriteByte('\'')
+	for _, c := range value {
+		switch c {
+		case 0:
+			w.WriteString(`\0`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case '\\':
+			w.WriteString(`\\`)
+		case '\'':
+			w.WriteString(`\'`)
+		case '"':
+			w.WriteString(`\"`)
+		case 0x1a:
+			w.WriteString(`\Z`)
+		default:
+			w.WriteByte(c)
+		}
+	}
+	w.WriteByte('\'')
+}
+
+// triggers writes the triggers of a table after its data, so they do not
+// fire during the restore.
+func (d *mysqlDumper) triggers(table string) error {
+	names, err := d.queryStrings(`SELECT TRIGGER_NAME FROM information_schema.TRIGGERS
+		WHERE EVENT_OBJECT_SCHEMA = DATABASE() AND EVENT_OBJECT_TABLE = ?
+		ORDER BY ACTION_TIMING, EVENT_MANIPULATION, ACTION_ORDER`, table)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		row, err := d.showRow("SHOW CREATE TRIGGER " + quoteIdentifier(name, '`'))
+		if err != nil {
+			return err
+		}
+		d.writeWithSQLMode(row["sql_mode"].String, row["SQL Original Statement"].String)
+	}
+	return nil
+}
+
+// routines writes the stored procedures and functions.
+func (d *mysqlDumper) routines() error {
+	rows, err := d.c.QueryContext(d.ctx, `SELECT ROUTINE_TYPE, ROUTINE_NAME FROM information_schema.ROUTINES
+		WHERE ROUTINE_SCHEMA = DATABASE() AND ROUTINE_TYPE IN ('FUNCTION', 'PROCEDURE')
+		ORDER BY ROUTINE_TYPE, ROUTINE_NAME`)
+	if err != nil {
+		return err
+	}
+	type routine struct{ kind, name string }
+	var routines []routine
+	for rows.Next() {
+		var r routine
+		if err := rows.Scan(&r.kind, &r.name); err != nil {
+			rows.Close()
+			return err
+		}
+		routines = append(routines, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(routines) == 0 {
+		return nil
+	}
+
+	d.w.WriteString("--\n-- Dumping routines\n--\n\n")
+	for _, r := range routines {
+		quoted := quoteIdentifier(r.name, '`')
+		row, err := d.showRow(fmt.Sprintf("SHOW CREATE %s %s", r.kind, quoted))
+		if err != nil {
+			return err
+		}
+		column := "Create Procedure"
+		if r.kind == "FUNCTION" {
+			column = "Create Function"
+		}
+		if !row[column].Valid {
+			return fmt.Errorf("not allowed to read the definition of %s %s", strings.ToLower(r.kind), r.name)
+		}
+		fmt.Fprintf(d.w, "/*!50003 DROP %s IF EXISTS %s */;\n", r.kind, quoted)
+		d.writeWithSQLMode(row["sql_mode"].String, row[column].String)
+	}
+	return nil
+}
+
+// writeWithSQLMode writes a routine or trigger definition between
+// DELIMITER statements, under the SQL mode it was created with.
+func (d *mysqlDumper) writeWithSQLMode(sqlMode, definition string) {
+	d.w.WriteString("/*!50003 SET @saved_sql_mode = @@sql_mode */ ;\n")
+	fmt.Fprintf(d.w, "/*!50003 SET sql_mode = %s */ ;\n", quoteLiteral(sqlMode))
+	fmt.Fprintf(d.w, "DELIMITER ;;\n%s ;;\nDELIMITER ;\n", definition)
+	d.w.WriteString("/*!50003 SET sql_mode = @saved_sql_mode */ ;\n\n")
+}
+
+// viewPlaceholder creates a view of constants with the columns of a view,
+// so other views can refer to it before it is created.
+func (d *mysqlDumper) viewPlaceholder(name string) error {
+	columns, err := d.queryStrings(`SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, name)
+	if err != nil {
+		return err
+	}
+	for i, column := range columns {
+		columns[i] = "1 AS " + quoteIdentifier(column, '`')
+	}
+	quoted := quoteIdentifier(name, '`')
+	fmt.Fprintf(d.w, "--\n-- Temporary view structure for view %s\n--\n\n", quoted)
+	fmt.Fprintf(d.w, "DROP TABLE IF EXISTS %s;\n/*!50001 DROP VIEW IF EXISTS %s*/;\n", quoted, quoted)
+	fmt.Fprintf(d.w, "/*!50001 CREATE VIEW %s AS SELECT \n %s */;\n\n", quoted, strings.Join(columns, ",\n "))
+	return nil
+}
+
+func (d *mysqlDumper) view(name string) error {
+	quoted := quoteIdentifier(name, '`')
+	row, err := d.showRow("SHOW CREATE VIEW " + quoted)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(d.w, "--\n-- Final view structure for view %s\n--\n\n", quoted)
+	fmt.Fprintf(d.w, "/*!50001 DROP VIEW IF EXISTS %s*/;\n", quoted)
+	fmt.Fprintf(d.w, "/*!50001 %s */;\n\n", row["Create View"].String)
+	return nil
+}
@@ -0,0 +1,281 @@
+package coreactions
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"yohan/databaseutilities/logger"
+)
+
+// OpenSnapshot opens a connection for every worker and starts their
+// snapshot transactions under one FLUSH TABLES WITH READ LOCK, so they all
+// see the same data, as mydumper does. The rows are read with the native
+// dumper, as separate mysqldump runs cannot share a snapshot.
+func (mysqlDriver) OpenSnapshot(conn Connection, workers int, m *Manifest) (TableSnapshot, error) {
+	if DumpEngine == EngineTool {
+		return nil, fmt.Errorf("parallel MySQL backups are written by the native dumper and cannot use --engine=tool")
+	}
+	db, err := openMySQL(conn)
+	if err != nil {
+		return nil, err
+	}
+	s := &mysqlSnapshot{db: db, workers: make(chan *mysqlDumper, workers), keys: map[string]tableKeys{}}
+	if err := s.open(conn, workers, m); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// mysqlSnapshot is a set of connections reading the same snapshot: main
+// writes the schema and post-data parts, the workers the rows of the
+// tables.
+type mysqlSnapshot struct {
+	db      *sql.DB
+	main    *mysqlDumper
+	workers chan *mysqlDumper
+	all     []*mysqlDumper
+	// keys holds the keys Schema left out of each table, for PostData.
+	keys map[string]tableKeys
+}
+
+func (s *mysqlSnapshot) open(conn Connection, workers int, m *Manifest) error {
+	ctx := context.Background()
+	newDumper := func() (*mysqlDumper, error) {
+		c, err := s.db.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d := &mysqlDumper{ctx: ctx, c: c, database: conn.Database}
+		s.all = append(s.all, d)
+		return d, nil
+	}
+
+	main, err := newDumper()
+	if err != nil {
+		return err
+	}
+	s.main = main
+	if m.ServerVersion == "" {
+		main.c.QueryRowContext(ctx, "SELECT VERSION()").Scan(&m.ServerVersion)
+	}
+	m.DumpToolVersion = "dbutility native " + ToolVersion
+
+	locked := true
+	if err := main.lockTables(); err != nil {
+		if !AllowInconsistent {
+			return fmt.Errorf("failed to lock tables for a consistent snapshot, which needs the RELOAD privilege (use --allow-inconsistent to back up anyway): %w", err)
+		}
+		logger.Warning(fmt.Sprintf("Failed to lock tables, the tables of the backup may be read from different points in time and no binlog coordinates are recorded: %v", err))
+		locked = false
+	}
+	for i := 0; i < workers; i++ {
+		d, err := newDumper()
+		if err != nil {
+			return err
+		}
+		if err := d.beginSnapshot(); err != nil {
+			return err
+		}
+		s.workers <- d
+	}
+	if err := main.beginSnapshot(); err != nil {
+		return err
+	}
+	if locked {
+		return main.unlockTables(m)
+	}
+	return nil
+}
+
+// Tables returns the base tables among selected, largest first so the
+// longest dumps start early.
+func (s *mysqlSnapshot) Tables(selected []string) ([]string, error) {
+	baseTables, _, err := s.main.objects(selected)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool, len(baseTables))
+	for _, table := range baseTables {
+		wanted[table] = true
+	}
+
+	bySize, err := s.main.queryStrings(`SELECT TABLE_NAME FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_TYPE <> 'VIEW'
+		ORDER BY COALESCE(DATA_LENGTH, 0) DESC, TABLE_NAME`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for _, table := range bySize {
+		if wanted[table] {
+			tables = append(tables, table)
+		}
+	}
+	return tables, nil
+}
+
+// Schema writes the CREATE DATABASE statement of a full backup, the table
+// structures and placeholders for the views. The tables are created with
+// their primary keys only, so the rows are loaded in key order without
+// maintaining other indexes; the rest of the keys are added by PostData.
+func (s *mysqlSnapshot) Schema(out io.Writer, selected []string) error {
+	d := s.main
+	baseTables, views, err := d.objects(selected)
+	if err != nil {
+		return err
+	}
+	return d.writeTo(out, func() error {
+		if len(selected) == 0 {
+			if err := d.createDatabase(); err != nil {
+				return err
+			}
+		}
+		for _, view := range views {
+			if err := d.viewPlaceholder(view); err != nil {
+				return err
+			}
+		}
+		for _, table := range baseTables {
+			create, err := d.createTable(table)
+			if err != nil {
+				return err
+			}
+			create, keys := splitTableKeys(create)
+			s.keys[table] = keys
+			d.writeTableStructure(table, create)
+		}
+		return nil
+	})
+}
+
+// TableData writes the rows of a table with the next free worker.
+func (s *mysqlSnapshot) TableData(out io.Writer, table string) error {
+	d := <-s.workers
+	defer func() { s.workers <- d }()
+	return d.writeTo(out, func() error {
+		return d.tableData(table)
+	})
+}
+
+// PostData writes the secondary indexes and foreign keys Schema left out,
+// the triggers, the routines of a full backup and the views. Foreign keys
+// are added once every table has its indexes, which they may need.
+func (s *mysqlSnapshot) PostData(out io.Writer, selected []string) error {
+	d := s.main
+	baseTables, views, err := d.objects(selected)
+	if err != nil {
+		return err
+	}
+	return d.writeTo(out, func() error {
+		for _, table := range baseTables {
+			writeAddKeys(d.w, "Indexes", table, s.keys[table].indexes)
+		}
+		for _, table := range baseTables {
+			writeAddKeys(d.w, "Foreign keys", table, s.keys[table].foreignKeys)
+		}
+		for _, table := range baseTables {
+			if err := d.triggers(table); err != nil {
+				return err
+			}
+		}
+		if len(selected) == 0 {
+			if err := d.routines(); err != nil {
+				return err
+			}
+		}
+		for _, view := range views {
+			if err := d.view(view); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *mysqlSnapshot) Close() error {
+	for _, d := range s.all {
+		d.c.ExecContext(d.ctx, "ROLLBACK")
+		d.c.Close()
+	}
+	return s.db.Close()
+}
+
+// writeTo writes one file of a dump, with the usual header and footer, to
+// out.
+func (d *mysqlDumper) writeTo(out io.Writer, write func() error) error {
+	d.w = bufio.NewWriterSize(out, 256*1024)
+	d.writeHeader()
+	if err := write(); err != nil {
+		return err
+	}
+	d.writeFooter()
+	return d.w.Flush()
+}
+
+// tableKeys are the definitions of the keys of a table that are created
+// after its rows are loaded.
+type tableKeys struct {
+	indexes     []string
+	foreignKeys []string
+}
+
+// splitTableKeys takes the secondary indexes and foreign keys out of a
+// CREATE TABLE statement as written by SHOW CREATE TABLE, one definition
+// per line. The primary key stays, as InnoDB stores the rows in it, and so
+// does the first key on an AUTO_INCREMENT column, which the column needs.
+func splitTableKeys(create string) (string, tableKeys) {
+	var keys tableKeys
+	lines := strings.Split(create, "\n")
+	last := len(lines) - 1
+	if last < 2 || !strings.HasSuffix(lines[0], "(") || !strings.HasPrefix(lines[last], ")") {
+		return create, keys
+	}
+
+	var autoIncrement string
+	for _, line := range lines[1:last] {
+		definition := strings.TrimSpace(line)
+		if strings.HasPrefix(definition, "`") && strings.Contains(definition, " AUTO_INCREMENT") {
+			autoIncrement, _, _ = strings.Cut(definition[1:], "` ")
+		}
+	}
+
+	var kept []string
+	for _, line := range lines[1:last] {
+		definition := strings.TrimSuffix(strings.TrimSpace(line), ",")
+		switch {
+		case strings.HasPrefix(definition, "PRIMARY KEY "):
+			if autoIncrement != "" && strings.Contains(definition, " (`"+autoIncrement+"`") {
+				autoIncrement = ""
+			}
+			kept = append(kept, "  "+definition)
+		case strings.HasPrefix(definition, "CONSTRAINT ") && strings.Contains(definition, " FOREIGN KEY "):
+			keys.foreignKeys = append(keys.foreignKeys, definition)
+		case strings.HasPrefix(definition, "KEY "), strings.HasPrefix(definition, "UNIQUE KEY "),
+			strings.HasPrefix(definition, "FULLTEXT KEY "), strings.HasPrefix(definition, "SPATIAL KEY "):
+			if autoIncrement != "" && strings.Contains(definition, " (`"+autoIncrement+"`") {
+				kept = append(kept, "  "+definition)
+				autoIncrement = ""
+				continue
+			}
+			keys.indexes = append(keys.indexes, definition)
+		default:
+			kept = append(kept, "  "+definition)
+		}
+	}
+	return lines[0] + "\n" + strings.Join(kept, ",\n") + "\n" + lines[last], keys
+}
+
+// writeAddKeys writes an ALTER TABLE statement adding the given keys to a
+// table.
+func writeAddKeys(w *bufio.Writer, title, table string, definitions []string) {
+	if len(definitions) == 0 {
+		return
+	}
+	quoted := quoteIdentifier(table, '`')
+	fmt.Fprintf(w, "--\n-- %s for table %s\n--\n\n", title, quoted)
+	fmt.Fprintf(w, "ALTER TABLE %s\n  ADD %s;\n\n", quoted, strings.Join(definitions, ",\n  ADD "))
+}
@@ -0,0 +1,98 @@
+package coreactions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitTableKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		create string
+		table  string
+		keys   tableKeys
+	}{
+		{
+			name: "secondary keys and foreign keys are moved",
+			create: "CREATE TABLE `orders` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `user_id` int NOT NULL,\n" +
+				"  `body` text,\n" +
+				"  `area` geometry NOT NULL /*!80003 SRID 0 */,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  UNIQUE KEY `orders_user` (`user_id`,`id`),\n" +
+				"  KEY `orders_user_id` (`user_id`),\n" +
+				"  FULLTEXT KEY `orders_body` (`body`),\n" +
+				"  SPATIAL KEY `orders_area` (`area`),\n" +
+				"  CONSTRAINT `orders_users` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE,\n" +
+				"  CONSTRAINT `orders_positive` CHECK ((`id` > 0))\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			table: "CREATE TABLE `orders` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `user_id` int NOT NULL,\n" +
+				"  `body` text,\n" +
+				"  `area` geometry NOT NULL /*!80003 SRID 0 */,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  CONSTRAINT `orders_positive` CHECK ((`id` > 0))\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			keys: tableKeys{
+				indexes: []string{
+					"UNIQUE KEY `orders_user` (`user_id`,`id`)",
+					"KEY `orders_user_id` (`user_id`)",
+					"FULLTEXT KEY `orders_body` (`body`)",
+					"SPATIAL KEY `orders_area` (`area`)",
+				},
+				foreignKeys: []string{"CONSTRAINT `orders_users` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE"},
+			},
+		},
+		{
+			name: "AUTO_INCREMENT column in the primary key",
+			create: "CREATE TABLE `users` (\n" +
+				"  `id` int NOT NULL AUTO_INCREMENT,\n" +
+				"  `email` varchar(255) NOT NULL,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  UNIQUE KEY `users_email` (`email`)\n" +
+				") ENGINE=InnoDB AUTO_INCREMENT=42",
+			table: "CREATE TABLE `users` (\n" +
+				"  `id` int NOT NULL AUTO_INCREMENT,\n" +
+				"  `email` varchar(255) NOT NULL,\n" +
+				"  PRIMARY KEY (`id`)\n" +
+				") ENGINE=InnoDB AUTO_INCREMENT=42",
+			keys: tableKeys{indexes: []string{"UNIQUE KEY `users_email` (`email`)"}},
+		},
+		{
+			name: "AUTO_INCREMENT column outside the primary key keeps its first key",
+			create: "CREATE TABLE `events` (\n" +
+				"  `tenant` int NOT NULL,\n" +
+				"  `seq` bigint NOT NULL AUTO_INCREMENT,\n" +
+				"  PRIMARY KEY (`tenant`,`seq`),\n" +
+				"  KEY `events_tenant` (`tenant`),\n" +
+				"  UNIQUE KEY `events_seq` (`seq`),\n" +
+				"  KEY `events_seq_tenant` (`seq`,`tenant`)\n" +
+				") ENGINE=InnoDB",
+			table: "CREATE TABLE `events` (\n" +
+				"  `tenant` int NOT NULL,\n" +
+				"  `seq` bigint NOT NULL AUTO_INCREMENT,\n" +
+				"  PRIMARY KEY (`tenant`,`seq`),\n" +
+				"  UNIQUE KEY `events_seq` (`seq`)\n" +
+				") ENGINE=InnoDB",
+			keys: tableKeys{indexes: []string{"KEY `events_tenant` (`tenant`)", "KEY `events_seq_tenant` (`seq`,`tenant`)"}},
+		},
+		{
+			name:   "table without keys",
+			create: "CREATE TABLE `log` (\n  `line` text\n) ENGINE=MyISAM",
+			table:  "CREATE TABLE `log` (\n  `line` text\n) ENGINE=MyISAM",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, keys := splitTableKeys(tt.create)
+			if table != tt.table {
+				t.Errorf("table\n%s\nwant\n%s", table, tt.table)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("keys = %q, want %q", keys, tt.keys)
+			}
+		})
+	}
+}
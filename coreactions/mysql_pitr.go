@@ -0,0 +1,331 @@
+package coreactions
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// binlogMagic starts every MySQL binary log file.
+var binlogMagic = []byte{0xfe, 'b', 'i', 'n'}
+
+// binlogName matches binary log file names such as mysql-bin.000042.
+var binlogName = regexp.MustCompile(`^(.+)\.(\d+)$`)
+
+// binlogFile is a binary log of the archive, and once fetched the local
+// file mysqlbinlog reads.
+type binlogFile struct {
+	name     string // file name as written by the server
+	key      string // key of the archived object
+	path     string // local path of the readable file
+	base     string
+	sequence int
+}
+
+// PointInTimeRestore restores the full dump and then replays the binary
+// logs from Recovery.BinlogArchive on top of it. The replay starts at the
+// binlog coordinates recorded in the backup manifest and stops at the
+// target time, binlog position or GTID set.
+func (d mysqlDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	if Recovery.BinlogArchive == "" {
+		return fmt.Errorf("no binlog source configured: set --binlog-archive for MySQL point-in-time recovery")
+	}
+
+	st, files, err := listBinlogs(Recovery.BinlogArchive)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to list binlogs: %v", err))
+		return err
+	}
+	files, err = binlogsToReplay(files, target)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	files, cleanup, err := fetchBinlogs(st, files, target.Time)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to fetch binlogs: %v", err))
+		return err
+	}
+	defer cleanup()
+
+	if err := d.Restore(conn, in); err != nil {
+		return err
+	}
+
+	args := []string{"--database", conn.Database}
+	switch {
+	case target.Start != nil:
+		args = append(args, fmt.Sprintf("--start-position=%d", target.Start.Position))
+	case target.StartGTIDs != "":
+		args = append(args, fmt.Sprintf("--exclude-gtids=%s", target.StartGTIDs))
+	default:
+		logger.Warning("Backup has no recorded binlog coordinates, replaying every available binlog")
+	}
+	if !target.Time.IsZero() {
+		// mysqlbinlog runs here and reads the date in the local time zone
+		args = append(args, fmt.Sprintf("--stop-datetime=%s", target.Time.Local().Format("2006-01-02 15:04:05")))
+	}
+	if target.StopPosition != nil {
+		// --stop-position applies to the last file given to mysqlbinlog
+		args = append(args, fmt.Sprintf("--stop-position=%d", target.StopPosition.Position))
+	}
+	if target.StopGTIDs != "" {
+		args = append(args, fmt.Sprintf("--include-gtids=%s", target.StopGTIDs))
+	}
+	for _, file := range files {
+		args = append(args, file.path)
+	}
+
+	logger.Info(fmt.Sprintf("Replaying %d binlog files from %s to %s", len(files), files[0].name, files[len(files)-1].name))
+	return d.replayBinlogs(conn, args)
+}
+
+// replayBinlogs pipes the output of mysqlbinlog into the mysql client.
+func (d mysqlDriver) replayBinlogs(conn Connection, args []string) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create pipe: %v", err))
+		return err
+	}
+
+	binlogCmd := d.command(conn, "mysqlbinlog", args...)
+	binlogCmd.Stdout = pw
+	mysqlCmd := d.command(conn, "mysql", conn.Database)
+	mysqlCmd.Stdin = pr
+
+	if err := mysqlCmd.Start(); err != nil {
+		pr.Close()
+		pw.Close()
+		logger.Error(fmt.Sprintf("Failed to start mysql: %v", err))
+		return err
+	}
+	if err := binlogCmd.Start(); err != nil {
+		pr.Close()
+		pw.Close()
+		mysqlCmd.Wait()
+		logger.Error(fmt.Sprintf("Failed to start mysqlbinlog: %v", err))
+		return err
+	}
+
+	// The children hold their own copies of the pipe, so mysql sees end of
+	// input as soon as mysqlbinlog exits.
+	pr.Close()
+	pw.Close()
+
+	binlogErr := binlogCmd.Wait()
+	mysqlErr := mysqlCmd.Wait()
+	if binlogErr != nil {
+		logger.Error(fmt.Sprintf("mysqlbinlog failed: %v", binlogErr))
+		return binlogErr
+	}
+	if mysqlErr != nil {
+		logger.Error(fmt.Sprintf("mysql failed: %v", mysqlErr))
+		return mysqlErr
+	}
+	return nil
+}
+
+// binlogsToReplay orders the binary logs and keeps those between the start
+// and stop coordinates of the target.
+func binlogsToReplay(files []binlogFile, target RecoveryTarget) ([]binlogFile, error) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].base != files[j].base {
+			return files[i].base < files[j].base
+		}
+		return files[i].sequence < files[j].sequence
+	})
+
+	first, last := 0, len(files)-1
+	if target.Start != nil {
+		first = indexOfBinlog(files, target.Start.File)
+		if first < 0 {
+			return nil, fmt.Errorf("binlog %s recorded in the backup manifest is not available", target.Start.File)
+		}
+	}
+	if target.StopPosition != nil {
+		last = indexOfBinlog(files, target.StopPosition.File)
+		if last < 0 {
+			return nil, fmt.Errorf("stop binlog %s is not available", target.StopPosition.File)
+		}
+	}
+	if len(files) == 0 || first > last {
+		return nil, fmt.Errorf("no binlogs to replay between the backup and the recovery target")
+	}
+
+	// Every file from the start on must be present, a gap would silently
+	// drop transactions.
+	for i := first + 1; i <= last; i++ {
+		if files[i].base == files[i-1].base && files[i].sequence != files[i-1].sequence+1 {
+			return nil, fmt.Errorf("binlog sequence has a gap between %s and %s", files[i-1].name, files[i].name)
+		}
+	}
+	return files[first : last+1], nil
+}
+
+func indexOfBinlog(files []binlogFile, name string) int {
+	for i, file := range files {
+		if file.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// listBinlogs lists the binary logs at location without fetching them.
+func listBinlogs(location string) (store.Store, []binlogFile, error) {
+	st, prefix, err := store.Open(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prefix != "" && prefix[len(prefix)-1] != '/' {
+		prefix += "/"
+	}
+	objects, err := st.List(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []binlogFile
+	for _, object := range objects {
+		name := archivedName(path.Base(filepath.ToSlash(object.Key)))
+		match := binlogName.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		sequence, _ := strconv.Atoi(match[2])
+		files = append(files, binlogFile{name: name, key: object.Key, base: match[1], sequence: sequence})
+	}
+	return st, files, nil
+}
+
+// fetchBinlogs makes the binary logs to replay available as plain local
+// files, in order. Plain binlogs in a local directory are used in place;
+// remote, compressed or encrypted ones are decoded into a temporary
+// directory that cleanup removes. Fetching stops at the first binlog
+// created after stopTime, as nothing in it or after it is replayed.
+func fetchBinlogs(st store.Store, files []binlogFile, stopTime time.Time) ([]binlogFile, func(), error) {
+	noop := func() {}
+	tempDir, err := os.MkdirTemp("", "dbutility_binlogs_*")
+	if err != nil {
+		return nil, noop, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	_, local := st.(*store.Local)
+	for i := range files {
+		if local && isPlainBinlog(files[i].key) {
+			files[i].path = files[i].key
+		} else {
+			if err := plaintextTemp("replaying archived binlogs"); err != nil {
+				cleanup()
+				return nil, noop, err
+			}
+			files[i].path = filepath.Join(tempDir, files[i].name)
+			if err := decodeObject(st, files[i].key, files[i].path); err != nil {
+				cleanup()
+				return nil, noop, err
+			}
+		}
+		if i > 0 && !stopTime.IsZero() {
+			if created, ok := binlogCreated(files[i].path); ok && created.After(stopTime) {
+				return files[:i], cleanup, nil
+			}
+		}
+	}
+	return files, cleanup, nil
+}
+
+// binlogCreated returns the time a binary log was started, the timestamp
+// of the format description event that opens it.
+func binlogCreated(path string) (time.Time, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer f.Close()
+
+	header := make([]byte, len(binlogMagic)+4)
+	if _, err := io.ReadFull(f, header); err != nil || !bytes.Equal(header[:len(binlogMagic)], binlogMagic) {
+		return time.Time{}, false
+	}
+	timestamp := binary.LittleEndian.Uint32(header[len(binlogMagic):])
+	if timestamp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(timestamp), 0), true
+}
+
+func isPlainBinlog(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(binlogMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, binlogMagic)
+}
+
+// BinaryLogs lists the binlogs the server still has, oldest first.
+func (d mysqlDriver) BinaryLogs(conn Connection) ([]string, error) {
+	out, err := d.query(conn, "SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range splitLines(out) {
+		name, _, _ := strings.Cut(line, "\t")
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// StreamBinlogs runs mysqlbinlog as a replica of the server, writing the
+// raw binlogs from first onwards into dir until it exits or ctx is done.
+func (d mysqlDriver) StreamBinlogs(ctx context.Context, conn Connection, first, dir string) error {
+	// mysqlbinlog connects with a server id that must not clash with the
+	// server's own or another replica's.
+	serverIDFlag := "--connection-server-id"
+	if mariadbBinlogTool() {
+		serverIDFlag = "--stop-never-slave-server-id"
+	}
+
+	cmd := d.command(conn, "mysqlbinlog",
+		"--read-from-remote-server",
+		"--raw",
+		"--stop-never",
+		fmt.Sprintf("%s=%d", serverIDFlag, Recovery.BinlogServerID),
+		fmt.Sprintf("--result-file=%s%c", dir, filepath.Separator),
+		first,
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-done
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+package coreactions
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"yohan/databaseutilities/logger"
+)
+
+// sourceDataVersion is the first mysqldump release that accepts
+// --source-data; older releases and MariaDB only know --master-data.
+var sourceDataVersion = []int{8, 0, 26}
+
+var (
+	// changeSource matches the commented statement written by
+	// --source-data=2 or --master-data=2.
+	changeSource = regexp.MustCompile(`^(?:-- )+CHANGE (?:MASTER|REPLICATION SOURCE) TO (?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+	// dumpVersion finds the server version mysqldump was built for, as in
+	// "mysqldump  Ver 8.0.36 for Linux" or "Ver 10.13 Distrib 5.7.44".
+	dumpVersion = regexp.MustCompile(`(?:Distrib|Ver) (\d+)\.(\d+)\.(\d+)`)
+)
+
+const gtidPurgedPrefix = "SET @@GLOBAL.GTID_PURGED="
+
+// maxScanLine caps how much of a single dump line is kept while looking for
+// the binlog coordinates; data lines can be arbitrarily long.
+const maxScanLine = 1 << 20
+
+// BackupWithBinlog dumps the database like Backup or BackupTables and
+// records the binlog coordinates and GTID set of the snapshot in m. When
+// the server has binary logging disabled the dump is taken without them.
+func (d mysqlDriver) BackupWithBinlog(conn Connection, out io.Writer, tables []string, m *Manifest) error {
+	flags := d.binlogFlags(conn)
+	if flags == nil {
+		return d.dump(conn, out, tables)
+	}
+
+	scanner := &binlogScanner{}
+	if err := d.dump(conn, io.MultiWriter(out, scanner), tables, flags...); err != nil {
+		return err
+	}
+	scanner.Close()
+
+	if scanner.position == nil {
+		logger.Warning("mysqldump did not report binlog coordinates, point-in-time restores will replay every available binlog")
+	} else {
+		m.BinlogFile = scanner.position.File
+		m.BinlogPosition = scanner.position.Position
+		logger.Info(fmt.Sprintf("Backup snapshot taken at binlog position %s", scanner.position))
+	}
+	m.GTIDExecuted = scanner.gtidSet
+	return nil
+}
+
+// binlogFlags returns the mysqldump options that write the binlog
+// coordinates into the dump, or nil if they cannot be recorded.
+func (d mysqlDriver) binlogFlags(conn Connection) []string {
+	logBin, err := d.query(conn, "SELECT @@log_bin")
+	if err != nil {
+		logger.Warning(fmt.Sprintf("Failed to check whether binary logging is enabled: %v", err))
+		return nil
+	}
+	if strings.TrimSpace(logBin) != "1" {
+		logger.Warning("Binary logging is disabled on the server, the backup will not record binlog coordinates")
+		return nil
+	}
+
+	version, err := d.ToolVersion()
+	if err != nil {
+		logger.Warning(fmt.Sprintf("Failed to read mysqldump version: %v", err))
+		return nil
+	}
+	if supportsSourceData(version) {
+		return []string{"--source-data=2"}
+	}
+	return []string{"--master-data=2"}
+}
+
+// supportsSourceData reports whether the mysqldump that printed version
+// accepts --source-data.
+func supportsSourceData(version string) bool {
+	if strings.Contains(version, "MariaDB") {
+		return false
+	}
+	match := dumpVersion.FindStringSubmatch(version)
+	if match == nil {
+		return false
+	}
+	for i, minimum := range sourceDataVersion {
+		part, _ := strconv.Atoi(match[i+1])
+		if part != minimum {
+			return part > minimum
+		}
+	}
+	return true
+}
+
+// binlogScanner watches the header of a mysqldump stream for the binlog
+// coordinates and the GTID_PURGED statement. It stops looking once the
+// first table is reached, so the rest of the dump only costs a byte search.
+type binlogScanner struct {
+	line     []byte
+	gtid     []byte
+	inGTID   bool
+	done     bool
+	position *BinlogPosition
+	gtidSet  string
+}
+
+func (s *binlogScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && !s.done {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.appendLine(p)
+			break
+		}
+		s.appendLine(p[:i])
+		s.scanLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close scans a last line that was not terminated by a newline.
+func (s *binlogScanner) Close() error {
+	if !s.done && len(s.line) > 0 {
+		s.scanLine()
+	}
+	return nil
+}
+
+func (s *binlogScanner) appendLine(p []byte) {
+	if room := maxScanLine - len(s.line); room < len(p) {
+		p = p[:max(room, 0)]
+	}
+	s.line = append(s.line, p...)
+}
+
+func (s *binlogScanner) scanLine() {
+	line := strings.TrimRight(string(s.line), "\r")
+	s.line = s.line[:0]
+
+	switch {
+	case s.inGTID || strings.HasPrefix(line, gtidPurgedPrefix):
+		// Large GTID sets are split over several lines.
+		s.inGTID = true
+		s.gtid = append(s.gtid, line...)
+		if strings.HasSuffix(line, ";") {
+			s.inGTID = false
+			s.gtidSet = parseGTIDPurged(string(s.gtid))
+		}
+	case strings.HasPrefix(line, "-- Current Database:"), strings.HasPrefix(line, "-- Table structure for table"):
+		s.done = true
+	default:
+		if match := changeSource.FindStringSubmatch(line); match != nil {
+			pos, _ := strconv.ParseInt(match[2], 10, 64)
+			s.position = &BinlogPosition{File: match[1], Position: pos}
+		}
+	}
+}
+
+// parseGTIDPurged extracts the GTID set from a statement such as
+// SET @@GLOBAL.GTID_PURGED=/*!80000 '+'*/ 'uuid:1-5,uuid:1-3';
+func parseGTIDPurged(statement string) string {
+	value := strings.TrimPrefix(statement, gtidPurgedPrefix)
+	if _, rest, found := strings.Cut(value, "*/"); found {
+		value = rest
+	}
+	start := strings.Index(value, "'")
+	end := strings.LastIndex(value, "'")
+	if start < 0 || end <= start {
+		return ""
+	}
+	return strings.Join(strings.Fields(value[start+1:end]), "")
+}
@@ -0,0 +1,218 @@
+package coreactions
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// RecoveryOptions configures physical backups and point-in-time restores.
+// main fills Recovery from the command-line flags.
+type RecoveryOptions struct {
+	// DataDirectory is the PostgreSQL data directory a base backup is
+	// restored into. It must be empty or not exist yet.
+	DataDirectory string
+	// WALArchive is the store location holding archived WAL segments,
+	// e.g. s3://bucket/wal/ or /var/lib/pgarchive.
+	WALArchive string
+	// BinlogArchive is the MySQL binlog directory or the store location
+	// of archived binlogs, e.g. /var/log/mysql or s3://bucket/binlog/.
+	BinlogArchive string
+	// StopPosition ends a MySQL replay at a binlog coordinate written as
+	// file:position, e.g. mysql-bin.000012:4567.
+	StopPosition string
+	// StopGTIDs ends a MySQL replay after the transactions of this GTID
+	// set; later transactions are not applied.
+	StopGTIDs string
+	// BinlogSpool is the local directory the binlog-archive action streams
+	// binlogs into before they are uploaded to BinlogArchive.
+	BinlogSpool string
+	// BinlogServerID is the replica server id the binlog-archive action
+	// connects with. It must be unique among the server's replicas.
+	BinlogServerID int
+}
+
+var Recovery RecoveryOptions
+
+// BinlogPosition is a coordinate in the MySQL binary log.
+type BinlogPosition struct {
+	File     string
+	Position int64
+}
+
+// ParseBinlogPosition parses a "file:position" coordinate.
+func ParseBinlogPosition(value string) (BinlogPosition, error) {
+	file, posStr, found := strings.Cut(value, ":")
+	pos, err := strconv.ParseInt(posStr, 10, 64)
+	if !found || file == "" || err != nil || pos < 0 {
+		return BinlogPosition{}, fmt.Errorf("invalid binlog position %q: expected file:position", value)
+	}
+	return BinlogPosition{File: file, Position: pos}, nil
+}
+
+func (p BinlogPosition) String() string {
+	return fmt.Sprintf("%s:%d", p.File, p.Position)
+}
+
+// RecoveryTarget says how far a point-in-time restore replays. Time is used
+// by every engine; StopPosition and StopGTIDs are MySQL alternatives. Start
+// and StartGTIDs come from the manifest of the backup being restored and
+// tell the replay which logged events the backup already contains.
+type RecoveryTarget struct {
+	Time         time.Time
+	StopPosition *BinlogPosition
+	StopGTIDs    string
+	Start        *BinlogPosition
+	StartGTIDs   string
+}
+
+func (t RecoveryTarget) String() string {
+	var parts []string
+	if !t.Time.IsZero() {
+		parts = append(parts, t.Time.Format("2006-01-02 15:04:05 -07:00"))
+	}
+	if t.StopPosition != nil {
+		parts = append(parts, "position "+t.StopPosition.String())
+	}
+	if t.StopGTIDs != "" {
+		parts = append(parts, "GTID set "+t.StopGTIDs)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// BaseBackupper is implemented by drivers that can take a physical base
+// backup of the whole server.
+type BaseBackupper interface {
+	BaseBackup(conn Connection, out io.Writer) error
+}
+
+// BaseBackupDatabase takes a physical base backup of the server, the
+// starting point for point-in-time restores of engines that replay
+// archived logs on top of it.
+func BaseBackupDatabase(dbType, host string, port int, username, password, dbName, outputFile string) error {
+	logger.Info(fmt.Sprintf("Starting base backup of server %s:%d", host, port))
+
+	driver, err := lookupDriver(dbType)
+	if err != nil {
+		return err
+	}
+	backupper, ok := driver.(BaseBackupper)
+	if !ok {
+		err := fmt.Errorf("base backup is not supported for database type: %s", dbType)
+		logger.Error(err.Error())
+		return err
+	}
+
+	timestamp := time.Now().Format("20060102_150405")
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	manifest := newManifest(dbType, KindBase, driver, conn, nil)
+	outputFile, err = writeBackup(outputFile, fmt.Sprintf("%s_basebackup_%s.tar", host, timestamp), manifest, func(out io.Writer) error {
+		return backupper.BaseBackup(conn, out)
+	})
+	if err != nil {
+		logger.Error(fmt.Sprintf("Base backup failed: %v", err))
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Base backup completed successfully to %s", outputFile))
+	return nil
+}
+
+// archiveKey joins an archive prefix and a file name into a store key.
+func archiveKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + name
+}
+
+// archivedName strips the extensions added when a file was archived with
+// compression or encryption.
+func archivedName(name string) string {
+	name = strings.TrimSuffix(name, ".enc")
+	for _, extension := range []string{".gz", ".zst", ".lz4"} {
+		name = strings.TrimSuffix(name, extension)
+	}
+	return name
+}
+
+// decodeObject downloads key into target, undoing any encryption and
+// compression applied when it was archived.
+func decodeObject(st store.Store, key, target string) error {
+	in, err := openArchived(st, key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// openArchived opens key for reading its original content.
+func openArchived(st store.Store, key string) (io.ReadCloser, error) {
+	in, err := st.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := decryptReader(in, BackupEncryption)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	plain, err := decompressReader(decrypted)
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return stackedReader{ReadCloser: plain, under: in}, nil
+}
+
+// uploadArchiveFile stores the file at filePath under prefix, compressed
+// and encrypted like a backup, and returns its key.
+func uploadArchiveFile(st store.Store, prefix, filePath string) (string, error) {
+	in, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	name := filepath.Base(filePath) + BackupCompression.Extension()
+	if BackupEncryption.Enabled() {
+		name += ".enc"
+	}
+	key := archiveKey(prefix, name)
+
+	out, err := st.Put(key)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := newEncodedWriter(out)
+	if err != nil {
+		out.Abort()
+		return "", err
+	}
+	if _, err := io.Copy(encoded, in); err != nil {
+		encoded.Close()
+		out.Abort()
+		return "", err
+	}
+	if err := encoded.Close(); err != nil {
+		out.Abort()
+		return "", err
+	}
+	return key, out.Close()
+}
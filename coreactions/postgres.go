@@ -0,0 +1,280 @@
+package coreactions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"yohan/databaseutilities/logger"
+)
+
+// pg_dump output formats, chosen with --format.
+const (
+	PostgresPlain     = "plain"
+	PostgresCustom    = "custom"
+	PostgresDirectory = "directory"
+	PostgresTar       = "tar"
+)
+
+// PostgresOptions configures the PostgreSQL driver. main fills Postgres
+// from the flags.
+type PostgresOptions struct {
+	// Format is the pg_dump format. Plain dumps are restored with psql,
+	// the archive formats with pg_restore.
+	Format string
+	// Jobs is the number of parallel jobs pg_dump uses for directory
+	// dumps and pg_restore uses for custom and directory restores.
+	Jobs int
+}
+
+var Postgres = PostgresOptions{Format: PostgresPlain, Jobs: 1}
+
+type postgresDriver struct{}
+
+func init() {
+	Register(postgresDriver{}, "postgres", "postgresql")
+}
+
+func (postgresDriver) Capabilities() Capabilities {
+	return Capabilities{
+		TableBackup:        true,
+		TableRestore:       true,
+		PointInTimeRestore: true,
+	}
+}
+
+// command builds a PostgreSQL client command with the password passed
+// through the environment instead of the process-wide PGPASSWORD.
+func (postgresDriver) command(conn Connection, name string, args ...string) *exec.Cmd {
+	args = append([]string{
+		fmt.Sprintf("--host=%s", conn.Host),
+		fmt.Sprintf("--port=%d", conn.Port),
+		fmt.Sprintf("--username=%s", conn.Username),
+	}, args...)
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+conn.Password)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// FileExtension names backups after the pg_dump format they are written
+// in. Directory dumps are stored as tar files of the directory.
+func (postgresDriver) FileExtension(kind string) string {
+	switch Postgres.Format {
+	case PostgresCustom:
+		return ".dump"
+	case PostgresDirectory:
+		return ".dir.tar"
+	case PostgresTar:
+		return ".tar"
+	default:
+		return ".sql"
+	}
+}
+
+// AnnotateManifest records the pg_dump format of the backup.
+func (postgresDriver) AnnotateManifest(m *Manifest) {
+	if DumpEngine == EngineNative {
+		m.Format = PostgresPlain
+	} else {
+		m.Format = Postgres.Format
+	}
+}
+
+func (d postgresDriver) ServerVersion(conn Connection) (string, error) {
+	cmd := d.command(conn, "psql",
+		"--no-align",
+		"--tuples-only",
+		"--command=SHOW server_version",
+		fmt.Sprintf("--dbname=%s", conn.Database),
+	)
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func (postgresDriver) ToolVersion() (string, error) {
+	out, err := exec.Command("pg_dump", "--version").Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Backup dumps the database. Plain dumps drop and recreate every object;
+// archive dumps leave that to pg_restore.
+func (d postgresDriver) Backup(conn Connection, out io.Writer) error {
+	if Postgres.Format == PostgresPlain {
+		return d.dump(conn, out, "--create", "--clean")
+	}
+	return d.dump(conn, out)
+}
+
+func (d postgresDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	return d.dump(conn, out, tableArgs(tables)...)
+}
+
+// Restore restores a backup of any pg_dump format, which is recognised
+// from the file itself.
+func (d postgresDriver) Restore(conn Connection, in io.Reader) error {
+	br := bufio.NewReaderSize(in, 64*1024)
+	format := detectPostgresFormat(br)
+	if format != PostgresPlain {
+		return d.restoreArchive(conn, br, format)
+	}
+	if conn.Scratch {
+		return d.restoreScript(conn, stripDatabaseSwitch(br, postgresDialect))
+	}
+	return d.restoreScript(conn, br)
+}
+
+// RestoreTables restores the given tables, with their sequences, indexes,
+// constraints and triggers, from a backup of any pg_dump format. Tables
+// that exist are emptied and keep their definition.
+func (d postgresDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	existing, err := d.existingTables(conn)
+	if err != nil {
+		return fmt.Errorf("failed to list the tables of database %s: %w", conn.Database, err)
+	}
+
+	br := bufio.NewReaderSize(in, 64*1024)
+	format := detectPostgresFormat(br)
+	if format != PostgresPlain {
+		return d.restoreArchiveTables(conn, br, format, tables, existing)
+	}
+	return d.restoreScriptTables(conn, br, tables, existing, "--single-transaction")
+}
+
+// StartSetRestore lists the tables of the database before the schema part
+// of a table restore creates any, so the post-data part still tells the
+// tables the set creates, which get their indexes and constraints, from
+// the ones that existed before.
+func (d postgresDriver) StartSetRestore(conn Connection, tables []string) (SetRestore, error) {
+	restore := &postgresSetRestore{driver: d, conn: conn, tables: tables}
+	if len(tables) > 0 {
+		existing, err := d.existingTables(conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the tables of database %s: %w", conn.Database, err)
+		}
+		restore.existing = existing
+	}
+	return restore, nil
+}
+
+// postgresSetRestore restores the parts of a backup set, which are always
+// plain scripts. psql stops at the first error, so a failed part is
+// reported instead of being skipped over, and the rows of a table are
+// loaded in a single transaction, so a failed table is left empty rather
+// than half loaded.
+type postgresSetRestore struct {
+	driver   postgresDriver
+	conn     Connection
+	tables   []string
+	existing map[string]bool
+}
+
+func (r *postgresSetRestore) RestorePart(in io.Reader, section string) error {
+	var args []string
+	if section == SectionData {
+		args = append(args, "--single-transaction")
+	} else if len(r.tables) > 0 {
+		return r.driver.restoreScriptTables(r.conn, in, r.tables, r.existing)
+	}
+	if r.conn.Scratch {
+		in = stripDatabaseSwitch(in, postgresDialect)
+	}
+	return r.driver.restoreScript(r.conn, in, append(args, "--set=ON_ERROR_STOP=1")...)
+}
+
+// restoreScript runs a plain SQL script with psql.
+func (d postgresDriver) restoreScript(conn Connection, in io.Reader, args ...string) error {
+	cmd := d.command(conn, "psql", append(args, fmt.Sprintf("--dbname=%s", conn.Database))...)
+	cmd.Stdin = in
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// restoreScriptTables runs the statements of a plain SQL script that
+// belong to the given tables with psql, which stops at the first error:
+// the script empties the existing tables, so it must not go on loading
+// rows after a failure.
+func (d postgresDriver) restoreScriptTables(conn Connection, in io.Reader, tables []string, existing map[string]bool, args ...string) error {
+	filter := newPostgresTableFilter(in, tables, existing)
+	if err := d.restoreScript(conn, filter, append(args, "--set=ON_ERROR_STOP=1")...); err != nil {
+		return err
+	}
+	for _, table := range filter.Missing() {
+		logger.Warning(fmt.Sprintf("Table %s not found in backup file", table))
+	}
+	return nil
+}
+
+// existingTables returns the qualified names of the tables of the
+// database, as pg_dump names them in its comments.
+func (d postgresDriver) existingTables(conn Connection) (map[string]bool, error) {
+	out, err := d.query(conn, `SELECT n.nspname || '.' || c.relname
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND `+userSchemas)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, table := range splitLines(out) {
+		existing[table] = true
+	}
+	return existing, nil
+}
+
+// query runs a single statement with psql and returns its unaligned output.
+func (d postgresDriver) query(conn Connection, query string) (string, error) {
+	cmd := d.command(conn, "psql",
+		"--no-psqlrc",
+		"--no-align",
+		"--tuples-only",
+		"--field-separator=\t",
+		"--set=ON_ERROR_STOP=1",
+		fmt.Sprintf("--command=%s", query),
+		fmt.Sprintf("--dbname=%s", conn.Database),
+	)
+	out, err := cmd.Output()
+	return strings.TrimRight(string(out), "\n"), err
+}
+
+func (d postgresDriver) CreateDatabase(conn Connection, name string) error {
+	_, err := d.query(conn, fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(name, '"')))
+	return err
+}
+
+func (d postgresDriver) DropDatabase(conn Connection, name string) error {
+	_, err := d.query(conn, fmt.Sprintf("DROP DATABASE IF EXISTS %s", quoteIdentifier(name, '"')))
+	return err
+}
+
+func (d postgresDriver) QueryValue(conn Connection, query string) (string, error) {
+	return d.query(conn, query)
+}
+
+// TableRowCounts counts the rows of every user table, keyed by
+// schema.table.
+func (d postgresDriver) TableRowCounts(conn Connection) (map[string]int64, error) {
+	out, err := d.query(conn, `SELECT schemaname || '.' || tablename, quote_ident(schemaname) || '.' || quote_ident(tablename)
+		FROM pg_catalog.pg_tables
+		WHERE schemaname NOT IN ('pg_catalog', 'information_schema')
+		ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []string
+	for _, line := range splitLines(out) {
+		name, quoted, _ := strings.Cut(line, "\t")
+		counts = append(counts, fmt.Sprintf("SELECT %s, count(*) FROM %s", quoteLiteral(name), quoted))
+	}
+	if len(counts) == 0 {
+		return map[string]int64{}, nil
+	}
+
+	out, err = d.query(conn, strings.Join(counts, " UNION ALL "))
+	if err != nil {
+		return nil, err
+	}
+	return parseRowCounts(out)
+}
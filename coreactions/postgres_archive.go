@@ -0,0 +1,278 @@
+package coreactions
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"yohan/databaseutilities/logger"
+)
+
+// pgDumpMagic starts every custom format archive.
+var pgDumpMagic = []byte("PGDMP")
+
+// pgDirectoryRoot is the directory a directory format dump is stored under
+// in its tar file. pg_dump's own tar format has no directory entries, which
+// tells the two apart.
+const pgDirectoryRoot = "dump/"
+
+// dump runs pg_dump in the configured format with extra options placed
+// before the database name. Directory dumps are written to a temporary
+// directory, with --jobs workers, and streamed to out as a tar file.
+func (d postgresDriver) dump(conn Connection, out io.Writer, extra ...string) error {
+	switch Postgres.Format {
+	case PostgresPlain, PostgresCustom, PostgresTar, PostgresDirectory:
+	default:
+		return fmt.Errorf("unknown PostgreSQL dump format %q: use plain, custom, directory or tar", Postgres.Format)
+	}
+
+	args := []string{fmt.Sprintf("--format=%s", Postgres.Format)}
+	// The archive formats compress their data by default; leave that to
+	// --compress when it is set, rather than compressing twice.
+	if BackupCompression.Algorithm != CompressNone && (Postgres.Format == PostgresCustom || Postgres.Format == PostgresDirectory) {
+		args = append(args, "--compress=0")
+	}
+	args = append(args, extra...)
+
+	if Postgres.Format != PostgresDirectory {
+		cmd := d.command(conn, "pg_dump", append(args, conn.Database)...)
+		cmd.Stdout = out
+		return cmd.Run()
+	}
+
+	if err := plaintextTemp("a directory format dump"); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "dbutility-pgdump-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "dump")
+	args = append(args, fmt.Sprintf("--jobs=%d", Postgres.Jobs), fmt.Sprintf("--file=%s", dir), conn.Database)
+	cmd := d.command(conn, "pg_dump", args...)
+	cmd.Stdout = os.Stdout
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	return writeDirectoryTar(out, dir)
+}
+
+// detectPostgresFormat recognises the format of a backup from its first
+// bytes without consuming them.
+func detectPostgresFormat(br *bufio.Reader) string {
+	header, _ := br.Peek(512)
+	switch {
+	case bytes.HasPrefix(header, pgDumpMagic):
+		return PostgresCustom
+	case len(header) == 512 && bytes.HasPrefix(header[257:], []byte("ustar")):
+		if header[156] == tar.TypeDir {
+			return PostgresDirectory
+		}
+		return PostgresTar
+	default:
+		return PostgresPlain
+	}
+}
+
+// restoreArchive restores a custom, tar or directory backup with
+// pg_restore, dropping the objects it recreates first. Parallel restores
+// need a file to seek in, so custom backups are spooled to a temporary
+// file when --jobs is above one and directory backups are always unpacked.
+// Tar backups, and custom backups whose plaintext must stay off the disk,
+// are restored by a single job from standard input.
+func (d postgresDriver) restoreArchive(conn Connection, in io.Reader, format string) error {
+	args := []string{
+		fmt.Sprintf("--format=%s", format),
+		"--clean",
+		"--if-exists",
+		fmt.Sprintf("--dbname=%s", conn.Database),
+	}
+
+	tmpDir, err := os.MkdirTemp("", "dbutility-pgrestore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var source string
+	switch {
+	case format == PostgresDirectory:
+		if source, err = extractDirectoryDump(in, tmpDir); err != nil {
+			return err
+		}
+	case format == PostgresCustom && Postgres.Jobs > 1 && !plaintextTempRefused():
+		source = filepath.Join(tmpDir, "archive")
+		if err := spoolFile(in, source); err != nil {
+			return err
+		}
+	}
+	if format != PostgresDirectory && source == "" && Postgres.Jobs > 1 {
+		logger.Warning(fmt.Sprintf("The %s dump is restored from standard input, with a single job", format))
+	}
+
+	if source != "" && format != PostgresTar && Postgres.Jobs > 1 {
+		args = append(args, fmt.Sprintf("--jobs=%d", Postgres.Jobs))
+	}
+	if source != "" {
+		args = append(args, source)
+	}
+	cmd := d.command(conn, "pg_restore", args...)
+	if source == "" {
+		cmd.Stdin = in
+	}
+	cmd.Stdout = os.Stdout
+	return cmd.Run()
+}
+
+// restoreArchiveTables restores the given tables of a custom, tar or
+// directory backup like those of a plain one: pg_restore turns the archive
+// back into a script, which goes through the same table filter and psql
+// run, so tables that exist are emptied rather than dropped and the
+// restore stops at the first error. It runs as a single job.
+func (d postgresDriver) restoreArchiveTables(conn Connection, in io.Reader, format string, tables []string, existing map[string]bool) error {
+	args := []string{fmt.Sprintf("--format=%s", format), "--file=-"}
+	if format == PostgresDirectory {
+		tmpDir, err := os.MkdirTemp("", "dbutility-pgrestore-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+
+		source, err := extractDirectoryDump(in, tmpDir)
+		if err != nil {
+			return err
+		}
+		args = append(args, source)
+	}
+
+	cmd := d.command(conn, "pg_restore", args...)
+	if format != PostgresDirectory {
+		cmd.Stdin = in
+	}
+	script, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = d.restoreScriptTables(conn, script, tables, existing, "--single-transaction")
+	if err != nil {
+		// psql stopped reading; unblock pg_restore.
+		io.Copy(io.Discard, script)
+	}
+	if waitErr := cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// extractDirectoryDump unpacks a directory dump into dir and returns the
+// path of the dump directory for pg_restore.
+func extractDirectoryDump(in io.Reader, dir string) (string, error) {
+	if err := plaintextTemp("restoring a directory format dump"); err != nil {
+		return "", err
+	}
+	if err := extractDirectoryTar(in, dir); err != nil {
+		return "", fmt.Errorf("failed to unpack directory dump: %w", err)
+	}
+	return filepath.Join(dir, strings.TrimSuffix(pgDirectoryRoot, "/")), nil
+}
+
+// spoolFile copies in to a new file at filePath.
+func spoolFile(in io.Reader, filePath string) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, in)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeDirectoryTar writes the files of a directory dump to out as a tar
+// file, under pgDirectoryRoot.
+func writeDirectoryTar(out io.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(out)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: pgDirectoryRoot, Mode: 0o700}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := addTarFile(tw, filepath.Join(dir, entry.Name()), pgDirectoryRoot+entry.Name()); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addTarFile(tw *tar.Writer, filePath, name string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0o600,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractDirectoryTar unpacks a directory dump written by
+// writeDirectoryTar into dir. Only plain files directly under
+// pgDirectoryRoot are accepted.
+func extractDirectoryTar(in io.Reader, dir string) error {
+	root := filepath.Join(dir, strings.TrimSuffix(pgDirectoryRoot, "/"))
+	if err := os.Mkdir(root, 0o700); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir && header.Name == pgDirectoryRoot {
+			continue
+		}
+		name, found := strings.CutPrefix(header.Name, pgDirectoryRoot)
+		if !found || header.Typeflag != tar.TypeReg || name == "" || strings.ContainsAny(name, `/\`) || name == ".." {
+			return fmt.Errorf("unexpected entry %q", header.Name)
+		}
+		if err := spoolFile(tr, filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+}
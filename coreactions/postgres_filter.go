@@ -0,0 +1,272 @@
+package coreactions
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// pgTableFilter is a streaming reader that keeps the parts of a plain
+// pg_dump belonging to the requested tables: their definitions, rows,
+// defaults, constraints, indexes, triggers, owned sequences and comments.
+// pg_dump precedes every object with a "-- Name: ...; Type: ..." comment,
+// which tells the filter what the statements after it create; objects that
+// do not name their table there are recognised from their statements.
+// Settings and psql meta-commands other than \connect are always kept.
+// Tables that already exist in the target database keep their definition,
+// indexes and dependent objects: they are emptied with one TRUNCATE before
+// their rows are loaded, and only their rows and sequence values are
+// restored.
+type pgTableFilter struct {
+	sqlFilter
+	tableSelection
+
+	// entry is the object the current statements belong to; keep says
+	// whether they are restored.
+	entry pgDumpEntry
+	keep  bool
+	// copying says whether the rows of the current COPY are restored.
+	copying bool
+
+	// sequences holds the statements of sequences whose owner is not
+	// known yet, until ALTER SEQUENCE ... OWNED BY names it.
+	sequences map[string][]byte
+	// kept records the restored objects, by type and qualified name.
+	kept map[string]bool
+	// existing holds the qualified names of the tables of the target
+	// database; truncate the restored ones among them, until they are
+	// emptied.
+	existing map[string]bool
+	truncate []pgDumpEntry
+}
+
+// pgDumpEntry is an object of a dump, as named in the comment pg_dump
+// writes before it.
+type pgDumpEntry struct {
+	Type   string
+	Schema string
+	Name   string
+}
+
+// key identifies the object, as pg_restore --list names it.
+func (e pgDumpEntry) key() string {
+	return e.Type + " " + e.Schema + " " + e.Name
+}
+
+// qualified returns the object's name qualified by its schema.
+func (e pgDumpEntry) qualified() string {
+	return qualify(e.Schema, e.Name)
+}
+
+func qualify(schema, name string) string {
+	if schema == "" || schema == "-" {
+		return name
+	}
+	return schema + "." + name
+}
+
+var pgEntryHeader = regexp.MustCompile(`(?m)^-- (?:Data for )?Name: (.*); Type: (.*); Schema: (.*); Owner: .*$`)
+
+// newPostgresTableFilter returns a filter restoring tables into a
+// database already holding the existing tables, which may be nil.
+func newPostgresTableFilter(in io.Reader, tables []string, existing map[string]bool) *pgTableFilter {
+	f := &pgTableFilter{
+		tableSelection: newTableSelection(tables),
+		keep:           true,
+		sequences:      map[string][]byte{},
+		kept:           map[string]bool{},
+		existing:       existing,
+	}
+	f.sqlFilter = sqlFilter{s: newSQLScanner(in, postgresDialect), filter: f.filter, end: f.emptyTables}
+	return f
+}
+
+// filter decides whether a statement is restored.
+func (f *pgTableFilter) filter(st *sqlStatement) {
+	if st.CopyData {
+		if f.copying {
+			f.buf = append(f.buf, st.Text...)
+		}
+		return
+	}
+	f.copying = false
+	if match := pgEntryHeader.FindSubmatch(st.Comments); match != nil {
+		f.entry = pgDumpEntry{Type: string(match[2]), Schema: string(match[3]), Name: string(match[1])}
+		f.keep = f.keepEntry(f.entry)
+		if f.keep {
+			f.kept[f.entry.key()] = true
+		}
+	}
+	if len(st.Text) == 0 {
+		// The comments ending the dump.
+		f.emit(st)
+		return
+	}
+
+	tokens := sqlTokens(st.Text, 16)
+	switch {
+	case switchesDatabase(st, postgresDialect):
+	case len(tokens) == 0, hasKeywords(tokens, "SET"), hasKeywords(tokens, "SELECT", "pg_catalog", ".", "set_config"), strings.HasPrefix(tokens[0], `\`):
+		f.emit(st)
+	case f.entry.Type == "":
+		// Before the first object: the DROP statements of a dump taken
+		// with --clean. Restored tables are created only when missing.
+	case f.entry.Type == "SEQUENCE" && !f.keep:
+		f.sequence(st, tokens)
+	case f.entry.Type == "INDEX" && !f.keep && hasKeywords(tokens, "CREATE"):
+		f.filterIndex(st, tokens)
+	case f.entry.Type == "SEQUENCE OWNED BY" && hasKeywords(tokens, "ALTER", "SEQUENCE"):
+		f.ownedBy(st, tokens)
+	case f.keep:
+		if f.entry.Type == "TABLE DATA" {
+			f.emptyTables()
+		}
+		f.emit(st)
+		f.copying = hasKeywords(tokens, "COPY")
+	}
+}
+
+// keepEntry decides from its header whether an object is restored. The
+// owners of sequences and indexes are only known from their statements.
+func (f *pgTableFilter) keepEntry(e pgDumpEntry) bool {
+	switch e.Type {
+	case "TABLE", "TABLE DATA", "TABLE ATTACH":
+		keep := f.selected(e.qualified())
+		if keep && e.Type == "TABLE" && f.exists(e.qualified()) {
+			f.truncate = append(f.truncate, e)
+		}
+		return keep && (e.Type == "TABLE DATA" || !f.exists(e.qualified()))
+	case "DEFAULT", "CONSTRAINT", "FK CONSTRAINT", "TRIGGER", "RULE", "POLICY", "ROW SECURITY":
+		// Named after their table: "table name".
+		table, _, _ := strings.Cut(e.Name, " ")
+		return f.restored(qualify(e.Schema, table))
+	case "SEQUENCE SET":
+		return f.kept["SEQUENCE "+e.Schema+" "+e.Name]
+	case "INDEX ATTACH":
+		return f.kept["INDEX "+e.Schema+" "+e.Name]
+	case "COMMENT", "ACL":
+		// Named after the object: "TABLE name", "COLUMN table.column".
+		kind, name, _ := strings.Cut(e.Name, " ")
+		switch kind {
+		case "TABLE":
+			return f.restored(qualify(e.Schema, name))
+		case "COLUMN":
+			if i := strings.LastIndex(name, "."); i > 0 {
+				return f.restored(qualify(e.Schema, name[:i]))
+			}
+		case "SEQUENCE", "INDEX":
+			return f.kept[kind+" "+e.Schema+" "+name]
+		}
+		return false
+	default:
+		return false
+	}
+}
+
+// sequence holds back the statements of a sequence until its owner is
+// known. Identity columns name their table in the statement creating the
+// sequence.
+func (f *pgTableFilter) sequence(st *sqlStatement, tokens []string) {
+	key := f.entry.qualified()
+	if table, ok := pgAlteredTable(tokens); ok && hasKeywords(tokens, "ALTER", "TABLE") && f.selected(table) {
+		f.keepSequence(f.entry.Schema, f.entry.Name)
+		if !f.exists(table) {
+			f.keep = true
+			f.emit(st)
+		}
+		return
+	}
+	f.sequences[key] = append(append(f.sequences[key], st.Comments...), st.Text...)
+}
+
+// ownedBy restores a sequence, and the statements held back for it, when it
+// belongs to a requested table.
+func (f *pgTableFilter) ownedBy(st *sqlStatement, tokens []string) {
+	sequence, i := qualifiedName(tokens, 2)
+	i = skipKeywords(tokens, i, "OWNED", "BY")
+	column, _ := qualifiedName(tokens, i)
+	table := column
+	if j := strings.LastIndex(column, "."); j > 0 {
+		table = column[:j]
+	}
+	if !f.selected(table) {
+		return
+	}
+	held := f.sequences[sequence]
+	delete(f.sequences, sequence)
+	f.keepSequence(f.entry.Schema, f.entry.Name)
+	if f.exists(table) {
+		// The sequence exists with its table; only its value is set.
+		return
+	}
+	f.buf = append(f.buf, held...)
+	f.kept[f.entry.key()] = true
+	f.emit(st)
+}
+
+// keepSequence records that a sequence, and so its value, is restored.
+func (f *pgTableFilter) keepSequence(schema, name string) {
+	f.kept["SEQUENCE "+schema+" "+name] = true
+	f.kept["SEQUENCE SET "+schema+" "+name] = true
+}
+
+// filterIndex decides whether an index is restored, from the table named
+// in its CREATE INDEX statement.
+func (f *pgTableFilter) filterIndex(st *sqlStatement, tokens []string) {
+	i := skipKeywords(tokens, 1, "UNIQUE", "INDEX", "CONCURRENTLY", "IF NOT EXISTS")
+	for i < len(tokens) && !strings.EqualFold(tokens[i], "ON") {
+		i++
+	}
+	i = skipKeywords(tokens, i+1, "ONLY")
+	table, _ := qualifiedName(tokens, i)
+	if f.restored(table) {
+		f.keep = true
+		f.kept[f.entry.key()] = true
+		f.emit(st)
+	}
+}
+
+// exists reports whether table is already in the target database.
+func (f *pgTableFilter) exists(table string) bool {
+	return f.existing[table]
+}
+
+// restored reports whether table is requested and created by the restore,
+// with the objects that belong to it.
+func (f *pgTableFilter) restored(table string) bool {
+	return f.selected(table) && !f.exists(table)
+}
+
+// emptyTables emits the TRUNCATE of the requested tables that exist. They
+// are truncated together, so foreign keys between them do not stop it.
+func (f *pgTableFilter) emptyTables() {
+	if len(f.truncate) == 0 {
+		return
+	}
+	names := make([]string, len(f.truncate))
+	for i, e := range f.truncate {
+		names[i] = quotePostgresName(e.Schema, e.Name)
+	}
+	f.buf = append(f.buf, fmt.Sprintf("\nTRUNCATE TABLE %s;\n", strings.Join(names, ", "))...)
+	f.truncate = nil
+}
+
+// pgAlteredTable returns the table an ALTER TABLE or DROP TABLE statement
+// works on.
+func pgAlteredTable(tokens []string) (string, bool) {
+	if !hasKeywords(tokens, "ALTER", "TABLE") && !hasKeywords(tokens, "DROP", "TABLE") {
+		return "", false
+	}
+	i := skipKeywords(tokens, 2, "IF EXISTS", "ONLY")
+	table, _ := qualifiedName(tokens, i)
+	return table, table != ""
+}
+
+// quotePostgresName quotes a schema-qualified name for PostgreSQL.
+func quotePostgresName(schema, name string) string {
+	if schema == "" || schema == "-" {
+		return quoteIdentifier(name, '"')
+	}
+	return quoteIdentifier(schema, '"') + "." + quoteIdentifier(name, '"')
+}
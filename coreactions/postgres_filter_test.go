@@ -0,0 +1,209 @@
+package coreactions
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// postgresTestDump is shaped like pg_dump --clean output: the DROP
+// statements, then every object after its "-- Name:" comment.
+const postgresTestDump = "SET statement_timeout = 0;\n" +
+	"SELECT pg_catalog.set_config('search_path', '', false);\n" +
+	"ALTER TABLE ONLY public.users DROP CONSTRAINT users_pkey;\n" +
+	"DROP TABLE public.users_archive;\n" +
+	"DROP TABLE public.users;\n" +
+	"\n--\n-- Name: touch(); Type: FUNCTION; Schema: public; Owner: app\n--\n\n" +
+	"CREATE FUNCTION public.touch() RETURNS trigger\n    LANGUAGE plpgsql\n    AS $$ BEGIN NEW.note := E'it\\'s; new'; RETURN NEW; END; $$;\n" +
+	"\n--\n-- Name: users; Type: TABLE; Schema: public; Owner: app\n--\n\n" +
+	"CREATE TABLE public.users (\n    id integer NOT NULL,\n    note text DEFAULT E'a\\';b'::text\n);\n" +
+	"\n--\n-- Name: users_id_seq; Type: SEQUENCE; Schema: public; Owner: app\n--\n\n" +
+	"CREATE SEQUENCE public.users_id_seq\n    START WITH 1;\n" +
+	"\n--\n-- Name: users_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: app\n--\n\n" +
+	"ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;\n" +
+	"\n--\n-- Name: users_archive; Type: TABLE; Schema: public; Owner: app\n--\n\n" +
+	"CREATE TABLE public.users_archive (\n    id integer NOT NULL\n);\n" +
+	"\n--\n-- Name: users id; Type: DEFAULT; Schema: public; Owner: app\n--\n\n" +
+	"ALTER TABLE ONLY public.users ALTER COLUMN id SET DEFAULT nextval('public.users_id_seq'::regclass);\n" +
+	"\n--\n-- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: app\n--\n\n" +
+	"COPY public.users (id, note) FROM stdin;\n" +
+	"1\tDROP TABLE public.users_archive;\n" +
+	"2\t-- Name: users_archive; Type: TABLE; Schema: public; Owner: app\n" +
+	"\\.\n" +
+	"\n--\n-- Data for Name: users_archive; Type: TABLE DATA; Schema: public; Owner: app\n--\n\n" +
+	"COPY public.users_archive (id) FROM stdin;\n" +
+	"3\n" +
+	"\\.\n" +
+	"\n--\n-- Name: users_id_seq; Type: SEQUENCE SET; Schema: public; Owner: app\n--\n\n" +
+	"SELECT pg_catalog.setval('public.users_id_seq', 2, true);\n" +
+	"\n--\n-- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: app\n--\n\n" +
+	"ALTER TABLE ONLY public.users\n    ADD CONSTRAINT users_pkey PRIMARY KEY (id);\n" +
+	"\n--\n-- Name: users_archive_id_idx; Type: INDEX; Schema: public; Owner: app\n--\n\n" +
+	"CREATE INDEX users_archive_id_idx ON public.users_archive USING btree (id);\n" +
+	"\n--\n-- Name: users users_touch; Type: TRIGGER; Schema: public; Owner: app\n--\n\n" +
+	"CREATE TRIGGER users_touch BEFORE INSERT ON public.users FOR EACH ROW EXECUTE FUNCTION public.touch();\n" +
+	"\n--\n-- PostgreSQL database dump complete\n--\n\n"
+
+func TestPostgresTableFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		tables   []string
+		existing map[string]bool
+		keep     []string
+		drop     []string
+		missing  []string
+	}{
+		{
+			name:   "new table with its rows, sequence and dependents",
+			tables: []string{"users"},
+			keep: []string{
+				"CREATE TABLE public.users (\n    id integer NOT NULL,\n    note text DEFAULT E'a\\';b'::text\n);",
+				"CREATE SEQUENCE public.users_id_seq",
+				"ALTER SEQUENCE public.users_id_seq OWNED BY public.users.id;",
+				"SET DEFAULT nextval('public.users_id_seq'::regclass);",
+				"COPY public.users (id, note) FROM stdin;\n1\tDROP TABLE public.users_archive;\n2\t-- Name: users_archive; Type: TABLE; Schema: public; Owner: app\n\\.\n",
+				"SELECT pg_catalog.setval('public.users_id_seq', 2, true);",
+				"ADD CONSTRAINT users_pkey PRIMARY KEY (id);",
+				"CREATE TRIGGER users_touch",
+			},
+			drop: []string{
+				"CREATE TABLE public.users_archive",
+				"COPY public.users_archive",
+				"users_archive_id_idx",
+				"\nDROP TABLE",
+				"DROP CONSTRAINT",
+				"CREATE FUNCTION",
+				"TRUNCATE",
+			},
+		},
+		{
+			name:   "prefix-named table",
+			tables: []string{"public.users_archive"},
+			keep: []string{
+				"CREATE TABLE public.users_archive (",
+				"COPY public.users_archive (id) FROM stdin;\n3\n\\.\n",
+				"CREATE INDEX users_archive_id_idx ON public.users_archive",
+			},
+			drop: []string{
+				"CREATE TABLE public.users (",
+				"COPY public.users (",
+				"users_id_seq",
+				"users_pkey",
+				"users_touch",
+			},
+		},
+		{
+			name:     "existing tables are emptied and keep their definition",
+			tables:   []string{"users", "users_archive"},
+			existing: map[string]bool{"public.users": true},
+			keep: []string{
+				"CREATE TABLE public.users_archive (",
+				"\nTRUNCATE TABLE \"public\".\"users\";\n\n--\n-- Data for Name: users; Type: TABLE DATA",
+				"COPY public.users (id, note) FROM stdin;",
+				"COPY public.users_archive (id) FROM stdin;",
+				"SELECT pg_catalog.setval('public.users_id_seq', 2, true);",
+				"CREATE INDEX users_archive_id_idx",
+			},
+			drop: []string{
+				"CREATE TABLE public.users (",
+				"CREATE SEQUENCE",
+				"OWNED BY",
+				"SET DEFAULT",
+				"users_pkey",
+				"CREATE TRIGGER",
+				"\nDROP TABLE",
+			},
+		},
+		{
+			name:    "missing tables are reported",
+			tables:  []string{"orders"},
+			drop:    []string{"CREATE", "COPY", "DROP", "TRUNCATE"},
+			missing: []string{"orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newPostgresTableFilter(strings.NewReader(postgresTestDump), tt.tables, tt.existing)
+			out, err := io.ReadAll(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(out)
+
+			for _, want := range append(tt.keep, "SET statement_timeout = 0;", "set_config('search_path', '', false);") {
+				if !strings.Contains(got, want) {
+					t.Errorf("filtered dump lacks %q:\n%s", want, got)
+				}
+			}
+			for _, unwanted := range tt.drop {
+				if strings.Contains(got, unwanted) {
+					t.Errorf("filtered dump holds %q:\n%s", unwanted, got)
+				}
+			}
+			if missing := f.Missing(); !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("Missing() = %q, want %q", missing, tt.missing)
+			}
+		})
+	}
+}
+
+// Tables without rows in the dump are still emptied, at its end.
+func TestPostgresTableFilterTruncatesSchemaOnly(t *testing.T) {
+	schema, _, _ := strings.Cut(postgresTestDump, "\n--\n-- Data for Name:")
+	out, err := io.ReadAll(newPostgresTableFilter(strings.NewReader(schema), []string{"users"}, map[string]bool{"public.users": true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(out); !strings.HasSuffix(got, "\nTRUNCATE TABLE \"public\".\"users\";\n") || strings.Contains(got, "CREATE TABLE") {
+		t.Errorf("filtered schema:\n%s", got)
+	}
+}
+
+// A table restore from a backup set lists the existing tables once, before
+// the schema part creates the missing ones, so the post-data part still
+// adds the indexes and constraints of the tables it created.
+func TestPostgresSetRestoreTables(t *testing.T) {
+	dir := t.TempDir()
+	// The fake psql reports public.users as existing once a script ran,
+	// and appends every script to restored.sql.
+	psql := "#!/bin/sh\n" +
+		"for arg; do case $arg in --command=*) [ -f " + dir + "/ran ] && echo public.users; exit 0;; esac; done\n" +
+		"cat >> " + dir + "/restored.sql && touch " + dir + "/ran\n"
+	if err := os.WriteFile(filepath.Join(dir, "psql"), []byte(psql), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	schema, rest, _ := strings.Cut(postgresTestDump, "\n--\n-- Data for Name: users;")
+	_, postData, _ := strings.Cut(rest, "\n--\n-- Name: users users_pkey;")
+	postData = "\n--\n-- Name: users users_pkey;" + postData
+
+	restore, err := postgresDriver{}.StartSetRestore(Connection{Database: "shop"}, []string{"users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []struct{ section, script string }{{SectionSchema, schema}, {SectionPostData, postData}} {
+		if err := restore.RestorePart(strings.NewReader(part.script), part.section); err != nil {
+			t.Fatalf("%s: %v", part.section, err)
+		}
+	}
+
+	out, err := os.ReadFile(filepath.Join(dir, "restored.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+	for _, want := range []string{"CREATE TABLE public.users (", "ADD CONSTRAINT users_pkey PRIMARY KEY (id);", "CREATE TRIGGER users_touch"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("restored scripts lack %q:\n%s", want, got)
+		}
+	}
+	for _, unwanted := range []string{"TRUNCATE", "users_archive"} {
+		if strings.Contains(got, unwanted) {
+			t.Errorf("restored scripts hold %q:\n%s", unwanted, got)
+		}
+	}
+}
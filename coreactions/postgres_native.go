@@ -0,0 +1,673 @@
+package coreactions
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// The native PostgreSQL dumper reads the schema from the catalog and the
+// rows with plain queries, so it needs neither pg_dump nor a matching
+// client version. lib/pq cannot run COPY TO STDOUT, so every column is
+// selected as text, which uses the same output functions as COPY, and
+// written as COPY FROM stdin blocks that psql restores.
+//
+// It covers schemas, extensions, enum types, domains, functions and
+// procedures, sequences, tables (partitioned, unlogged, identity and
+// generated columns), views, materialized views, constraints, indexes and
+// triggers. Table dumps include the extensions, types and functions the
+// tables need. Owners, privileges, comments and other object types are not
+// dumped. PostgreSQL 13 or later is required.
+
+// userSchemas excludes the system schemas from catalog queries on n.
+const userSchemas = `n.nspname <> 'information_schema' AND n.nspname NOT LIKE 'pg\_%'`
+
+// notExtensionMember excludes objects created by an extension; classid is
+// the catalog the object lives in and oid its id.
+func notExtensionMember(classid, oid string) string {
+	return fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM pg_catalog.pg_depend d
+		WHERE d.classid = '%s'::pg_catalog.regclass AND d.objid = %s AND d.deptype = 'e')`, classid, oid)
+}
+
+// pgNeeded lists, as (classid, objid), the selected tables and the objects
+// they need: the types, functions, operator classes and extensions their
+// columns, defaults, constraints, indexes and triggers refer to, and those
+// these refer to in turn, such as the enum under a domain or the extension
+// a type belongs to. Objects belonging to a table or a domain depend on it
+// automatically ('a'); the rest is followed through normal ('n'),
+// internal ('i', an array type's element) and extension ('e')
+// dependencies. Built-in objects are pinned and have no dependencies
+// recorded, so only user objects are found. %s selects the tables.
+const pgNeeded = `WITH RECURSIVE needed(classid, objid) AS (
+		SELECT 'pg_catalog.pg_class'::pg_catalog.regclass::oid, c.oid FROM pg_catalog.pg_class c WHERE true %s
+	UNION
+		SELECT CASE WHEN dep.deptype = 'a' THEN dep.classid ELSE dep.refclassid END,
+			CASE WHEN dep.deptype = 'a' THEN dep.objid ELSE dep.refobjid END
+		FROM needed o JOIN pg_catalog.pg_depend dep ON
+			dep.deptype = 'a' AND dep.refclassid = o.classid AND dep.refobjid = o.objid
+				AND dep.classid IN ('pg_catalog.pg_attrdef'::pg_catalog.regclass, 'pg_catalog.pg_constraint'::pg_catalog.regclass,
+					'pg_catalog.pg_trigger'::pg_catalog.regclass, 'pg_catalog.pg_class'::pg_catalog.regclass)
+			OR dep.deptype IN ('n', 'i', 'e') AND dep.classid = o.classid AND dep.objid = o.objid
+				AND dep.refclassid IN ('pg_catalog.pg_type'::pg_catalog.regclass, 'pg_catalog.pg_proc'::pg_catalog.regclass,
+					'pg_catalog.pg_opclass'::pg_catalog.regclass, 'pg_catalog.pg_extension'::pg_catalog.regclass)
+	)
+`
+
+// openPostgres connects with lib/pq. The SSL mode comes from PGSSLMODE and
+// defaults to disable, as the server may not offer SSL.
+func openPostgres(conn Connection) (*sql.DB, error) {
+	query := url.Values{}
+	sslMode := os.Getenv("PGSSLMODE")
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	query.Set("sslmode", sslMode)
+	dsn := &url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(conn.Username, conn.Password),
+		Host:     fmt.Sprintf("%s:%d", conn.Host, conn.Port),
+		Path:     "/" + conn.Database,
+		RawQuery: query.Encode(),
+	}
+	return sql.Open("postgres", dsn.String())
+}
+
+// NativeDump writes a plain SQL dump of the database, or of the given
+// tables, read in a single repeatable read transaction.
+func (postgresDriver) NativeDump(conn Connection, out io.Writer, tables []string, m *Manifest) error {
+	if Postgres.Format != PostgresPlain {
+		return fmt.Errorf("the native engine only writes plain dumps, not --format=%s", Postgres.Format)
+	}
+	db, err := openPostgres(conn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY"); err != nil {
+		return err
+	}
+	if m.ServerVersion == "" {
+		tx.QueryRow("SHOW server_version").Scan(&m.ServerVersion)
+	}
+
+	// Table names are resolved with the normal search path; everything
+	// after runs with an empty one so the catalog functions qualify every
+	// name they print.
+	var selected []int64
+	for _, table := range tables {
+		var oid sql.NullInt64
+		if err := tx.QueryRow("SELECT pg_catalog.to_regclass($1)::oid", table).Scan(&oid); err != nil {
+			return err
+		}
+		if !oid.Valid {
+			return fmt.Errorf("table %s does not exist", table)
+		}
+		selected = append(selected, oid.Int64)
+	}
+	for _, setting := range []string{
+		"SET search_path = ''",
+		"SET DateStyle = ISO",
+		"SET IntervalStyle = postgres",
+		"SET extra_float_digits = 3",
+	} {
+		if _, err := tx.Exec(setting); err != nil {
+			return err
+		}
+	}
+
+	d := &pgDumper{tx: tx, w: bufio.NewWriterSize(out, 256*1024), full: len(tables) == 0}
+	if !d.full {
+		d.tables = "AND c.oid IN (SELECT pg_catalog.unnest($1::oid[]) UNION SELECT i.inhrelid FROM pg_catalog.pg_inherits i WHERE i.inhparent = ANY($1::oid[]))"
+		d.args = []any{pq.Array(selected)}
+	}
+	if err := d.dump(); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// pgDumper writes the sections of a native dump in dependency order.
+type pgDumper struct {
+	tx   *sql.Tx
+	w    *bufio.Writer
+	full bool
+	// tables restricts catalog queries on c to the selected tables and
+	// their partitions, with args as the query arguments.
+	tables string
+	args   []any
+
+	// Filled by the earlier sections for the later ones.
+	sequenceOwners []string
+	tableList      []pgTable
+}
+
+func (d *pgDumper) dump() error {
+	d.w.WriteString(`-- PostgreSQL database dump written by dbutility
+SET statement_timeout = 0;
+SET client_encoding = 'UTF8';
+SET standard_conforming_strings = on;
+SET check_function_bodies = false;
+SELECT pg_catalog.set_config('search_path', '', false);
+
+`)
+	sections := []func() error{d.schemas}
+	if d.full {
+		sections = append(sections, d.drops)
+	}
+	sections = append(sections, d.extensions, d.enums, d.domains, d.functions, d.sequences, d.createTables)
+	if d.full {
+		sections = append(sections, d.views)
+	}
+	sections = append(sections, d.data, d.sequenceValues, d.constraints, d.indexes, d.triggers)
+	if d.full {
+		sections = append(sections, d.refreshViews)
+	}
+	for _, section := range sections {
+		if err := section(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statements runs a catalog query returning one statement per row and
+// writes each one followed by format.
+func (d *pgDumper) statements(format, query string, args ...any) error {
+	rows, err := d.tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var statement string
+		if err := rows.Scan(&statement); err != nil {
+			return err
+		}
+		fmt.Fprintf(d.w, format, statement)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.w.WriteString("\n")
+	return nil
+}
+
+// withNeeded prefixes a catalog query of a table dump with pgNeeded, for
+// the restrictions of needed.
+func (d *pgDumper) withNeeded(query string) string {
+	if d.full {
+		return query
+	}
+	return fmt.Sprintf(pgNeeded, d.tables) + query
+}
+
+// needed restricts a catalog query of a table dump to the objects of
+// catalog, identified by oid, that the selected tables need.
+func (d *pgDumper) needed(catalog, oid string) string {
+	if d.full {
+		return ""
+	}
+	return fmt.Sprintf(" AND %s IN (SELECT objid FROM needed WHERE classid = 'pg_catalog.%s'::pg_catalog.regclass)", oid, catalog)
+}
+
+// schemas creates the schemas of the dump. A table dump creates those of
+// the tables and of the objects they need.
+func (d *pgDumper) schemas() error {
+	query := `SELECT pg_catalog.quote_ident(n.nspname) FROM pg_catalog.pg_namespace n
+		WHERE ` + userSchemas + ` AND ` + notExtensionMember("pg_namespace", "n.oid") + ` ORDER BY n.oid`
+	if !d.full {
+		query = d.withNeeded(`SELECT pg_catalog.quote_ident(n.nspname) FROM pg_catalog.pg_namespace n
+			WHERE n.oid IN (
+				SELECT c.relnamespace FROM pg_catalog.pg_class c WHERE true ` + d.tables + `
+				UNION SELECT t.typnamespace FROM pg_catalog.pg_type t WHERE true` + d.needed("pg_type", "t.oid") + `
+				UNION SELECT p.pronamespace FROM pg_catalog.pg_proc p WHERE true` + d.needed("pg_proc", "p.oid") + `
+				UNION SELECT e.extnamespace FROM pg_catalog.pg_extension e WHERE true` + d.needed("pg_extension", "e.oid") + `)
+			AND ` + userSchemas + ` AND ` + notExtensionMember("pg_namespace", "n.oid") + ` ORDER BY n.oid`)
+	}
+	return d.statements("CREATE SCHEMA IF NOT EXISTS %s;\n", query, d.args...)
+}
+
+// drops removes the objects of the dump first, like pg_dump --clean, so
+// a dump can be restored over an existing database.
+func (d *pgDumper) drops() error {
+	if err := d.statements("DROP VIEW IF EXISTS %s CASCADE;\n", `SELECT c.oid::pg_catalog.regclass::text
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'v' AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` ORDER BY c.oid DESC`); err != nil {
+		return err
+	}
+	if err := d.statements("DROP MATERIALIZED VIEW IF EXISTS %s CASCADE;\n", `SELECT c.oid::pg_catalog.regclass::text
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'm' AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` ORDER BY c.oid DESC`); err != nil {
+		return err
+	}
+	if err := d.statements("DROP TABLE IF EXISTS %s CASCADE;\n", `SELECT c.oid::pg_catalog.regclass::text
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND NOT c.relispartition AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` ORDER BY c.oid DESC`); err != nil {
+		return err
+	}
+	if err := d.statements("DROP SEQUENCE IF EXISTS %s CASCADE;\n", `SELECT c.oid::pg_catalog.regclass::text
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'S' AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` ORDER BY c.oid DESC`); err != nil {
+		return err
+	}
+	if err := d.statements("DROP DOMAIN IF EXISTS %s CASCADE;\n", `SELECT t.oid::pg_catalog.regtype::text
+		FROM pg_catalog.pg_type t JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+		WHERE t.typtype = 'd' AND `+userSchemas+` AND `+notExtensionMember("pg_type", "t.oid")+` ORDER BY t.oid DESC`); err != nil {
+		return err
+	}
+	return d.statements("DROP TYPE IF EXISTS %s CASCADE;\n", `SELECT t.oid::pg_catalog.regtype::text
+		FROM pg_catalog.pg_type t JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+		WHERE t.typtype = 'e' AND `+userSchemas+` AND `+notExtensionMember("pg_type", "t.oid")+` ORDER BY t.oid DESC`)
+}
+
+func (d *pgDumper) extensions() error {
+	return d.statements("CREATE EXTENSION IF NOT EXISTS %s;\n", d.withNeeded(`SELECT pg_catalog.quote_ident(e.extname) || ' WITH SCHEMA ' || pg_catalog.quote_ident(n.nspname)
+		FROM pg_catalog.pg_extension e JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname <> 'plpgsql'`+d.needed("pg_extension", "e.oid")+` ORDER BY e.oid`), d.args...)
+}
+
+func (d *pgDumper) enums() error {
+	return d.statements("CREATE TYPE %s;\n", d.withNeeded(`SELECT t.oid::pg_catalog.regtype::text || ' AS ENUM (' ||
+			pg_catalog.string_agg(pg_catalog.quote_literal(e.enumlabel), ', ' ORDER BY e.enumsortorder) || ')'
+		FROM pg_catalog.pg_type t
+		JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+		JOIN pg_catalog.pg_enum e ON e.enumtypid = t.oid
+		WHERE `+userSchemas+` AND `+notExtensionMember("pg_type", "t.oid")+d.needed("pg_type", "t.oid")+`
+		GROUP BY t.oid ORDER BY t.oid`), d.args...)
+}
+
+// domains creates domains in creation order, which puts every domain after
+// the domains it is based on, with their defaults and constraints.
+func (d *pgDumper) domains() error {
+	return d.statements("CREATE DOMAIN %s;\n", d.withNeeded(`SELECT t.oid::pg_catalog.regtype::text || ' AS ' || pg_catalog.format_type(t.typbasetype, t.typtypmod) ||
+			CASE WHEN t.typcollation <> bt.typcollation THEN ' COLLATE ' || pg_catalog.quote_ident(cn.nspname) || '.' || pg_catalog.quote_ident(co.collname) ELSE '' END ||
+			CASE WHEN t.typdefault IS NOT NULL THEN ' DEFAULT ' || t.typdefault ELSE '' END ||
+			CASE WHEN t.typnotnull THEN ' NOT NULL' ELSE '' END ||
+			COALESCE((SELECT pg_catalog.string_agg(' CONSTRAINT ' || pg_catalog.quote_ident(con.conname) || ' ' || pg_catalog.pg_get_constraintdef(con.oid), '' ORDER BY con.oid)
+				FROM pg_catalog.pg_constraint con WHERE con.contypid = t.oid AND con.contype = 'c'), '')
+		FROM pg_catalog.pg_type t
+		JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace
+		JOIN pg_catalog.pg_type bt ON bt.oid = t.typbasetype
+		LEFT JOIN pg_catalog.pg_collation co ON co.oid = t.typcollation
+		LEFT JOIN pg_catalog.pg_namespace cn ON cn.oid = co.collnamespace
+		WHERE t.typtype = 'd' AND `+userSchemas+` AND `+notExtensionMember("pg_type", "t.oid")+d.needed("pg_type", "t.oid")+`
+		ORDER BY t.oid`), d.args...)
+}
+
+func (d *pgDumper) functions() error {
+	return d.statements("%s;\n\n", d.withNeeded(`SELECT pg_catalog.pg_get_functiondef(p.oid)
+		FROM pg_catalog.pg_proc p JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
+		WHERE p.prokind IN ('f', 'p') AND `+userSchemas+` AND `+notExtensionMember("pg_proc", "p.oid")+d.needed("pg_proc", "p.oid")+`
+		ORDER BY p.oid`), d.args...)
+}
+
+// sequenceOwner finds the column a sequence belongs to: 'a' for serial
+// columns, 'i' for identity columns.
+const sequenceOwner = `LEFT JOIN pg_catalog.pg_depend dep ON dep.classid = 'pg_class'::pg_catalog.regclass
+		AND dep.objid = s.seqrelid AND dep.refclassid = 'pg_class'::pg_catalog.regclass AND dep.deptype IN ('a', 'i')
+	LEFT JOIN pg_catalog.pg_attribute a ON a.attrelid = dep.refobjid AND a.attnum = dep.refobjsubid`
+
+// sequences creates the sequences that are not part of an identity
+// column. In a table dump only the sequences owned by the tables are
+// included.
+func (d *pgDumper) sequences() error {
+	query := `SELECT 'CREATE SEQUENCE ' || s.seqrelid::pg_catalog.regclass::text ||
+			' AS ' || pg_catalog.format_type(s.seqtypid, NULL) ||
+			' START WITH ' || s.seqstart || ' INCREMENT BY ' || s.seqincrement ||
+			' MINVALUE ' || s.seqmin || ' MAXVALUE ' || s.seqmax || ' CACHE ' || s.seqcache ||
+			CASE WHEN s.seqcycle THEN ' CYCLE' ELSE '' END || ';' ||
+			CASE WHEN dep.deptype = 'a' THEN E'\n' || 'ALTER SEQUENCE ' || s.seqrelid::pg_catalog.regclass::text ||
+				' OWNED BY ' || dep.refobjid::pg_catalog.regclass::text || '.' || pg_catalog.quote_ident(a.attname) || ';'
+			ELSE '' END
+		FROM pg_catalog.pg_sequence s
+		JOIN pg_catalog.pg_class sc ON sc.oid = s.seqrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = sc.relnamespace
+		` + sequenceOwner + `
+		WHERE dep.deptype IS DISTINCT FROM 'i' AND ` + userSchemas + ` AND ` + notExtensionMember("pg_class", "sc.oid")
+	if !d.full {
+		query += ` AND dep.refobjid IN (SELECT c.oid FROM pg_catalog.pg_class c WHERE true ` + d.tables + `)`
+	}
+	// The OWNED BY clause refers to a table that does not exist yet, so
+	// it is written after the tables.
+	rows, err := d.tx.Query(query+" ORDER BY s.seqrelid", d.args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var owned []string
+	for rows.Next() {
+		var statement string
+		if err := rows.Scan(&statement); err != nil {
+			return err
+		}
+		create, owner, _ := strings.Cut(statement, "\n")
+		fmt.Fprintln(d.w, create)
+		if owner != "" {
+			owned = append(owned, owner)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.w.WriteString("\n")
+	d.sequenceOwners = owned
+	return nil
+}
+
+// pgTable is a table of the dump.
+type pgTable struct {
+	oid         int64
+	name        string
+	kind        string
+	parent      sql.NullString
+	bound       sql.NullString
+	partitionBy sql.NullString
+	unlogged    bool
+}
+
+func (d *pgDumper) listTables() ([]pgTable, error) {
+	rows, err := d.tx.Query(`SELECT c.oid, c.oid::pg_catalog.regclass::text, c.relkind,
+			(SELECT i.inhparent::pg_catalog.regclass::text FROM pg_catalog.pg_inherits i WHERE i.inhrelid = c.oid AND c.relispartition),
+			CASE WHEN c.relispartition THEN pg_catalog.pg_get_expr(c.relpartbound, c.oid) END,
+			CASE WHEN c.relkind = 'p' THEN pg_catalog.pg_get_partkeydef(c.oid) END,
+			c.relpersistence = 'u'
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p') AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` `+d.tables+`
+		ORDER BY c.relispartition, c.oid`, d.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []pgTable
+	for rows.Next() {
+		var t pgTable
+		if err := rows.Scan(&t.oid, &t.name, &t.kind, &t.parent, &t.bound, &t.partitionBy, &t.unlogged); err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+func (d *pgDumper) createTables() error {
+	tables, err := d.listTables()
+	if err != nil {
+		return err
+	}
+	d.tableList = tables
+
+	for _, t := range tables {
+		create := "CREATE TABLE "
+		if t.unlogged {
+			create = "CREATE UNLOGGED TABLE "
+		}
+		if t.parent.Valid {
+			fmt.Fprintf(d.w, "%s%s PARTITION OF %s %s", create, t.name, t.parent.String, t.bound.String)
+		} else {
+			columns, err := d.columnDefinitions(t.oid)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(d.w, "%s%s (\n    %s\n)", create, t.name, strings.Join(columns, ",\n    "))
+		}
+		if t.partitionBy.Valid {
+			fmt.Fprintf(d.w, " PARTITION BY %s", t.partitionBy.String)
+		}
+		d.w.WriteString(";\n\n")
+	}
+
+	for _, owner := range d.sequenceOwners {
+		fmt.Fprintln(d.w, owner)
+	}
+	d.w.WriteString("\n")
+	return nil
+}
+
+func (d *pgDumper) columnDefinitions(table int64) ([]string, error) {
+	rows, err := d.tx.Query(`SELECT pg_catalog.quote_ident(a.attname) || ' ' || pg_catalog.format_type(a.atttypid, a.atttypmod) ||
+			CASE WHEN a.attcollation <> t.typcollation THEN ' COLLATE ' || pg_catalog.quote_ident(cn.nspname) || '.' || pg_catalog.quote_ident(co.collname) ELSE '' END ||
+			CASE
+				WHEN a.attgenerated = 's' THEN ' GENERATED ALWAYS AS (' || pg_catalog.pg_get_expr(ad.adbin, ad.adrelid) || ') STORED'
+				WHEN a.attidentity = 'a' THEN ' GENERATED ALWAYS AS IDENTITY'
+				WHEN a.attidentity = 'd' THEN ' GENERATED BY DEFAULT AS IDENTITY'
+				WHEN ad.adbin IS NOT NULL THEN ' DEFAULT ' || pg_catalog.pg_get_expr(ad.adbin, ad.adrelid)
+				ELSE ''
+			END ||
+			CASE WHEN a.attnotnull THEN ' NOT NULL' ELSE '' END
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_type t ON t.oid = a.atttypid
+		LEFT JOIN pg_catalog.pg_attrdef ad ON ad.adrelid = a.attrelid AND ad.adnum = a.attnum
+		LEFT JOIN pg_catalog.pg_collation co ON co.oid = a.attcollation
+		LEFT JOIN pg_catalog.pg_namespace cn ON cn.oid = co.collnamespace
+		WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// views creates views and materialized views in creation order, which
+// puts every view after the views it selects from. Materialized views are
+// filled at the end of the restore.
+func (d *pgDumper) views() error {
+	return d.statements("%s;\n\n", `SELECT CASE c.relkind
+				WHEN 'v' THEN 'CREATE VIEW ' || c.oid::pg_catalog.regclass::text || ' AS' || E'\n' || pg_catalog.rtrim(pg_catalog.pg_get_viewdef(c.oid), ';')
+				ELSE 'CREATE MATERIALIZED VIEW ' || c.oid::pg_catalog.regclass::text || ' AS' || E'\n' || pg_catalog.rtrim(pg_catalog.pg_get_viewdef(c.oid), ';') || E'\n' || 'WITH NO DATA'
+			END
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('v', 'm') AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+`
+		ORDER BY c.oid`)
+}
+
+func (d *pgDumper) refreshViews() error {
+	return d.statements("REFRESH MATERIALIZED VIEW %s;\n", `SELECT c.oid::pg_catalog.regclass::text
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'm' AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+`
+		ORDER BY c.oid`)
+}
+
+// data writes the rows of every table that holds any as a COPY block.
+// Partitioned tables hold no rows of their own.
+func (d *pgDumper) data() error {
+	for _, t := range d.tableList {
+		if t.kind != "r" {
+			continue
+		}
+		if err := d.copyTable(t); err != nil {
+			return fmt.Errorf("failed to dump %s: %w", t.name, err)
+		}
+	}
+	return nil
+}
+
+func (d *pgDumper) copyTable(t pgTable) error {
+	rows, err := d.tx.Query(`SELECT pg_catalog.quote_ident(a.attname) FROM pg_catalog.pg_attribute a
+		WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = ''
+		ORDER BY a.attnum`, t.oid)
+	if err != nil {
+		return err
+	}
+	var columns, selects []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, column)
+		selects = append(selects, column+"::text")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+
+	rows, err = d.tx.Query(fmt.Sprintf("SELECT %s FROM ONLY %s", strings.Join(selects, ", "), t.name))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Fprintf(d.w, "COPY %s (%s) FROM stdin;\n", t.name, strings.Join(columns, ", "))
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		for i, value := range values {
+			if i > 0 {
+				d.w.WriteByte('\t')
+			}
+			if !value.Valid {
+				d.w.WriteString(`\N`)
+			} else {
+				writeCopyValue(d.w, value.String)
+			}
+		}
+		d.w.WriteByte('\n')
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.w.WriteString("\\.\n\n")
+	return nil
+}
+
+// writeCopyValue escapes a value for the COPY text format.
+func writeCopyValue(w *bufio.Writer, value string) {
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			w.WriteString(`\\`)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case '\t':
+			w.WriteString(`\t`)
+		case '\b':
+			w.WriteString(`\b`)
+		case '\f':
+			w.WriteString(`\f`)
+		case '\v':
+			w.WriteString(`\v`)
+		default:
+			w.WriteByte(c)
+		}
+	}
+}
+
+// sequenceValues sets every sequence, identity sequences included, to the
+// value it had when the dump started.
+func (d *pgDumper) sequenceValues() error {
+	query := `SELECT s.seqrelid::pg_catalog.regclass::text
+		FROM pg_catalog.pg_sequence s
+		JOIN pg_catalog.pg_class sc ON sc.oid = s.seqrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = sc.relnamespace
+		` + sequenceOwner + `
+		WHERE ` + userSchemas + ` AND ` + notExtensionMember("pg_class", "sc.oid")
+	if !d.full {
+		query += ` AND dep.refobjid IN (SELECT c.oid FROM pg_catalog.pg_class c WHERE true ` + d.tables + `)`
+	}
+	rows, err := d.tx.Query(query+" ORDER BY s.seqrelid", d.args...)
+	if err != nil {
+		return err
+	}
+	var sequences []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		sequences = append(sequences, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range sequences {
+		var lastValue int64
+		var isCalled bool
+		if err := d.tx.QueryRow(fmt.Sprintf("SELECT last_value, is_called FROM %s", name)).Scan(&lastValue, &isCalled); err != nil {
+			return err
+		}
+		fmt.Fprintf(d.w, "SELECT pg_catalog.setval(%s, %d, %s);\n", quoteLiteral(name), lastValue, strconv.FormatBool(isCalled))
+	}
+	d.w.WriteString("\n")
+	return nil
+}
+
+// constraints adds the constraints after the data, foreign keys last.
+// Constraints of a partitioned table are added to its partitions too, so
+// the copies on the partitions are skipped.
+func (d *pgDumper) constraints() error {
+	return d.statements("%s;\n", `SELECT CASE WHEN c.relkind = 'p' THEN 'ALTER TABLE ' ELSE 'ALTER TABLE ONLY ' END || con.conrelid::pg_catalog.regclass::text ||
+			' ADD CONSTRAINT ' || pg_catalog.quote_ident(con.conname) || ' ' || pg_catalog.pg_get_constraintdef(con.oid)
+		FROM pg_catalog.pg_constraint con
+		JOIN pg_catalog.pg_class c ON c.oid = con.conrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE con.contype IN ('p', 'u', 'c', 'x', 'f') AND con.conparentid = 0 AND con.conislocal
+			AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` `+d.tables+`
+		ORDER BY con.contype = 'f', c.relispartition, con.oid`, d.args...)
+}
+
+// indexes creates the indexes that do not back a constraint. Indexes of a
+// partitioned table are created without ONLY so they cascade to the
+// partitions, whose own copies are skipped.
+func (d *pgDumper) indexes() error {
+	return d.statements("%s;\n", `SELECT pg_catalog.replace(pg_catalog.pg_get_indexdef(i.indexrelid), ' ON ONLY ', ' ON ')
+		FROM pg_catalog.pg_index i
+		JOIN pg_catalog.pg_class ic ON ic.oid = i.indexrelid
+		JOIN pg_catalog.pg_class c ON c.oid = i.indrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT ic.relispartition
+			AND NOT EXISTS (SELECT 1 FROM pg_catalog.pg_constraint con WHERE con.conindid = i.indexrelid AND con.contype IN ('p', 'u', 'x'))
+			AND c.relkind IN ('r', 'p', 'm') AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` `+d.tables+`
+		ORDER BY i.indexrelid`, d.args...)
+}
+
+func (d *pgDumper) triggers() error {
+	return d.statements("%s;\n", `SELECT pg_catalog.pg_get_triggerdef(t.oid)
+		FROM pg_catalog.pg_trigger t
+		JOIN pg_catalog.pg_class c ON c.oid = t.tgrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE NOT t.tgisinternal AND t.tgparentid = 0
+			AND `+userSchemas+` AND `+notExtensionMember("pg_class", "c.oid")+` `+d.tables+`
+		ORDER BY t.oid`, d.args...)
+}
@@ -0,0 +1,141 @@
+package coreactions
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/lib/pq"
+)
+
+// OpenSnapshot exports a snapshot from a repeatable read transaction that
+// stays open until Close. Every part of the set is written by a pg_dump run
+// importing it with --snapshot, so all of them see the same data.
+func (d postgresDriver) OpenSnapshot(conn Connection, workers int, m *Manifest) (TableSnapshot, error) {
+	if DumpEngine == EngineNative {
+		return nil, fmt.Errorf("parallel PostgreSQL backups are written with pg_dump and cannot use --engine=native")
+	}
+	if Postgres.Format != PostgresPlain {
+		return nil, fmt.Errorf("parallel PostgreSQL backups are written as plain dumps, not --format=%s", Postgres.Format)
+	}
+
+	db, err := openPostgres(conn)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &pgSnapshot{driver: d, conn: conn, db: db, tx: tx}
+	if _, err := tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY"); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := tx.QueryRow("SELECT pg_catalog.pg_export_snapshot()").Scan(&s.id); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to export snapshot: %w", err)
+	}
+	return s, nil
+}
+
+// pgSnapshot is an exported snapshot and the transaction keeping it alive.
+type pgSnapshot struct {
+	driver postgresDriver
+	conn   Connection
+	db     *sql.DB
+	tx     *sql.Tx
+	id     string
+}
+
+// Tables returns the tables holding rows among selected, including the
+// partitions of selected partitioned tables, largest first.
+func (s *pgSnapshot) Tables(selected []string) ([]string, error) {
+	query := `SELECT pg_catalog.quote_ident(n.nspname) || '.' || pg_catalog.quote_ident(c.relname)
+		FROM pg_catalog.pg_class c JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'r' AND ` + userSchemas + ` AND ` + notExtensionMember("pg_class", "c.oid")
+	var args []any
+	if len(selected) > 0 {
+		var oids []int64
+		for _, table := range selected {
+			var oid sql.NullInt64
+			if err := s.tx.QueryRow("SELECT pg_catalog.to_regclass($1)::oid", table).Scan(&oid); err != nil {
+				return nil, err
+			}
+			if !oid.Valid {
+				return nil, fmt.Errorf("table %s does not exist", table)
+			}
+			oids = append(oids, oid.Int64)
+		}
+		query += ` AND c.oid IN (SELECT pg_catalog.unnest($1::oid[])
+			UNION SELECT t.relid FROM pg_catalog.unnest($1::oid[]) s(oid), pg_catalog.pg_partition_tree(s.oid) t)`
+		args = append(args, pq.Array(oids))
+	}
+	query += ` ORDER BY pg_catalog.pg_relation_size(c.oid) DESC, 1`
+
+	rows, err := s.tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// Schema writes the pre-data section: the objects the rows are loaded
+// into. Full backups drop every object first, as single-file backups do.
+func (s *pgSnapshot) Schema(out io.Writer, selected []string) error {
+	if len(selected) == 0 {
+		return s.dump(out, "--section=pre-data", "--clean", "--if-exists")
+	}
+	return s.dump(out, append([]string{"--section=pre-data"}, tableArgs(selected)...)...)
+}
+
+func (s *pgSnapshot) TableData(out io.Writer, table string) error {
+	return s.dump(out, "--section=data", fmt.Sprintf("--table=%s", table))
+}
+
+// PostData writes the post-data section: indexes, constraints, triggers
+// and the refresh of materialized views. Full backups first set the
+// sequences and load the large objects, the rest of the data section.
+func (s *pgSnapshot) PostData(out io.Writer, selected []string) error {
+	if len(selected) > 0 {
+		return s.dump(out, append([]string{"--section=post-data"}, tableArgs(selected)...)...)
+	}
+	if err := s.dump(out, "--section=data", "--exclude-table-data=*.*"); err != nil {
+		return err
+	}
+	return s.dump(out, "--section=post-data")
+}
+
+func (s *pgSnapshot) Close() error {
+	if s.tx != nil {
+		s.tx.Rollback()
+	}
+	return s.db.Close()
+}
+
+// dump runs pg_dump on the snapshot.
+func (s *pgSnapshot) dump(out io.Writer, args ...string) error {
+	args = append([]string{"--format=plain", fmt.Sprintf("--snapshot=%s", s.id)}, args...)
+	cmd := s.driver.command(s.conn, "pg_dump", append(args, s.conn.Database)...)
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+func tableArgs(tables []string) []string {
+	var args []string
+	for _, table := range tables {
+		args = append(args, fmt.Sprintf("--table=%s", table))
+	}
+	return args
+}
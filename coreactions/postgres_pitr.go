@@ -0,0 +1,219 @@
+package coreactions
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// BaseBackup streams a tar-format base backup of the whole cluster. The WAL
+// needed to make the backup consistent is fetched into the same tar.
+func (d postgresDriver) BaseBackup(conn Connection, out io.Writer) error {
+	cmd := d.command(conn, "pg_basebackup",
+		"--pgdata=-",
+		"--format=tar",
+		"--wal-method=fetch",
+		"--checkpoint=fast",
+	)
+	cmd.Stdout = out
+	return cmd.Run()
+}
+
+// PointInTimeRestore lays a base backup down into Recovery.DataDirectory and
+// configures PostgreSQL to replay the archived WAL up to the target time and
+// then promote. The server itself is started by the operator afterwards;
+// the connection settings are not used.
+func (postgresDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	if target.Time.IsZero() {
+		return fmt.Errorf("PostgreSQL point-in-time recovery needs a target date")
+	}
+	dataDir := Recovery.DataDirectory
+	if dataDir == "" {
+		return fmt.Errorf("no data directory configured: set --datadir for PostgreSQL point-in-time recovery")
+	}
+	if Recovery.WALArchive == "" {
+		return fmt.Errorf("no WAL archive configured: set --wal-archive for PostgreSQL point-in-time recovery")
+	}
+	dataDir, err := filepath.Abs(dataDir)
+	if err != nil {
+		return err
+	}
+	if err := checkEmptyDirectory(dataDir); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Extracting base backup into %s", dataDir))
+	if err := extractTar(in, dataDir); err != nil {
+		return fmt.Errorf("failed to extract base backup (was it taken with the basebackup action?): %w", err)
+	}
+
+	restoreCommand, err := walFetchCommand()
+	if err != nil {
+		return err
+	}
+
+	settings := fmt.Sprintf("\n# Added by dbutility for point-in-time recovery\nrestore_command = '%s'\nrecovery_target_time = '%s'\nrecovery_target_action = 'promote'\n",
+		strings.ReplaceAll(restoreCommand, "'", "''"), target.Time.Format("2006-01-02 15:04:05-07:00"))
+	if err := appendFile(filepath.Join(dataDir, "postgresql.auto.conf"), settings); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Data directory %s is ready: start PostgreSQL on it to replay WAL up to %s", dataDir, target.Time.Format("2006-01-02 15:04:05 -07:00")))
+	return nil
+}
+
+// walFetchCommand returns the restore_command that has this executable
+// fetch each WAL file from Recovery.WALArchive when recovery asks for it,
+// with the archive and decryption settings of this run. A passphrase is
+// not written to the configuration; the server then needs it in
+// $BACKUP_ENCRYPTION_PASSPHRASE.
+func walFetchCommand() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the dbutility executable for restore_command: %w", err)
+	}
+	archive := Recovery.WALArchive
+	if !store.IsS3URI(archive) && !store.IsVultrURI(archive) {
+		if archive, err = filepath.Abs(archive); err != nil {
+			return "", err
+		}
+	}
+
+	args := []string{"--wal-archive", archive}
+	for _, option := range [][2]string{{"--encryption-key-file", BackupEncryption.KeyFile}, {"--age-identity", BackupEncryption.AgeIdentityFile}} {
+		if option[1] == "" {
+			continue
+		}
+		file, err := filepath.Abs(option[1])
+		if err != nil {
+			return "", err
+		}
+		args = append(args, option[0], file)
+	}
+	if BackupEncryption.Passphrase != "" {
+		logger.Warning("The encryption passphrase is not written to restore_command: start PostgreSQL with BACKUP_ENCRYPTION_PASSPHRASE set")
+	}
+	switch {
+	case store.IsS3URI(archive):
+		settings := store.S3Settings
+		for _, option := range [][2]string{{"--s3-endpoint", settings.Endpoint}, {"--s3-region", settings.Region}, {"--s3-prefix", settings.Prefix}} {
+			if option[1] != "" {
+				args = append(args, option[0], option[1])
+			}
+		}
+		if settings.PathStyle {
+			args = append(args, "--s3-path-style")
+		}
+	case store.IsVultrURI(archive):
+		args = append(args, "--vultr-region", store.VultrSettings.Region)
+		if store.VultrSettings.Prefix != "" {
+			args = append(args, "--vultr-prefix", store.VultrSettings.Prefix)
+		}
+	}
+
+	command := shellQuote(exe) + ` wal-fetch "%f" "%p"`
+	for _, arg := range args {
+		command += " " + shellQuote(arg)
+	}
+	return command, nil
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./:@+=,-]+$`)
+
+// shellQuote quotes s, when needed, for the shell PostgreSQL runs
+// restore_command with.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// checkEmptyDirectory refuses to restore over an existing data directory.
+func checkEmptyDirectory(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dir)
+	}
+	return nil
+}
+
+// extractTar unpacks a tar stream into dir, refusing entries that would
+// land outside of it.
+func extractTar(in io.Reader, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if target != dir && !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("tar entry %s points outside of %s", header.Name, dir)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			logger.Warning(fmt.Sprintf("Skipping unsupported tar entry %s", header.Name))
+		}
+	}
+}
+
+func appendFile(name, content string) error {
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
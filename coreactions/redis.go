@@ -0,0 +1,286 @@
+package coreactions
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"yohan/databaseutilities/logger"
+)
+
+// redisMagic starts every RDB file.
+var redisMagic = []byte("REDIS")
+
+// RedisRDBName is the file a restore stages the snapshot as in --datadir.
+// It must match the instance's dbfilename setting.
+var RedisRDBName = "dump.rdb"
+
+// redisDriver backs up a whole Redis instance as an RDB snapshot, pulled
+// over the replication protocol so the tool does not need access to the
+// server's disk. The Connection's Database is only used to name backups.
+type redisDriver struct{}
+
+func init() {
+	Register(redisDriver{}, "redis")
+}
+
+func (redisDriver) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// FileExtension names backups after RDB files.
+func (redisDriver) FileExtension(kind string) string {
+	return ".rdb"
+}
+
+func (redisDriver) ServerVersion(conn Connection) (string, error) {
+	client, err := dialRedis(conn)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	info, err := client.do("INFO", "server")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range splitLines(info) {
+		if version, found := strings.CutPrefix(line, "redis_version:"); found {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("INFO did not report redis_version")
+}
+
+func (redisDriver) ToolVersion() (string, error) {
+	return "replication SYNC", nil
+}
+
+// Backup asks the server for a full resynchronisation, as a new replica
+// would. The server runs BGSAVE, or streams a diskless snapshot, and sends
+// the RDB once it is complete; the connection is closed before the
+// replication stream that follows.
+func (redisDriver) Backup(conn Connection, out io.Writer) error {
+	client, err := dialRedis(conn)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Redis 7 can skip the replication backlog for clients that only
+	// want the snapshot; older versions reject the option.
+	client.do("REPLCONF", "rdb-only", "1")
+
+	if err := client.send("SYNC"); err != nil {
+		return err
+	}
+
+	// The server sends newlines as keepalives while the snapshot is
+	// being written.
+	var header string
+	for header == "" {
+		line, err := client.r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("waiting for the snapshot: %w", err)
+		}
+		header = strings.TrimRight(line, "\r\n")
+	}
+
+	switch {
+	case strings.HasPrefix(header, "-"):
+		return fmt.Errorf("SYNC failed: %s", header[1:])
+	case strings.HasPrefix(header, "$EOF:"):
+		// Diskless transfer of unknown length, ended by a random mark.
+		return copyUntilMark(out, client.r, []byte(header[len("$EOF:"):]))
+	case strings.HasPrefix(header, "$"):
+		size, err := strconv.ParseInt(header[1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected SYNC reply %q", header)
+		}
+		logger.Info(fmt.Sprintf("Receiving RDB snapshot of %d bytes", size))
+		_, err = io.CopyN(out, client.r, size)
+		return err
+	default:
+		return fmt.Errorf("unexpected SYNC reply %q", header)
+	}
+}
+
+// copyUntilMark copies r to out up to the end mark, which is not copied.
+// The mark may be split across reads and followed by more data, such as
+// the replication stream, which is not copied either.
+func copyUntilMark(out io.Writer, r io.Reader, mark []byte) error {
+	if len(mark) == 0 {
+		return fmt.Errorf("snapshot has an empty end mark")
+	}
+	buf := make([]byte, 0, 64*1024+len(mark))
+	chunk := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if i := bytes.Index(buf, mark); i >= 0 {
+			_, werr := out.Write(buf[:i])
+			return werr
+		}
+		// Hold back the bytes that may start a mark split across reads.
+		if keep := len(mark) - 1; len(buf) > keep {
+			if _, werr := out.Write(buf[:len(buf)-keep]); werr != nil {
+				return werr
+			}
+			buf = append(buf[:0], buf[len(buf)-keep:]...)
+		}
+		if err == io.EOF {
+			return fmt.Errorf("snapshot ended before its end mark")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (redisDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	return fmt.Errorf("table backup is not supported for Redis")
+}
+
+// Restore stages the snapshot as the RDB file of a stopped instance, in
+// --datadir, so it is loaded when the instance starts. A running instance
+// would overwrite the file when it next saves or shuts down, so the restore
+// is refused while anything accepts connections on the instance's address,
+// whether or not the credentials are right. An existing RDB file is kept
+// with a .old suffix.
+func (redisDriver) Restore(conn Connection, in io.Reader) error {
+	dataDir := Recovery.DataDirectory
+	if dataDir == "" {
+		return fmt.Errorf("no data directory configured: set --datadir to the Redis dir")
+	}
+	address := net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))
+	if c, err := net.DialTimeout("tcp", address, 5*time.Second); err == nil {
+		c.Close()
+		return fmt.Errorf("redis is running on %s: stop the instance before restoring its snapshot", address)
+	}
+
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(len(redisMagic))
+	if !bytes.Equal(magic, redisMagic) {
+		return fmt.Errorf("backup is not a Redis RDB snapshot")
+	}
+
+	tmp, err := os.CreateTemp(dataDir, ".dbutility_restore_*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, br); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	target := filepath.Join(dataDir, RedisRDBName)
+	if _, err := os.Stat(target); err == nil {
+		old := fmt.Sprintf("%s.%s.old", target, time.Now().Format("20060102_150405"))
+		if err := os.Rename(target, old); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("Kept the previous snapshot as %s", old))
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Snapshot staged as %s, start Redis to load it", target))
+	return nil
+}
+
+func (redisDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	return fmt.Errorf("table restore is not supported for Redis")
+}
+
+func (redisDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	return fmt.Errorf("point-in-time recovery is not supported for Redis")
+}
+
+// redisClient speaks just enough RESP for the driver.
+type redisClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialRedis connects and authenticates, with the ACL user if one is
+// given.
+func dialRedis(conn Connection) (*redisClient, error) {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port)), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	client := &redisClient{conn: c, r: bufio.NewReader(c)}
+
+	switch {
+	case conn.Username != "":
+		_, err = client.do("AUTH", conn.Username, conn.Password)
+	case conn.Password != "":
+		_, err = client.do("AUTH", conn.Password)
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *redisClient) Close() error {
+	return c.conn.Close()
+}
+
+// send writes a command as an array of bulk strings.
+func (c *redisClient) send(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(c.conn, b.String())
+	return err
+}
+
+// do sends a command and reads a simple, integer or bulk string reply.
+func (c *redisClient) do(args ...string) (string, error) {
+	if err := c.send(args...); err != nil {
+		return "", err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", fmt.Errorf("%s failed: %s", args[0], line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return "", err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return "", err
+		}
+		return string(data[:size]), nil
+	default:
+		return "", fmt.Errorf("unexpected reply to %s: %q", args[0], line)
+	}
+}
@@ -0,0 +1,47 @@
+package coreactions
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader returns its data at most size bytes at a time.
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestCopyUntilMark(t *testing.T) {
+	mark := []byte("0123456789abcdef0123456789abcdef01234567")
+	snapshot := bytes.Repeat([]byte("REDIS0011 snapshot bytes "), 5000)
+	// The replication stream goes on after the mark.
+	stream := append(append(bytes.Clone(snapshot), mark...), "*1\r\n$4\r\nPING\r\n"...)
+
+	for _, size := range []int{1, 7, len(mark) - 1, len(mark) + 3, len(stream)} {
+		var out bytes.Buffer
+		if err := copyUntilMark(&out, &chunkReader{data: stream, size: size}, mark); err != nil {
+			t.Fatalf("chunks of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), snapshot) {
+			t.Fatalf("chunks of %d bytes: copied %d bytes, want %d", size, out.Len(), len(snapshot))
+		}
+	}
+
+	var out bytes.Buffer
+	err := copyUntilMark(&out, iotest.OneByteReader(bytes.NewReader(snapshot)), mark)
+	if err == nil || !strings.Contains(err.Error(), "before its end mark") {
+		t.Fatalf("got error %v", err)
+	}
+}
@@ -1,66 +1,52 @@
 package coreactions
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"strings"
 	"time"
 	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
 )
 
 func RestoreDatabase(dbType, host string, port int, username, password, dbName, inputFile string) error {
-	logger.Info(fmt.Sprintf("Starting restore of database %s from %s", dbName, inputFile))
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	return restoreDatabase(dbType, conn, inputFile)
+}
 
-	if _, err := os.Stat(inputFile); os.IsNotExist(err) {
-		err := fmt.Errorf("input file does not exist: %s", inputFile)
-		logger.Error(err.Error())
+// restoreDatabase restores the backup or backup set at inputFile into
+// conn.Database.
+func restoreDatabase(dbType string, conn Connection, inputFile string) error {
+	logger.Info(fmt.Sprintf("Starting restore of database %s from %s", conn.Database, inputFile))
+
+	set, err := openBackupSet(inputFile)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read backup set: %v", err))
 		return err
 	}
+	if set != nil {
+		return restoreBackupSet(dbType, conn, inputFile, set, nil)
+	}
 
-	var cmd *exec.Cmd
-
-	switch strings.ToLower(dbType) {
-	case "mysql", "mariadb":
-		cmd = exec.Command(
-			"mysql",
-			fmt.Sprintf("-h%s", host),
-			fmt.Sprintf("-P%d", port),
-			fmt.Sprintf("-u%s", username),
-			fmt.Sprintf("-p%s", password),
-			dbName,
-		)
-
-		inFile, err := os.Open(inputFile)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to open input file: %v", err))
-			return err
-		}
-		defer inFile.Close()
-		cmd.Stdin = inFile
-
-	case "postgresql", "postgres":
-
-		os.Setenv("PGPASSWORD", password)
-		cmd = exec.Command(
-			"psql",
-			fmt.Sprintf("--host=%s", host),
-			fmt.Sprintf("--port=%d", port),
-			fmt.Sprintf("--username=%s", username),
-			fmt.Sprintf("--dbname=%s", dbName),
-			"-f", inputFile,
-		)
-
-	default:
-		err := fmt.Errorf("unsupported database type: %s", dbType)
-		logger.Error(err.Error())
+	inFile, manifest, err := openInput(inputFile)
+	if err != nil {
 		return err
 	}
+	defer inFile.Close()
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	driver, err := restoreDriver(dbType, manifest)
+	if err != nil {
+		return err
+	}
 
-	if err := cmd.Run(); err != nil {
+	conn.Backup = manifest
+	if manifest != nil && manifest.Parent != "" {
+		err = restoreChain(driver, conn, inputFile, manifest, inFile)
+	} else {
+		err = driver.Restore(conn, inFile)
+	}
+	if err != nil {
 		logger.Error(fmt.Sprintf("Database restore failed: %v", err))
 		return err
 	}
@@ -72,157 +58,274 @@ func RestoreDatabase(dbType, host string, port int, username, password, dbName,
 func RestoreDatabaseTables(dbType, host string, port int, username, password, dbName, inputFile string, tables []string) error {
 	logger.Info(fmt.Sprintf("Starting restore of selected tables to database %s from %s", dbName, inputFile))
 
-	if _, err := os.Stat(inputFile); os.IsNotExist(err) {
-		err := fmt.Errorf("input file does not exist: %s", inputFile)
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	set, err := openBackupSet(inputFile)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read backup set: %v", err))
+		return err
+	}
+	if set != nil {
+		return restoreBackupSet(dbType, conn, inputFile, set, tables)
+	}
+
+	inFile, manifest, err := openInput(inputFile)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	driver, err := restoreDriver(dbType, manifest)
+	if err != nil {
+		return err
+	}
+	if !driver.Capabilities().TableRestore {
+		err := fmt.Errorf("table restore is not supported for database type: %s", dbType)
 		logger.Error(err.Error())
 		return err
 	}
 
-	if strings.ToLower(dbType) == "mysql" || strings.ToLower(dbType) == "mariadb" {
-		// Create a temporary file to hold the filtered backup
-		tempFile, err := os.CreateTemp("", "filtered_backup_*.sql")
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to create temporary file: %v", err))
-			return err
-		}
-		defer os.Remove(tempFile.Name())
+	conn.Backup = manifest
+	if err := driver.RestoreTables(conn, inFile, tables); err != nil {
+		logger.Error(fmt.Sprintf("Database tables restore failed: %v", err))
+		return err
+	}
 
-		data, err := os.ReadFile(inputFile)
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to read input file: %v", err))
-			return err
-		}
+	logger.Info(fmt.Sprintf("Database tables restore completed successfully from %s", inputFile))
+	return nil
+}
 
-		content := string(data)
-		var filteredContent strings.Builder
+// restoreBackupSet restores the backup set opened from inputFile, or the
+// given tables of it.
+func restoreBackupSet(dbType string, conn Connection, inputFile string, set *setInput, tables []string) error {
+	driver, err := restoreDriver(dbType, set.manifest)
+	if err != nil {
+		return err
+	}
+	if len(tables) > 0 && !driver.Capabilities().TableRestore {
+		err := fmt.Errorf("table restore is not supported for database type: %s", dbType)
+		logger.Error(err.Error())
+		return err
+	}
 
-		headerEnd := strings.Index(content, "CREATE TABLE")
-		if headerEnd > 0 {
-			filteredContent.WriteString(content[:headerEnd])
-		}
+	conn.Backup = set.manifest
+	if err := restoreSet(driver, conn, set, tables); err != nil {
+		logger.Error(fmt.Sprintf("Backup set restore failed: %v", err))
+		return err
+	}
+	logger.Info(fmt.Sprintf("Backup set restore completed successfully from %s", inputFile))
+	return nil
+}
 
-		for _, table := range tables {
-			tableStart := strings.Index(content, fmt.Sprintf("CREATE TABLE `%s`", table))
-			if tableStart == -1 {
-				logger.Warning(fmt.Sprintf("Table %s not found in backup file", table))
-				continue
-			}
+func RestoreDatabaseOfSpecificDate(dbType, host string, port int, username, password, dbName, inputFile, date string) error {
+	logger.Info(fmt.Sprintf("Starting point-in-time restore of database %s to date %s", dbName, date))
 
-			nextTableStart := strings.Index(content[tableStart+1:], "CREATE TABLE")
-			if nextTableStart == -1 {
+	target, err := recoveryTarget(date)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
 
-				filteredContent.WriteString(content[tableStart:])
-			} else {
-				filteredContent.WriteString(content[tableStart : tableStart+nextTableStart+1])
-			}
-		}
+	inFile, manifest, err := openInput(inputFile)
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
+
+	driver, err := restoreDriver(dbType, manifest)
+	if err != nil {
+		return err
+	}
+	if !driver.Capabilities().PointInTimeRestore {
+		err := fmt.Errorf("unsupported database type for point-in-time recovery: %s", dbType)
+		logger.Error(err.Error())
+		return err
+	}
 
-		if err := os.WriteFile(tempFile.Name(), []byte(filteredContent.String()), 0644); err != nil {
-			logger.Error(fmt.Sprintf("Failed to write to temporary file: %v", err))
-			return err
+	conn := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName, Backup: manifest}
+	if manifest != nil {
+		if manifest.BinlogFile != "" {
+			target.Start = &BinlogPosition{File: manifest.BinlogFile, Position: manifest.BinlogPosition}
 		}
+		target.StartGTIDs = manifest.GTIDExecuted
+	}
+	if err := driver.PointInTimeRestore(conn, inFile, target); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Point-in-time recovery completed successfully to %s", target))
+	return nil
+}
+
+// parseTargetTime reads the --date of a point-in-time restore. A date
+// without a zone offset is a local time of the machine dbutility runs on;
+// each driver converts the instant into what its server expects.
+func parseTargetTime(date string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", date, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date format: expected 2006-01-02T15:04:05, optionally with a zone offset such as Z or +02:00: %w", err)
+	}
+	return t, nil
+}
 
-		inputFile = tempFile.Name()
+// recoveryTarget builds the replay target from the date argument and the
+// MySQL stop options in Recovery. At least one of them must be set.
+func recoveryTarget(date string) (RecoveryTarget, error) {
+	var target RecoveryTarget
+	if date != "" {
+		targetDate, err := parseTargetTime(date)
+		if err != nil {
+			return target, err
+		}
+		target.Time = targetDate
 	}
+	if Recovery.StopPosition != "" {
+		position, err := ParseBinlogPosition(Recovery.StopPosition)
+		if err != nil {
+			return target, err
+		}
+		target.StopPosition = &position
+	}
+	target.StopGTIDs = Recovery.StopGTIDs
 
-	return RestoreDatabase(dbType, host, port, username, password, dbName, inputFile)
+	if target.Time.IsZero() && target.StopPosition == nil && target.StopGTIDs == "" {
+		return target, fmt.Errorf("no recovery target: set --date, --stop-position or --stop-gtids")
+	}
+	return target, nil
 }
 
-func RestoreDatabaseOfSpecificDate(dbType, host string, port int, username, password, dbName, inputFile, date string) error {
-	logger.Info(fmt.Sprintf("Starting point-in-time restore of database %s to date %s", dbName, date))
+// openInput opens a backup for reading through the store that inputFile
+// belongs to and undoes any encryption and compression. inputFile may be a
+// local path or an s3:// or vultr:// URI. When the backup has a manifest
+// its checksum is verified before the backup is returned, so a restore
+// never starts on a corrupted file, and the manifest is returned.
+func openInput(inputFile string) (io.ReadCloser, *Manifest, error) {
+	st, key, err := store.Open(inputFile)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, nil, err
+	}
 
-	// Check if input file exists
-	if _, err := os.Stat(inputFile); os.IsNotExist(err) {
+	if _, err := st.Stat(key); errors.Is(err, os.ErrNotExist) {
 		err := fmt.Errorf("input file does not exist: %s", inputFile)
 		logger.Error(err.Error())
-		return err
+		return nil, nil, err
 	}
 
-	// Parse the date string
-	targetDate, err := time.Parse("2006-01-02T15:04:05", date)
+	manifest, err := readManifest(st, key)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Invalid date format: %v", err))
-		return err
+		logger.Error(fmt.Sprintf("Failed to read backup manifest: %v", err))
+		return nil, nil, err
+	}
+	if manifest == nil {
+		logger.Warning(fmt.Sprintf("No manifest found for %s, skipping checksum verification", inputFile))
 	}
 
-	switch strings.ToLower(dbType) {
-	case "mysql", "mariadb":
+	in, err := openVerified(st, key, manifest)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to open input file: %v", err))
+		return nil, nil, err
+	}
 
-		if err := RestoreDatabase(dbType, host, port, username, password, dbName, inputFile); err != nil {
-			return err
-		}
+	plain, err := decodeInput(in)
+	if err != nil {
+		in.Close()
+		logger.Error(err.Error())
+		return nil, nil, err
+	}
+	return stackedReader{ReadCloser: plain, under: in}, manifest, nil
+}
 
-		// Execute mysqlbinlog to apply logs up to the target date
-		cmd := exec.Command(
-			"mysqlbinlog",
-			fmt.Sprintf("--stop-datetime='%s'", targetDate.Format("2006-01-02 15:04:05")),
-			"--database", dbName,
-			"/var/log/mysql/mysql-bin.*", // Adjust path to binlogs as needed
-		)
-
-		// Pipe output to mysql command
-		mysqlCmd := exec.Command(
-			"mysql",
-			fmt.Sprintf("-h%s", host),
-			fmt.Sprintf("-P%d", port),
-			fmt.Sprintf("-u%s", username),
-			fmt.Sprintf("-p%s", password),
-			dbName,
-		)
-
-		pipe, err := cmd.StdoutPipe()
+// openVerified opens the stored bytes of the backup at key. With a
+// manifest the whole file is checked against it first: local files are
+// simply read twice, and files in a remote store are spooled to a
+// temporary file, readable only by the current user, while they are
+// downloaded and hashed. The spooled file holds the backup as stored, so
+// an encrypted backup stays encrypted on disk.
+func openVerified(st store.Store, key string, manifest *Manifest) (io.ReadCloser, error) {
+	in, err := st.Get(key)
+	if err != nil || manifest == nil {
+		return in, err
+	}
+	if _, local := st.(*store.Local); local {
+		err := verifyChecksum(in, manifest, st.URI(key))
+		in.Close()
 		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to create pipe: %v", err))
-			return err
+			return nil, err
 		}
-		mysqlCmd.Stdin = pipe
+		return st.Get(key)
+	}
 
-		// Start both commands
-		if err := cmd.Start(); err != nil {
-			logger.Error(fmt.Sprintf("Failed to start mysqlbinlog: %v", err))
-			return err
-		}
-		if err := mysqlCmd.Start(); err != nil {
-			logger.Error(fmt.Sprintf("Failed to start mysql: %v", err))
-			return err
-		}
+	defer in.Close()
+	spool, err := os.CreateTemp("", "dbutility_restore_*")
+	if err != nil {
+		return nil, err
+	}
+	spooled := tempFile{spool}
+	if err := verifyChecksum(io.TeeReader(in, spool), manifest, st.URI(key)); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spooled.Close()
+		return nil, err
+	}
+	return spooled, nil
+}
 
-		// Wait for completion
-		if err := cmd.Wait(); err != nil {
-			logger.Error(fmt.Sprintf("mysqlbinlog failed: %v", err))
-			return err
-		}
-		if err := mysqlCmd.Wait(); err != nil {
-			logger.Error(fmt.Sprintf("mysql failed: %v", err))
-			return err
-		}
+// tempFile is a temporary file that is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
 
-	case "postgresql", "postgres":
-		os.Setenv("PGPASSWORD", password)
-		cmd := exec.Command(
-			"pg_restore",
-			fmt.Sprintf("--host=%s", host),
-			fmt.Sprintf("--port=%d", port),
-			fmt.Sprintf("--username=%s", username),
-			fmt.Sprintf("--dbname=%s", dbName),
-			fmt.Sprintf("--recovery-target-time=%s", targetDate.Format("2006-01-02 15:04:05")),
-			inputFile,
-		)
-
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		if err := cmd.Run(); err != nil {
-			logger.Error(fmt.Sprintf("Point-in-time recovery failed: %v", err))
-			return err
-		}
+func (f tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
 
-	default:
-		err := fmt.Errorf("unsupported database type for point-in-time recovery: %s", dbType)
-		logger.Error(err.Error())
-		return err
+// decodeInput decrypts and decompresses a stored backup.
+func decodeInput(in io.Reader) (io.ReadCloser, error) {
+	decrypted, err := decryptReader(in, BackupEncryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt input file: %w", err)
+	}
+	plain, err := decompressReader(decrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress input file: %w", err)
+	}
+	return plain, nil
+}
+
+// restoreDriver picks the driver for a restore. The engine recorded in the
+// manifest is used when no database type is given, and a database type
+// that disagrees with the manifest is refused.
+func restoreDriver(dbType string, manifest *Manifest) (Driver, error) {
+	if manifest != nil {
+		if dbType == "" {
+			dbType = manifest.Engine
+		} else if engineName(dbType) != manifest.Engine {
+			err := fmt.Errorf("backup was taken from a %s database and cannot be restored as %s", manifest.Engine, dbType)
+			logger.Error(err.Error())
+			return nil, err
+		}
 	}
+	return lookupDriver(dbType)
+}
 
-	logger.Info(fmt.Sprintf("Point-in-time recovery completed successfully to %s", date))
-	return nil
+// stackedReader is a reader layered on top of another one; closing it
+// closes both.
+type stackedReader struct {
+	io.ReadCloser
+	under io.Closer
+}
+
+func (r stackedReader) Close() error {
+	err := r.ReadCloser.Close()
+	if underErr := r.under.Close(); err == nil {
+		err = underErr
+	}
+	return err
 }
@@ -0,0 +1,138 @@
+package coreactions
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// scriptDriver backs up a fixed script and records what it restores.
+type scriptDriver struct {
+	restored *[]string
+}
+
+func (d scriptDriver) Backup(conn Connection, out io.Writer) error {
+	_, err := io.WriteString(out, "CREATE TABLE users (id int);\nINSERT INTO users VALUES (1);\n")
+	return err
+}
+
+func (d scriptDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	return d.Backup(conn, out)
+}
+
+func (d scriptDriver) Restore(conn Connection, in io.Reader) error {
+	script, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	*d.restored = append(*d.restored, string(script))
+	return nil
+}
+
+func (d scriptDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	return d.Restore(conn, in)
+}
+
+func (d scriptDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	return d.Restore(conn, in)
+}
+
+func (scriptDriver) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// inTempDir runs the test in a temporary directory, which also receives
+// the log file.
+func inTempDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	logger.Init()
+	return dir
+}
+
+func TestRestoreVerifiesChecksumFirst(t *testing.T) {
+	dir := inTempDir(t)
+	var restored []string
+	Register(scriptDriver{restored: &restored}, "scripttest")
+
+	backup := filepath.Join(dir, "shop.sql")
+	if err := BackupDatabase("scripttest", "", 0, "", "", "shop", backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreDatabase("", "", 0, "", "", "shop", backup); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || !strings.Contains(restored[0], "INSERT INTO users") {
+		t.Fatalf("restored %q", restored)
+	}
+
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-5] ^= 1
+	if err := os.WriteFile(backup, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err = RestoreDatabase("", "", 0, "", "", "shop", backup)
+	if err == nil || !strings.Contains(err.Error(), "checksum does not match") {
+		t.Fatalf("restore of a corrupted backup: %v", err)
+	}
+	if len(restored) != 1 {
+		t.Errorf("the driver was given the corrupted backup: %q", restored[1:])
+	}
+}
+
+// remoteStore hides that a store is local, so backups are read from it
+// like from S3.
+type remoteStore struct {
+	*store.Local
+}
+
+func TestOpenVerifiedSpoolsRemoteBackups(t *testing.T) {
+	spoolDir := t.TempDir()
+	t.Setenv("TMPDIR", spoolDir)
+	st := remoteStore{store.NewLocal(t.TempDir())}
+
+	script := "SELECT 1;\n"
+	w, err := st.Put("shop.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := newHashingWriter(w)
+	io.WriteString(hash, script)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Size: hash.size, SHA256: hash.Sum()}
+
+	in, err := openVerified(st, "shop.sql", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(in)
+	in.Close()
+	if err != nil || string(got) != script {
+		t.Fatalf("read %q, %v", got, err)
+	}
+
+	m.SHA256 = strings.Repeat("0", len(m.SHA256))
+	if _, err := openVerified(st, "shop.sql", m); err == nil {
+		t.Fatal("corrupted backup was opened")
+	}
+	if spooled, _ := os.ReadDir(spoolDir); len(spooled) > 0 {
+		t.Errorf("spooled files left behind: %v", spooled)
+	}
+}
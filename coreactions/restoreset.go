@@ -0,0 +1,187 @@
+package coreactions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// setInput is a backup set opened for restore.
+type setInput struct {
+	st       store.Store
+	prefix   string
+	manifest *Manifest
+}
+
+// openBackupSet opens the backup set at inputFile, which names either the
+// set's directory or its index. It returns nil when inputFile is not a
+// backup set.
+func openBackupSet(inputFile string) (*setInput, error) {
+	st, key, err := store.Open(inputFile)
+	if err != nil {
+		return nil, err
+	}
+	prefix, found := strings.CutSuffix(key, backupSetIndex)
+	if !found && key != "" {
+		prefix = strings.TrimSuffix(key, "/") + "/"
+	}
+	// Probing below a plain backup file fails with ENOTDIR on local disks;
+	// any failure there means inputFile is not a set, and opening it as a
+	// single-file backup reports the real problem.
+	if _, err := st.Stat(prefix + backupSetIndex); err != nil {
+		if found {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	r, err := st.Get(prefix + backupSetIndex)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid backup set index %s: %w", st.URI(prefix+backupSetIndex), err)
+	}
+	if len(m.Parts) == 0 {
+		return nil, fmt.Errorf("backup set %s lists no parts", st.URI(prefix))
+	}
+	return &setInput{st: st, prefix: prefix, manifest: &m}, nil
+}
+
+// restoreSet restores a backup set, or the given tables of it: the schema
+// first, then the rows of Parallel tables at once, then the indexes,
+// constraints and triggers. Every table is attempted even when some fail,
+// and all failures are reported together.
+func restoreSet(driver Driver, conn Connection, set *setInput, tables []string) error {
+	var schema, postData *BackupPart
+	var data []BackupPart
+	for i, part := range set.manifest.Parts {
+		switch part.Section {
+		case SectionSchema:
+			schema = &set.manifest.Parts[i]
+		case SectionPostData:
+			postData = &set.manifest.Parts[i]
+		case SectionData:
+			if len(tables) == 0 || containsTable(tables, part.Table) {
+				data = append(data, part)
+			}
+		default:
+			return fmt.Errorf("backup set %s has a part of unknown section %q", set.st.URI(set.prefix), part.Section)
+		}
+	}
+	if schema == nil || postData == nil {
+		return fmt.Errorf("backup set %s is incomplete", set.st.URI(set.prefix))
+	}
+	for _, table := range tables {
+		if !hasTablePart(data, table) {
+			logger.Warning(fmt.Sprintf("Table %s not found in backup set", table))
+		}
+	}
+	logger.Info(fmt.Sprintf("Restoring backup set %s: %d tables with %d workers", set.st.URI(set.prefix), len(data), Parallel))
+
+	var restore SetRestore
+	if restorer, ok := driver.(PartRestorer); ok {
+		var err error
+		if restore, err = restorer.StartSetRestore(conn, tables); err != nil {
+			return fmt.Errorf("failed to start the restore: %w", err)
+		}
+	}
+
+	if err := set.restorePart(driver, restore, conn, *schema, tables); err != nil {
+		return fmt.Errorf("failed to restore the schema: %w", err)
+	}
+
+	failures := make([]error, len(data))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < Parallel; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				table := data[i].Table
+				if err := set.restorePart(driver, restore, conn, data[i], nil); err != nil {
+					logger.Error(fmt.Sprintf("Restore of table %s failed: %v", table, err))
+					failures[i] = fmt.Errorf("table %s: %w", table, err)
+				} else {
+					logger.Info(fmt.Sprintf("Restored table %s", table))
+				}
+			}
+		}()
+	}
+	for i := range data {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	// The indexes and constraints are created even when some tables
+	// failed, so the tables that were restored are complete.
+	if err := set.restorePart(driver, restore, conn, *postData, tables); err != nil {
+		failures = append(failures, fmt.Errorf("indexes, constraints and triggers: %w", err))
+	}
+
+	failed := 0
+	for _, failure := range failures {
+		if failure != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d parts failed to restore:\n%w", failed, len(data)+1, errors.Join(failures...))
+	}
+	return nil
+}
+
+// restorePart restores one part of the set, keeping only the given tables
+// of the schema and post-data parts. restore is nil unless the driver is
+// a PartRestorer.
+func (set *setInput) restorePart(driver Driver, restore SetRestore, conn Connection, part BackupPart, tables []string) error {
+	in, _, err := openInput(set.st.URI(set.prefix + part.File))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if restore != nil {
+		return restore.RestorePart(in, part.Section)
+	}
+	if len(tables) > 0 {
+		return driver.RestoreTables(conn, in, tables)
+	}
+	return driver.Restore(conn, in)
+}
+
+// containsTable reports whether table, as recorded in a backup set, is one
+// of the requested tables. Quotes are ignored, and a name without a schema
+// matches the table of that name in any schema.
+func containsTable(requested []string, table string) bool {
+	table = unquoteName(table)
+	for _, name := range requested {
+		name = unquoteName(name)
+		if name == table || (!strings.Contains(name, ".") && strings.HasSuffix(table, "."+name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTablePart(parts []BackupPart, table string) bool {
+	for _, part := range parts {
+		if containsTable([]string{table}, part.Table) {
+			return true
+		}
+	}
+	return false
+}
+
+func unquoteName(name string) string {
+	return strings.NewReplacer(`"`, "", "`", "").Replace(name)
+}
@@ -0,0 +1,72 @@
+package coreactions
+
+import (
+	"io"
+	"regexp"
+)
+
+// sqlFilter is a streaming reader that passes every statement of a dump to
+// filter, which emits what is restored.
+type sqlFilter struct {
+	s      *sqlScanner
+	filter func(st *sqlStatement)
+	// end, if set, is called once the whole dump has been read, to emit
+	// what goes after the last statement.
+	end func()
+	buf []byte
+	err error
+}
+
+func (f *sqlFilter) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		st, err := f.s.Next()
+		if err != nil {
+			f.err = err
+			if err == io.EOF && f.end != nil {
+				f.end()
+			}
+			continue
+		}
+		f.filter(st)
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// emit passes a statement, with the comments before it, through.
+func (f *sqlFilter) emit(st *sqlStatement) {
+	f.buf = append(append(f.buf, st.Comments...), st.Text...)
+}
+
+// Statements with which pg_dump --create and mysqldump --databases switch to
+// the database they were taken from. They are removed when a backup is
+// test-restored into a scratch database, and from table restores, so the
+// rows land in the database given on the command line.
+var (
+	postgresDatabaseSwitch = regexp.MustCompile(`^(\\connect |(DROP|CREATE|ALTER) DATABASE |COMMENT ON DATABASE )`)
+	mysqlDatabaseSwitch    = regexp.MustCompile("^(CREATE DATABASE |USE `)")
+)
+
+// stripDatabaseSwitch removes the statements that switch databases from a
+// dump of the given dialect.
+func stripDatabaseSwitch(in io.Reader, dialect sqlDialect) io.Reader {
+	f := &sqlFilter{s: newSQLScanner(in, dialect)}
+	f.filter = func(st *sqlStatement) {
+		if !st.CopyData && switchesDatabase(st, dialect) {
+			return
+		}
+		f.emit(st)
+	}
+	return f
+}
+
+func switchesDatabase(st *sqlStatement, dialect sqlDialect) bool {
+	if dialect == mysqlDialect {
+		return mysqlDatabaseSwitch.Match(st.Text)
+	}
+	return postgresDatabaseSwitch.Match(st.Text)
+}
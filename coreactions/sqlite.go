@@ -0,0 +1,537 @@
+//go:build cgo
+
+package coreactions
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"yohan/databaseutilities/logger"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteHeader starts every SQLite database file.
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// sqliteDriver backs up SQLite database files. The Connection's Database is
+// the path of the file; host, port and credentials are not used. Full
+// backups are copies of the database file taken with the online backup
+// API, table backups are SQL text.
+type sqliteDriver struct{}
+
+func init() {
+	Register(sqliteDriver{}, "sqlite", "sqlite3")
+}
+
+func (sqliteDriver) Capabilities() Capabilities {
+	return Capabilities{
+		TableBackup:  true,
+		TableRestore: true,
+	}
+}
+
+// FileExtension names full backups after the database files they hold;
+// table backups are SQL text.
+func (sqliteDriver) FileExtension(kind string) string {
+	if kind == KindTables {
+		return ".sql"
+	}
+	return ".db"
+}
+
+func (sqliteDriver) ServerVersion(conn Connection) (string, error) {
+	version, _, _ := sqlite3.Version()
+	return version, nil
+}
+
+func (sqliteDriver) ToolVersion() (string, error) {
+	version, _, _ := sqlite3.Version()
+	return "SQLite " + version + " (online backup API)", nil
+}
+
+// openSQLite opens the database file at path. readOnly databases must
+// already exist.
+func openSQLite(path string, readOnly bool) (*sql.DB, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no SQLite database file given")
+	}
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_busy_timeout=5000"
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+		dsn += "&mode=ro"
+	}
+	return sql.Open("sqlite3", dsn)
+}
+
+// Backup copies the database with the online backup API, which gives a
+// consistent snapshot while the application keeps writing, into a
+// temporary file and streams that file to out.
+func (sqliteDriver) Backup(conn Connection, out io.Writer) error {
+	if err := plaintextTemp("a SQLite backup"); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", "dbutility_sqlite_*.db")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := sqliteOnlineBackup(conn.Database, tmp.Name()); err != nil {
+		return err
+	}
+
+	in, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// sqliteOnlineBackup copies the main database of source into target in
+// a single backup step.
+func sqliteOnlineBackup(source, target string) error {
+	src, err := openSQLite(source, true)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := openSQLite(target, false)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dstRaw any) error {
+		return srcConn.Raw(func(srcRaw any) error {
+			backup, err := dstRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// BackupTables writes the schema and rows of the given tables as SQL text,
+// read in one transaction so the tables are consistent with each other.
+func (sqliteDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	db, err := openSQLite(conn.Database, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "PRAGMA foreign_keys=OFF;")
+	fmt.Fprintln(w, "BEGIN TRANSACTION;")
+	for _, table := range tables {
+		if err := dumpSQLiteTable(tx, w, table); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(w, "COMMIT;")
+	return w.Flush()
+}
+
+// dumpSQLiteTable writes the statements recreating one table, its rows,
+// indexes and triggers.
+func dumpSQLiteTable(tx *sql.Tx, w io.Writer, table string) error {
+	var createSQL string
+	err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&createSQL)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("table %s does not exist", table)
+	}
+	if err != nil {
+		return err
+	}
+
+	columns, err := sqliteColumns(tx, "main", table)
+	if err != nil {
+		return err
+	}
+
+	quoted := quoteIdentifier(table, '"')
+	fmt.Fprintf(w, "DROP TABLE IF EXISTS %s;\n", quoted)
+	fmt.Fprintf(w, "%s;\n", createSQL)
+
+	// quote() renders every value, blobs and reals included, as the exact
+	// SQL literal, so no value goes through a Go type.
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i] = fmt.Sprintf("quote(%s)", quoteIdentifier(column, '"'))
+	}
+	columnList := strings.Join(quoteIdentifiers(columns), ",")
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s FROM %s", strings.Join(values, " || ',' || "), quoted))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "INSERT INTO %s(%s) VALUES(%s);\n", quoted, columnList, row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	extras, err := sqliteTableExtras(tx, "main", table)
+	if err != nil {
+		return err
+	}
+	for _, statement := range extras {
+		fmt.Fprintf(w, "%s;\n", statement)
+	}
+	return nil
+}
+
+// sqliteQuerier is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type sqliteQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// sqliteColumns lists the insertable columns of a table; generated columns
+// are left out.
+func sqliteColumns(q sqliteQuerier, schema, table string) ([]string, error) {
+	rows, err := q.Query(fmt.Sprintf("SELECT name FROM pragma_table_info(%s, %s)", quoteLiteral(table), quoteLiteral(schema)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+func quoteIdentifiers(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdentifier(name, '"')
+	}
+	return quoted
+}
+
+// Restore creates the database file from a full backup or a SQL dump. It
+// refuses to replace an existing file; the new database is built next to
+// it and only renamed into place once complete.
+func (sqliteDriver) Restore(conn Connection, in io.Reader) error {
+	if conn.Database == "" {
+		return fmt.Errorf("no SQLite database file given")
+	}
+	if _, err := os.Stat(conn.Database); err == nil {
+		return fmt.Errorf("%s already exists: SQLite backups are restored into a new file", conn.Database)
+	}
+
+	tmp, err := loadSQLiteBackup(in, filepath.Dir(conn.Database))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	return os.Rename(tmp, conn.Database)
+}
+
+// RestoreTables copies the given tables, with their indexes and triggers,
+// from the backup into the database file, replacing tables of the same
+// name. The file is created if it does not exist.
+func (sqliteDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	if err := plaintextTemp("a SQLite table restore"); err != nil {
+		return err
+	}
+	tmp, err := loadSQLiteBackup(in, "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	db, err := openSQLite(conn.Database, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if _, err := c.ExecContext(ctx, "ATTACH DATABASE ? AS backup", tmp); err != nil {
+		return err
+	}
+	defer c.ExecContext(ctx, "DETACH DATABASE backup")
+
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		var createSQL string
+		err := tx.QueryRow("SELECT sql FROM backup.sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&createSQL)
+		if err == sql.ErrNoRows {
+			logger.Warning(fmt.Sprintf("Table %s not found in backup file", table))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		columns, err := sqliteColumns(tx, "backup", table)
+		if err != nil {
+			return err
+		}
+		quoted := quoteIdentifier(table, '"')
+		columnList := strings.Join(quoteIdentifiers(columns), ",")
+		statements := []string{
+			fmt.Sprintf("DROP TABLE IF EXISTS main.%s", quoted),
+			createSQL,
+			fmt.Sprintf("INSERT INTO main.%s(%s) SELECT %s FROM backup.%s", quoted, columnList, columnList, quoted),
+		}
+		extras, err := sqliteTableExtras(tx, "backup", table)
+		if err != nil {
+			return err
+		}
+		for _, statement := range append(statements, extras...) {
+			if _, err := tx.Exec(statement); err != nil {
+				return fmt.Errorf("failed to restore table %s: %w", table, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteTableExtras returns the index and trigger definitions of a table.
+func sqliteTableExtras(q sqliteQuerier, schema, table string) ([]string, error) {
+	rows, err := q.Query(fmt.Sprintf("SELECT sql FROM %s.sqlite_master WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL", schema), table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statements []string
+	for rows.Next() {
+		var statement string
+		if err := rows.Scan(&statement); err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	return statements, rows.Err()
+}
+
+// loadSQLiteBackup turns a backup, either a database file or a SQL dump,
+// into a database file in dir (the temp directory if empty) and returns
+// its path. The caller removes the file.
+func loadSQLiteBackup(in io.Reader, dir string) (string, error) {
+	tmp, err := os.CreateTemp(dir, ".dbutility_restore_*.db")
+	if err != nil {
+		return "", err
+	}
+	name := tmp.Name()
+
+	br := bufio.NewReader(in)
+	header, _ := br.Peek(len(sqliteHeader))
+	if bytes.Equal(header, sqliteHeader) {
+		_, err = io.Copy(tmp, br)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		tmp.Close()
+		err = execSQLiteScript(name, br)
+	}
+	if err == nil {
+		err = checkSQLite(name)
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// execSQLiteScript runs a SQL dump against the database file at path one
+// statement at a time, so the dump is never held in memory. The statements
+// share one connection, which the dump's BEGIN TRANSACTION and COMMIT
+// apply to.
+func execSQLiteScript(path string, in io.Reader) error {
+	db, err := openSQLite(path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	s := newSQLScanner(in, sqliteDialect)
+	for {
+		st, err := s.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(st.Text)) == 0 {
+			continue
+		}
+		if _, err := c.ExecContext(ctx, string(st.Text)); err != nil {
+			return fmt.Errorf("failed to run %q: %w", firstLine(st.Text), err)
+		}
+	}
+}
+
+// firstLine returns the first line of a statement, for error messages.
+func firstLine(text []byte) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(string(text)), "\n")
+	return line
+}
+
+// checkSQLite runs a quick integrity check of the database file at path.
+func checkSQLite(path string) error {
+	db, err := openSQLite(path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&result); err != nil {
+		return fmt.Errorf("backup is not a valid SQLite database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup failed the SQLite integrity check: %s", result)
+	}
+	return nil
+}
+
+func (sqliteDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	return fmt.Errorf("point-in-time recovery is not supported for SQLite")
+}
+
+// CreateDatabase does nothing: a SQLite database is the file name names,
+// which the restore creates.
+func (sqliteDriver) CreateDatabase(conn Connection, name string) error {
+	return nil
+}
+
+// DropDatabase removes the database file name and the journal files
+// SQLite keeps next to it.
+func (sqliteDriver) DropDatabase(conn Connection, name string) error {
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		os.Remove(name + suffix)
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (sqliteDriver) QueryValue(conn Connection, query string) (string, error) {
+	db, err := openSQLite(conn.Database, true)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var value sql.NullString
+	if err := db.QueryRow(query).Scan(&value); err != nil {
+		return "", err
+	}
+	return value.String, nil
+}
+
+// TableRowCounts counts the rows of every table, SQLite's own tables
+// excluded.
+func (sqliteDriver) TableRowCounts(conn Connection) (map[string]int64, error) {
+	db, err := openSQLite(conn.Database, true)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var count int64
+		if err := tx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", quoteIdentifier(table, '"'))).Scan(&count); err != nil {
+			return nil, err
+		}
+		counts[table] = count
+	}
+	return counts, nil
+}
@@ -0,0 +1,42 @@
+//go:build !cgo
+
+package coreactions
+
+import (
+	"fmt"
+	"io"
+)
+
+// The SQLite driver uses the C library through cgo. Binaries built with
+// CGO_ENABLED=0 keep the engine names but refuse every operation.
+type sqliteDriver struct{}
+
+var errSQLiteUnavailable = fmt.Errorf("SQLite support is not available: dbutility was built without cgo")
+
+func init() {
+	Register(sqliteDriver{}, "sqlite", "sqlite3")
+}
+
+func (sqliteDriver) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func (sqliteDriver) Backup(conn Connection, out io.Writer) error {
+	return errSQLiteUnavailable
+}
+
+func (sqliteDriver) BackupTables(conn Connection, out io.Writer, tables []string) error {
+	return errSQLiteUnavailable
+}
+
+func (sqliteDriver) Restore(conn Connection, in io.Reader) error {
+	return errSQLiteUnavailable
+}
+
+func (sqliteDriver) RestoreTables(conn Connection, in io.Reader, tables []string) error {
+	return errSQLiteUnavailable
+}
+
+func (sqliteDriver) PointInTimeRestore(conn Connection, in io.Reader, target RecoveryTarget) error {
+	return errSQLiteUnavailable
+}
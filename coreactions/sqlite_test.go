@@ -0,0 +1,69 @@
+//go:build cgo
+
+package coreactions
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteTableBackupRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "app.db")
+	script := `CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);
+CREATE TABLE log (user_id INTEGER, note TEXT);
+CREATE TRIGGER users_log AFTER INSERT ON users BEGIN
+  INSERT INTO log VALUES (NEW.id, 'added; ok');
+  INSERT INTO log VALUES (NEW.id, 'end');
+END;
+INSERT INTO users (name) VALUES ('ada'), ('grace');
+`
+	if err := execSQLiteScript(source, bytes.NewReader([]byte(script))); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := sqliteDriver{}
+	counts, err := driver.TableRowCounts(Connection{Database: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["users"] != 2 || counts["log"] != 4 {
+		t.Fatalf("source counts %v", counts)
+	}
+
+	var backup bytes.Buffer
+	if err := driver.BackupTables(Connection{Database: source}, &backup, []string{"users", "log"}); err != nil {
+		t.Fatal(err)
+	}
+	restored := filepath.Join(dir, "dbutility_verify_test")
+	if err := driver.Restore(Connection{Database: restored}, &backup); err != nil {
+		t.Fatal(err)
+	}
+	counts, err = driver.TableRowCounts(Connection{Database: restored})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["users"] != 2 || counts["log"] != 4 {
+		t.Fatalf("restored counts %v", counts)
+	}
+
+	// The trigger was restored whole and still fires.
+	if err := execSQLiteScript(restored, bytes.NewReader([]byte("INSERT INTO users (name) VALUES ('linus');\n"))); err != nil {
+		t.Fatal(err)
+	}
+	value, err := driver.QueryValue(Connection{Database: restored}, "SELECT count(*) = 6 FROM log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isTrue(value) {
+		t.Fatalf("trigger did not fire: %q", value)
+	}
+
+	if err := driver.DropDatabase(Connection{}, restored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.TableRowCounts(Connection{Database: restored}); err == nil {
+		t.Fatal("scratch database still exists")
+	}
+}
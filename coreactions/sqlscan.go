@@ -0,0 +1,479 @@
+package coreactions
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// sqlStatement is a statement of a dump, or one line of the rows following
+// a COPY ... FROM stdin.
+type sqlStatement struct {
+	// Comments holds the blank lines and comments before the statement.
+	Comments []byte
+	// Text is the statement with its terminator and the rest of its line.
+	// It is empty for comments at the end of the dump.
+	Text []byte
+	// CopyData marks a line of COPY rows, including the closing \. line.
+	CopyData bool
+}
+
+// sqlDialect selects the syntax of the dump a sqlScanner reads.
+type sqlDialect int
+
+const (
+	// postgresDialect is pg_dump output as psql reads it: nested
+	// comments, E'' strings with backslash escapes, dollar quoting, psql
+	// meta-commands and COPY blocks.
+	postgresDialect sqlDialect = iota
+	// mysqlDialect is mysqldump output as the mysql client reads it:
+	// backslash escapes in every string, backquoted identifiers, # and
+	// "-- " comments, /*! */ comments holding statements, and DELIMITER.
+	mysqlDialect
+	// sqliteDialect is a .dump script as the sqlite3 shell reads it:
+	// strings without escapes, "", `` and [] quoted identifiers, and
+	// CREATE TRIGGER statements whose semicolons end at END;.
+	sqliteDialect
+)
+
+// sqlScanner splits a dump into statements as the database's client does,
+// without reading more than a statement into memory. The rows of COPY
+// blocks are returned a line at a time.
+type sqlScanner struct {
+	r         *bufio.Reader
+	dialect   sqlDialect
+	delimiter string
+	inCopy    bool
+}
+
+func newSQLScanner(r io.Reader, dialect sqlDialect) *sqlScanner {
+	return &sqlScanner{r: bufio.NewReaderSize(r, 64*1024), dialect: dialect, delimiter: ";"}
+}
+
+var copyFromStdin = regexp.MustCompile(`(?is)^COPY\s.*\sFROM\s+stdin\b`)
+
+// Next returns the next statement, or io.EOF after the last one.
+func (s *sqlScanner) Next() (*sqlStatement, error) {
+	if s.inCopy {
+		line, err := s.r.ReadBytes('\n')
+		if len(line) == 0 {
+			return nil, err
+		}
+		if string(bytes.TrimRight(line, "\r\n")) == `\.` {
+			s.inCopy = false
+		}
+		return &sqlStatement{Text: line, CopyData: true}, nil
+	}
+
+	st := &sqlStatement{}
+	if err := s.readComments(st); err != nil {
+		if err == io.EOF && len(st.Comments) > 0 {
+			return st, nil
+		}
+		return nil, err
+	}
+
+	first, _ := s.r.Peek(len("DELIMITER "))
+	var err error
+	switch {
+	case s.dialect == postgresDialect && first[0] == '\\':
+		// psql meta-commands end at the end of their line.
+		st.Text, err = s.r.ReadBytes('\n')
+	case s.dialect == mysqlDialect && strings.EqualFold(string(first), "DELIMITER "):
+		// So does DELIMITER, which sets what ends the statements after it.
+		st.Text, err = s.r.ReadBytes('\n')
+		if delimiter := strings.TrimSpace(string(st.Text[len(first):])); delimiter != "" {
+			s.delimiter = delimiter
+		}
+	default:
+		err = s.readStatement(st)
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if s.dialect == postgresDialect && copyFromStdin.Match(st.Text) {
+		s.inCopy = true
+	}
+	return st, nil
+}
+
+// readComments reads the whitespace and comments before a statement.
+func (s *sqlScanner) readComments(st *sqlStatement) error {
+	for {
+		next, err := s.r.Peek(4)
+		if len(next) == 0 {
+			return err
+		}
+		switch {
+		case isSpace(next[0]):
+			s.r.ReadByte()
+			st.Comments = append(st.Comments, next[0])
+		case s.lineComment(next):
+			line, err := s.r.ReadBytes('\n')
+			st.Comments = append(st.Comments, line...)
+			if err != nil {
+				return err
+			}
+		case s.dialect == mysqlDialect && (bytes.HasPrefix(next, []byte("/*!")) || bytes.HasPrefix(next, []byte("/*M!"))):
+			// /*! ... */ holds a statement for the servers it names.
+			return nil
+		case bytes.HasPrefix(next, []byte("/*")):
+			s.r.Discard(2)
+			st.Comments = append(st.Comments, "/*"...)
+			if err := s.readBlockComment(&st.Comments); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// readStatement reads a statement up to its delimiter and the whitespace
+// after it on the same line.
+func (s *sqlScanner) readStatement(st *sqlStatement) error {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == '\'':
+			escapes := s.dialect == mysqlDialect || s.dialect == postgresDialect && len(st.Text) > 0 && (st.Text[len(st.Text)-1] == 'E' || st.Text[len(st.Text)-1] == 'e') &&
+				(len(st.Text) == 1 || !isIdentByte(st.Text[len(st.Text)-2]))
+			st.Text = append(st.Text, c)
+			if err := s.readQuoted(&st.Text, c, escapes); err != nil {
+				return err
+			}
+		case c == '"':
+			st.Text = append(st.Text, c)
+			if err := s.readQuoted(&st.Text, c, s.dialect == mysqlDialect); err != nil {
+				return err
+			}
+		case c == '`' && (s.dialect == mysqlDialect || s.dialect == sqliteDialect):
+			st.Text = append(st.Text, c)
+			if err := s.readQuoted(&st.Text, c, false); err != nil {
+				return err
+			}
+		case c == '[' && s.dialect == sqliteDialect:
+			name, err := s.r.ReadBytes(']')
+			st.Text = append(append(st.Text, c), name...)
+			if err != nil {
+				return err
+			}
+		case c == '$' && s.dialect == postgresDialect:
+			follows := len(st.Text) > 0 && isIdentByte(st.Text[len(st.Text)-1])
+			st.Text = append(st.Text, c)
+			if !follows {
+				if err := s.readDollarQuoted(&st.Text); err != nil {
+					return err
+				}
+			}
+		case c == '#' && s.dialect == mysqlDialect:
+			line, err := s.r.ReadBytes('\n')
+			st.Text = append(append(st.Text, c), line...)
+			if err != nil {
+				return err
+			}
+		case c == '-':
+			if next, _ := s.r.Peek(2); s.lineComment(append([]byte{c}, next...)) {
+				line, err := s.r.ReadBytes('\n')
+				st.Text = append(append(st.Text, c), line...)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			st.Text = append(st.Text, c)
+		case c == '/':
+			next, _ := s.r.Peek(3)
+			switch {
+			case len(next) == 0 || next[0] != '*':
+				st.Text = append(st.Text, c)
+			case s.dialect == mysqlDialect && (bytes.HasPrefix(next, []byte("*!")) || bytes.HasPrefix(next, []byte("*M!"))):
+				// The statement inside a /*! comment is scanned as
+				// usual; its closing */ is plain text.
+				st.Text = append(st.Text, c)
+			default:
+				s.r.Discard(1)
+				st.Text = append(st.Text, "/*"...)
+				if err := s.readBlockComment(&st.Text); err != nil {
+					return err
+				}
+			}
+		default:
+			st.Text = append(st.Text, c)
+			if c == s.delimiter[len(s.delimiter)-1] && bytes.HasSuffix(st.Text, []byte(s.delimiter)) && !s.inTriggerBody(st.Text) {
+				return s.readLineEnd(st)
+			}
+		}
+	}
+}
+
+// inTriggerBody reports whether the semicolon ending text ends a
+// statement inside the BEGIN ... END of an SQLite CREATE TRIGGER rather
+// than the trigger. Like the sqlite3 shell, the first END followed by a
+// semicolon ends the trigger.
+func (s *sqlScanner) inTriggerBody(text []byte) bool {
+	if s.dialect != sqliteDialect {
+		return false
+	}
+	tokens := sqlTokens(text, 3)
+	if !hasKeywords(tokens, "CREATE", "TRIGGER") && !hasKeywords(tokens, "CREATE", "TEMP", "TRIGGER") && !hasKeywords(tokens, "CREATE", "TEMPORARY", "TRIGGER") {
+		return false
+	}
+	body := bytes.TrimRightFunc(text[:len(text)-1], func(r rune) bool { return r < 0x80 && isSpace(byte(r)) })
+	end := len(body) - len("END")
+	return end < 0 || !strings.EqualFold(string(body[end:]), "END") || end > 0 && isIdentByte(body[end-1])
+}
+
+// lineComment reports whether next starts a comment running to the end of
+// the line. MySQL needs a space after the two dashes.
+func (s *sqlScanner) lineComment(next []byte) bool {
+	if s.dialect == mysqlDialect {
+		return len(next) > 0 && next[0] == '#' ||
+			len(next) >= 2 && next[0] == '-' && next[1] == '-' && (len(next) == 2 || isSpace(next[2]))
+	}
+	return bytes.HasPrefix(next, []byte("--"))
+}
+
+// readLineEnd adds the spaces after a statement's terminator, and the
+// newline ending its line, to the statement.
+func (s *sqlScanner) readLineEnd(st *sqlStatement) error {
+	for {
+		next, err := s.r.Peek(1)
+		if len(next) == 0 {
+			return err
+		}
+		switch next[0] {
+		case ' ', '\t', '\r':
+			s.r.ReadByte()
+			st.Text = append(st.Text, next[0])
+		case '\n':
+			s.r.ReadByte()
+			st.Text = append(st.Text, '\n')
+			return nil
+		default:
+			return nil
+		}
+	}
+}
+
+// readQuoted reads the rest of a string or quoted identifier. A doubled
+// quote stands for itself, and escapes allows backslash escapes.
+func (s *sqlScanner) readQuoted(text *[]byte, quote byte, escapes bool) error {
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		*text = append(*text, c)
+		switch {
+		case c == '\\' && escapes:
+			c, err := s.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			*text = append(*text, c)
+		case c == quote:
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == quote {
+				s.r.ReadByte()
+				*text = append(*text, quote)
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+// readDollarQuoted reads a $tag$...$tag$ string after its first $. A $
+// not starting a tag, as in a $1 parameter, is left alone.
+func (s *sqlScanner) readDollarQuoted(text *[]byte) error {
+	tag := []byte{'$'}
+	for i := 0; ; i++ {
+		next, _ := s.r.Peek(i + 1)
+		if len(next) <= i {
+			return nil
+		}
+		c := next[i]
+		if c == '$' {
+			tag = append(tag, next[:i+1]...)
+			s.r.Discard(i + 1)
+			break
+		}
+		if !isIdentByte(c) || (i == 0 && c >= '0' && c <= '9') {
+			return nil
+		}
+	}
+	*text = append(*text, tag[1:]...)
+
+	start := len(*text)
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		*text = append(*text, c)
+		if c == '$' && len(*text)-start >= len(tag) && bytes.HasSuffix(*text, tag) {
+			return nil
+		}
+	}
+}
+
+// readBlockComment reads the rest of a /* comment */. PostgreSQL comments
+// may be nested.
+func (s *sqlScanner) readBlockComment(text *[]byte) error {
+	depth := 1
+	var prev byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		*text = append(*text, c)
+		switch {
+		case prev == '/' && c == '*' && s.dialect == postgresDialect:
+			depth++
+			c = 0
+		case prev == '*' && c == '/':
+			depth--
+			if depth == 0 {
+				return nil
+			}
+			c = 0
+		}
+		prev = c
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// sqlTokens splits the start of a statement into at most limit tokens:
+// words, quoted identifiers and strings, and single punctuation
+// characters. Comments and whitespace are skipped.
+func sqlTokens(text []byte, limit int) []string {
+	var tokens []string
+	for i := 0; i < len(text) && len(tokens) < limit; {
+		c := text[i]
+		switch {
+		case isSpace(c):
+			i++
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case bytes.HasPrefix(text[i:], []byte("/*!")), bytes.HasPrefix(text[i:], []byte("/*M!")):
+			// The statement inside a MySQL executable comment is read,
+			// without its version.
+			i += bytes.IndexByte(text[i:], '!') + 1
+			for i < len(text) && text[i] >= '0' && text[i] <= '9' {
+				i++
+			}
+		case c == '*' && i+1 < len(text) && text[i+1] == '/':
+			i += 2
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := bytes.Index(text[i+2:], []byte("*/"))
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '"' || c == '\'' || c == '`':
+			j := i + 1
+			for j < len(text) {
+				if text[j] == c {
+					if j+1 < len(text) && text[j+1] == c {
+						j += 2
+						continue
+					}
+					break
+				}
+				j++
+			}
+			tokens = append(tokens, string(text[i:min(j+1, len(text))]))
+			i = j + 1
+		case isIdentByte(c):
+			j := i
+			for j < len(text) && (isIdentByte(text[j]) || text[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, string(text[i:j]))
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+// qualifiedName reads a possibly qualified name from tokens at i. It
+// returns the name with its quotes removed, its parts joined by dots, and
+// the index of the token after it.
+func qualifiedName(tokens []string, i int) (string, int) {
+	var parts []string
+	for i < len(tokens) {
+		parts = append(parts, unquoteIdentifier(tokens[i]))
+		i++
+		if i+1 >= len(tokens) || tokens[i] != "." {
+			break
+		}
+		i++
+	}
+	return strings.Join(parts, "."), i
+}
+
+// unquoteIdentifier removes the quotes around an identifier.
+func unquoteIdentifier(token string) string {
+	if len(token) >= 2 && (token[0] == '"' || token[0] == '`') && token[len(token)-1] == token[0] {
+		quote := token[:1]
+		return strings.ReplaceAll(token[1:len(token)-1], quote+quote, quote)
+	}
+	return token
+}
+
+// hasKeywords reports whether tokens start with the given keywords,
+// ignoring case.
+func hasKeywords(tokens []string, keywords ...string) bool {
+	if len(tokens) < len(keywords) {
+		return false
+	}
+	for i, keyword := range keywords {
+		if !strings.EqualFold(tokens[i], keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipKeywords skips the optional keywords present at tokens[i:], in any
+// order, and returns the index of the first other token.
+func skipKeywords(tokens []string, i int, keywords ...string) int {
+	for i < len(tokens) {
+		switch {
+		case i+1 < len(tokens) && strings.EqualFold(tokens[i], "IF") && strings.EqualFold(tokens[i+1], "EXISTS") && containsFold(keywords, "IF EXISTS"):
+			i += 2
+		case containsFold(keywords, tokens[i]):
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
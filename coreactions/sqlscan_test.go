@@ -0,0 +1,163 @@
+package coreactions
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// scanned is a statement as returned by sqlScanner, without its comments.
+type scanned struct {
+	Text     string
+	CopyData bool
+}
+
+func scanAll(t *testing.T, dump string, dialect sqlDialect) []scanned {
+	t.Helper()
+	s := newSQLScanner(strings.NewReader(dump), dialect)
+	var statements []scanned
+	for {
+		st, err := s.Next()
+		if err == io.EOF {
+			return statements
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		statements = append(statements, scanned{Text: string(st.Text), CopyData: st.CopyData})
+	}
+}
+
+func TestSQLScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect sqlDialect
+		dump    string
+		want    []scanned
+	}{
+		{
+			name:    "COPY rows that look like statements",
+			dialect: postgresDialect,
+			dump: "COPY public.notes (id, body) FROM stdin;\n" +
+				"1\tDROP TABLE users;\n" +
+				"2\t-- not a comment\n" +
+				"3\t\\.x\n" +
+				"\\.\n" +
+				"SELECT 1;\n",
+			want: []scanned{
+				{Text: "COPY public.notes (id, body) FROM stdin;\n"},
+				{Text: "1\tDROP TABLE users;\n", CopyData: true},
+				{Text: "2\t-- not a comment\n", CopyData: true},
+				{Text: "3\t\\.x\n", CopyData: true},
+				{Text: "\\.\n", CopyData: true},
+				{Text: "SELECT 1;\n"},
+			},
+		},
+		{
+			name:    "E'' strings with backslash escapes",
+			dialect: postgresDialect,
+			dump:    "INSERT INTO t VALUES (E'it\\'s; done');\nSELECT 2;\n",
+			want: []scanned{
+				{Text: "INSERT INTO t VALUES (E'it\\'s; done');\n"},
+				{Text: "SELECT 2;\n"},
+			},
+		},
+		{
+			name:    "standard strings end at a backslash",
+			dialect: postgresDialect,
+			dump:    "INSERT INTO t VALUES ('C:\\');\nSELECT 'a''; b';\n",
+			want: []scanned{
+				{Text: "INSERT INTO t VALUES ('C:\\');\n"},
+				{Text: "SELECT 'a''; b';\n"},
+			},
+		},
+		{
+			name:    "dollar quoted function bodies",
+			dialect: postgresDialect,
+			dump: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\n" +
+				"CREATE FUNCTION g() RETURNS text AS $body$ SELECT '$$;'; $body$ LANGUAGE sql;\n" +
+				"PREPARE p AS SELECT $1;\n",
+			want: []scanned{
+				{Text: "CREATE FUNCTION f() RETURNS int AS $$ SELECT 1; $$ LANGUAGE sql;\n"},
+				{Text: "CREATE FUNCTION g() RETURNS text AS $body$ SELECT '$$;'; $body$ LANGUAGE sql;\n"},
+				{Text: "PREPARE p AS SELECT $1;\n"},
+			},
+		},
+		{
+			name:    "nested comments and psql meta-commands",
+			dialect: postgresDialect,
+			dump:    "\\connect mydb\nSELECT /* a /* b; */ c; */ 1;\n",
+			want: []scanned{
+				{Text: "\\connect mydb\n"},
+				{Text: "SELECT /* a /* b; */ c; */ 1;\n"},
+			},
+		},
+		{
+			name:    "triggers between DELIMITER lines",
+			dialect: mysqlDialect,
+			dump: "DELIMITER ;;\n" +
+				"/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER `audit` BEFORE INSERT ON `users` FOR EACH ROW BEGIN SET NEW.created = NOW(); INSERT INTO `log` VALUES (1); END */;;\n" +
+				"DELIMITER ;\n" +
+				"SELECT 1;\n",
+			want: []scanned{
+				{Text: "DELIMITER ;;\n"},
+				{Text: "/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`%`*/ /*!50003 TRIGGER `audit` BEFORE INSERT ON `users` FOR EACH ROW BEGIN SET NEW.created = NOW(); INSERT INTO `log` VALUES (1); END */;;\n"},
+				{Text: "DELIMITER ;\n"},
+				{Text: "SELECT 1;\n"},
+			},
+		},
+		{
+			name:    "MySQL strings, identifiers and comments",
+			dialect: mysqlDialect,
+			dump: "INSERT INTO `a;b` VALUES ('it\\'s; done',\"x;\");\n" +
+				"# a comment;\n" +
+				"SELECT 1--1;\n",
+			want: []scanned{
+				{Text: "INSERT INTO `a;b` VALUES ('it\\'s; done',\"x;\");\n"},
+				{Text: "SELECT 1--1;\n"},
+			},
+		},
+		{
+			name:    "SQLite triggers, strings and identifiers",
+			dialect: sqliteDialect,
+			dump: "CREATE TRIGGER [audit;log] AFTER INSERT ON users BEGIN\n" +
+				"  INSERT INTO log VALUES ('C:\\', `a;b`);\n" +
+				"  UPDATE stats SET n = n + 1 WHERE kind = backend;\n" +
+				"END;\n" +
+				"CREATE TEMP TRIGGER t2 AFTER DELETE ON users BEGIN DELETE FROM log; end ;\n" +
+				"INSERT INTO users VALUES ('x''; y');\n",
+			want: []scanned{
+				{Text: "CREATE TRIGGER [audit;log] AFTER INSERT ON users BEGIN\n" +
+					"  INSERT INTO log VALUES ('C:\\', `a;b`);\n" +
+					"  UPDATE stats SET n = n + 1 WHERE kind = backend;\n" +
+					"END;\n"},
+				{Text: "CREATE TEMP TRIGGER t2 AFTER DELETE ON users BEGIN DELETE FROM log; end ;\n"},
+				{Text: "INSERT INTO users VALUES ('x''; y');\n"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scanAll(t, tt.dump, tt.dialect); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scanned\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSQLTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"CREATE TABLE public.users (", []string{"CREATE", "TABLE", "public", ".", "users", "("}},
+		{`DROP TABLE IF EXISTS "My Table";`, []string{"DROP", "TABLE", "IF", "EXISTS", `"My Table"`, ";"}},
+		{"/*!40000 ALTER TABLE `users` DISABLE KEYS */;", []string{"ALTER", "TABLE", "`users`", "DISABLE", "KEYS", ";"}},
+	}
+	for _, tt := range tests {
+		if got := sqlTokens([]byte(tt.text), 16); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sqlTokens(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package coreactions
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// RecordRowCounts makes backups count the rows of every table and store the
+// counts in the manifest for the verify action. Counting reads every table,
+// so it is off by default; main sets it from --record-row-counts.
+var RecordRowCounts bool
+
+// VerifyBackup test-restores a backup into a scratch database that is
+// created and dropped by the tool. dbName is the database the scratch
+// database is created from and is not modified. The restored database is
+// checked against the manifest (tables present, row counts equal) and every
+// assertion must select a true value. All failed checks are reported
+// together in the returned error.
+func VerifyBackup(dbType, host string, port int, username, password, dbName, inputFile string, assertions []string) error {
+	logger.Info(fmt.Sprintf("Starting verification of backup %s", inputFile))
+
+	manifest, err := loadManifest(inputFile)
+	if err != nil {
+		return err
+	}
+	driver, err := restoreDriver(dbType, manifest)
+	if err != nil {
+		return err
+	}
+	if dbType == "" {
+		dbType = manifest.Engine
+	}
+
+	verifier, ok := driver.(Verifier)
+	if !ok {
+		err := fmt.Errorf("backup verification is not supported for database type: %s", dbType)
+		logger.Error(err.Error())
+		return err
+	}
+
+	admin := Connection{Host: host, Port: port, Username: username, Password: password, Database: dbName}
+	scratch := admin
+	scratch.Database = fmt.Sprintf("dbutility_verify_%s", time.Now().Format("20060102_150405"))
+	scratch.Scratch = true
+
+	if err := verifier.CreateDatabase(admin, scratch.Database); err != nil {
+		logger.Error(fmt.Sprintf("Failed to create scratch database %s: %v", scratch.Database, err))
+		return err
+	}
+	defer func() {
+		if err := verifier.DropDatabase(admin, scratch.Database); err != nil {
+			logger.Error(fmt.Sprintf("Failed to drop scratch database %s: %v", scratch.Database, err))
+		}
+	}()
+
+	if err := restoreDatabase(dbType, scratch, inputFile); err != nil {
+		return fmt.Errorf("test restore failed: %w", err)
+	}
+
+	var failures []string
+
+	counts, err := verifier.TableRowCounts(scratch)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to count rows in scratch database: %v", err))
+		return err
+	}
+	failures = append(failures, checkTables(manifest, counts)...)
+
+	for _, assertion := range assertions {
+		value, err := verifier.QueryValue(scratch, assertion)
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("assertion %q failed: %v", assertion, err))
+		case !isTrue(value):
+			failures = append(failures, fmt.Sprintf("assertion %q returned %q", assertion, value))
+		}
+	}
+
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			logger.Error("Verification check failed:", failure)
+		}
+		return fmt.Errorf("backup %s failed verification: %s", inputFile, strings.Join(failures, "; "))
+	}
+
+	logger.Info(fmt.Sprintf("Backup %s verified successfully (%d tables)", inputFile, len(counts)))
+	return nil
+}
+
+// loadManifest reads the manifest of the backup at inputFile, if any.
+func loadManifest(inputFile string) (*Manifest, error) {
+	st, key, err := store.Open(inputFile)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+	manifest, err := readManifest(st, key)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read backup manifest: %v", err))
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// checkTables compares the restored tables with the manifest. Without a
+// manifest the only requirement is that something was restored.
+func checkTables(manifest *Manifest, counts map[string]int64) []string {
+	if manifest == nil {
+		if len(counts) == 0 {
+			return []string{"no tables were restored"}
+		}
+		return nil
+	}
+
+	var failures []string
+	for _, table := range manifest.Tables {
+		if _, ok := findTable(counts, table); !ok {
+			failures = append(failures, fmt.Sprintf("table %s is missing", table))
+		}
+	}
+	if len(manifest.Tables) == 0 && len(counts) == 0 {
+		failures = append(failures, "no tables were restored")
+	}
+
+	for table, expected := range manifest.RowCounts {
+		actual, ok := findTable(counts, table)
+		switch {
+		case !ok:
+			failures = append(failures, fmt.Sprintf("table %s is missing", table))
+		case actual != expected:
+			failures = append(failures, fmt.Sprintf("table %s has %d rows, expected %d", table, actual, expected))
+		}
+	}
+	return failures
+}
+
+// findTable looks a table up by its full name or, for names given without a
+// schema, by its unqualified name.
+func findTable(counts map[string]int64, table string) (int64, bool) {
+	if count, ok := counts[table]; ok {
+		return count, true
+	}
+	for name, count := range counts {
+		if _, unqualified, found := strings.Cut(name, "."); found && unqualified == table {
+			return count, true
+		}
+	}
+	return 0, false
+}
+
+// filterRowCounts keeps the counts of the given tables only.
+func filterRowCounts(counts map[string]int64, tables []string) map[string]int64 {
+	filtered := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		if count, ok := findTable(counts, table); ok {
+			filtered[table] = count
+		}
+	}
+	return filtered
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "t", "true", "1", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// parseRowCounts parses "name<TAB>count" lines.
+func parseRowCounts(out string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for _, line := range splitLines(out) {
+		name, countStr, found := strings.Cut(line, "\t")
+		if !found {
+			return nil, errors.New("unexpected row count output: " + line)
+		}
+		count, err := strconv.ParseInt(strings.TrimSpace(countStr), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected row count for %s: %w", name, err)
+		}
+		counts[name] = count
+	}
+	return counts, nil
+}
+
+// splitLines splits command output into its non-empty lines.
+func splitLines(out string) []string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// quoteIdentifier quotes an identifier with the engine's quote character.
+func quoteIdentifier(name string, quote rune) string {
+	q := string(quote)
+	return q + strings.ReplaceAll(name, q, q+q) + q
+}
+
+// quoteLiteral quotes a string literal.
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
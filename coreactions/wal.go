@@ -0,0 +1,144 @@
+package coreactions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
+)
+
+// PushWALSegment archives a completed WAL segment, or a history or backup
+// label file, into Recovery.WALArchive with the configured compression and
+// encryption. It is meant to be the PostgreSQL archive_command with %p as
+// walPath. Pushing a file that is already archived with the same content
+// succeeds, as PostgreSQL may retry after a crash; different content is
+// refused so an archive shared by two servers is never overwritten.
+func PushWALSegment(walPath string) error {
+	st, prefix, err := openWALArchive()
+	if err != nil {
+		return err
+	}
+	if err := BackupEncryption.Validate(); err != nil {
+		return err
+	}
+
+	name := filepath.Base(walPath)
+	if key, err := findArchived(st, prefix, name); err == nil {
+		same, err := sameContent(st, key, walPath)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to compare WAL file %s with the archive: %v", name, err))
+			return err
+		}
+		if !same {
+			err := fmt.Errorf("WAL file %s is already archived at %s with different content", name, st.URI(key))
+			logger.Error(err.Error())
+			return err
+		}
+		logger.Warning(fmt.Sprintf("WAL file %s is already archived at %s", name, st.URI(key)))
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		logger.Error(fmt.Sprintf("Failed to check the WAL archive: %v", err))
+		return err
+	}
+
+	key, err := uploadArchiveFile(st, prefix, walPath)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to archive WAL file %s: %v", name, err))
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Archived WAL file %s to %s", name, st.URI(key)))
+	return nil
+}
+
+// FetchWALSegment restores the archived WAL file name into target. It is
+// meant to be the PostgreSQL restore_command with %f as name and %p as
+// target. A file missing from the archive returns an error wrapping
+// os.ErrNotExist; PostgreSQL asks for files that may not exist, such as
+// the next timeline history, so that is not logged as a failure.
+func FetchWALSegment(name, target string) error {
+	st, prefix, err := openWALArchive()
+	if err != nil {
+		return err
+	}
+
+	key, err := findArchived(st, prefix, name)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Info(fmt.Sprintf("WAL file %s is not in the archive", name))
+		return err
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to check the WAL archive: %v", err))
+		return err
+	}
+
+	if err := decodeObject(st, key, target); err != nil {
+		os.Remove(target)
+		logger.Error(fmt.Sprintf("Failed to fetch WAL file %s: %v", name, err))
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Fetched WAL file %s from %s", name, st.URI(key)))
+	return nil
+}
+
+func openWALArchive() (store.Store, string, error) {
+	if Recovery.WALArchive == "" {
+		err := fmt.Errorf("no WAL archive configured: set --wal-archive")
+		logger.Error(err.Error())
+		return nil, "", err
+	}
+	st, prefix, err := store.Open(Recovery.WALArchive)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, "", err
+	}
+	return st, prefix, nil
+}
+
+// findArchived returns the key name was archived under, whatever the
+// compression and encryption used at the time.
+func findArchived(st store.Store, prefix, name string) (string, error) {
+	for _, compression := range []string{"", ".gz", ".zst", ".lz4"} {
+		for _, encryption := range []string{"", ".enc"} {
+			key := archiveKey(prefix, name+compression+encryption)
+			_, err := st.Stat(key)
+			if err == nil {
+				return key, nil
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+	return "", fmt.Errorf("%s: %w", name, os.ErrNotExist)
+}
+
+// sameContent reports whether the archived key holds the same bytes as the
+// local file.
+func sameContent(st store.Store, key, filePath string) (bool, error) {
+	archived, err := openArchived(st, key)
+	if err != nil {
+		return false, err
+	}
+	defer archived.Close()
+	local, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer local.Close()
+
+	archivedHash, localHash := sha256.New(), sha256.New()
+	if _, err := io.Copy(archivedHash, archived); err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(localHash, local); err != nil {
+		return false, err
+	}
+	return bytes.Equal(archivedHash.Sum(nil), localHash.Sum(nil)), nil
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"yohan/databaseutilities/coreactions"
 	"yohan/databaseutilities/logger"
+	"yohan/databaseutilities/store"
 	"yohan/databaseutilities/webapplication"
 
 	"github.com/joho/godotenv"
@@ -29,6 +31,9 @@ var DateToRestore string // Restore databse till date
 var DatabaseRestoreInputFile string
 var DatabaseRestoreOutputFile string
 var BackupSchedule string
+var BackupCompression string
+var VerifyAssertions []string
+var PreviousBackup string
 
 func init() {
 
@@ -46,9 +51,44 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&DatabaseRestoreOutputFile, "outputfile", "y", DatabaseRestoreOutputFile, "To Define the output file for restore database")
 	rootCmd.PersistentFlags().StringVarP(&BackupSchedule, "schedule", "s", "", "Cron schedule for automatic backups (e.g., '0 0 * * *')")
 
+	rootCmd.PersistentFlags().StringVarP(&BackupCompression, "compress", "c", "none", "Compression for new backups: none, gzip, zstd or lz4, optionally with a level (e.g., 'zstd:19')")
+	rootCmd.PersistentFlags().StringVar(&coreactions.DumpEngine, "engine", "", "How logical backups are taken: tool (default) runs the database's dump tool, native uses the dumper built into dbutility (PostgreSQL and MySQL)")
+	rootCmd.PersistentFlags().StringVar(&coreactions.BackupMode, "mode", coreactions.ModeFull, "Backup mode: full, or incremental or differential to back up the MySQL binlog since --previous")
+	rootCmd.PersistentFlags().StringVar(&PreviousBackup, "previous", "", "Backup an incremental or differential backup follows; differential backups follow the full backup of its chain")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Postgres.Format, "format", coreactions.PostgresPlain, "PostgreSQL dump format: plain, custom, directory or tar; restores detect the format of the backup")
+	rootCmd.PersistentFlags().IntVar(&coreactions.Postgres.Jobs, "jobs", 1, "Parallel jobs for PostgreSQL directory dumps and custom or directory restores")
+	rootCmd.PersistentFlags().BoolVar(&coreactions.AllowInconsistent, "allow-inconsistent", false, "Let a parallel MySQL backup go on when FLUSH TABLES WITH READ LOCK is denied, reading its tables at different points in time")
+	rootCmd.PersistentFlags().IntVar(&coreactions.Parallel, "parallel", 1, "Tables backed up at once from one snapshot (PostgreSQL and MySQL), above 1 written as a backup set directory; also the tables restored at once from a backup set")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Recovery.DataDirectory, "datadir", "", "PostgreSQL data directory to restore a base backup into for point-in-time recovery")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Recovery.WALArchive, "wal-archive", "", "Location of the PostgreSQL WAL archive (e.g., 's3://bucket/wal/' or '/var/lib/pgarchive')")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Recovery.BinlogArchive, "binlog-archive", "", "Location of the MySQL binary logs to replay for point-in-time recovery (e.g., '/var/lib/mysql' or 's3://bucket/binlogs/')")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Recovery.StopPosition, "stop-position", "", "Binlog position to stop a MySQL point-in-time restore at (e.g., 'mysql-bin.000042:1337')")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Recovery.StopGTIDs, "stop-gtids", "", "GTID set a MySQL point-in-time restore replays up to (e.g., '3E11FA47-71CA-11E1-9E33-C80AA9429562:1-77')")
+	rootCmd.PersistentFlags().StringVar(&coreactions.Recovery.BinlogSpool, "binlog-spool", filepath.Join(os.TempDir(), "dbutility-binlogs"), "Local directory binlogs are streamed into before being archived")
+	rootCmd.PersistentFlags().IntVar(&coreactions.Recovery.BinlogServerID, "binlog-server-id", 4271, "Replica server id used to stream binlogs, must be unique among the server's replicas")
+	rootCmd.PersistentFlags().StringVar(&coreactions.MSSQL.BackupDirectory, "mssql-backup-dir", "", "SQL Server staging directory for BACKUP and RESTORE files, as seen by the server (e.g., '/var/opt/mssql/backup')")
+	rootCmd.PersistentFlags().StringVar(&coreactions.MSSQL.LocalDirectory, "mssql-local-dir", "", "The SQL Server staging directory as seen by this tool (defaults to --mssql-backup-dir)")
+	rootCmd.PersistentFlags().StringVar(&coreactions.MSSQL.BackupType, "mssql-backup-type", coreactions.MSSQLFull, "SQL Server backup type: full, differential or log")
+	rootCmd.PersistentFlags().BoolVar(&coreactions.MSSQL.NoRecovery, "mssql-no-recovery", false, "Leave a restored SQL Server database restoring so further differential or log backups can be applied")
+	rootCmd.PersistentFlags().StringVar(&coreactions.RedisRDBName, "redis-rdb-name", coreactions.RedisRDBName, "File name a Redis restore stages the snapshot as in --datadir, the instance's dbfilename")
+	rootCmd.PersistentFlags().StringArrayVar(&VerifyAssertions, "assert", nil, "SQL query that must return true after a verify test restore (repeatable)")
+	rootCmd.PersistentFlags().BoolVar(&coreactions.RecordRowCounts, "record-row-counts", false, "Count the rows of every table during backup and store them in the manifest for verify")
+	rootCmd.PersistentFlags().StringVar(&coreactions.BackupEncryption.KeyFile, "encryption-key-file", "", "File holding a 256-bit AES key (raw, hex or base64) to encrypt and decrypt backups")
+	rootCmd.PersistentFlags().StringVar(&coreactions.BackupEncryption.Passphrase, "encryption-passphrase", os.Getenv("BACKUP_ENCRYPTION_PASSPHRASE"), "Passphrase to encrypt and decrypt backups (defaults to $BACKUP_ENCRYPTION_PASSPHRASE)")
+	rootCmd.PersistentFlags().StringSliceVar(&coreactions.BackupEncryption.Recipients, "age-recipient", nil, "age X25519 public key to encrypt backups to (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&coreactions.BackupEncryption.AgeIdentityFile, "age-identity", "", "age identity file used to decrypt backups during restore")
+	rootCmd.PersistentFlags().BoolVar(&coreactions.AllowPlaintextTemp, "allow-plaintext-temp", false, "Let encrypted backups and restores that can only work on files write the plaintext to a temporary file")
+	rootCmd.PersistentFlags().StringVar(&store.S3Settings.Endpoint, "s3-endpoint", store.S3Settings.Endpoint, "S3-compatible endpoint for s3:// files (e.g., 'http://localhost:9000' for MinIO)")
+	rootCmd.PersistentFlags().StringVar(&store.S3Settings.Region, "s3-region", store.S3Settings.Region, "Region of the S3 bucket")
+	rootCmd.PersistentFlags().StringVar(&store.S3Settings.Prefix, "s3-prefix", store.S3Settings.Prefix, "Key prefix applied to every s3:// object")
+	rootCmd.PersistentFlags().BoolVar(&store.S3Settings.PathStyle, "s3-path-style", store.S3Settings.PathStyle, "Use path-style addressing for the S3 bucket")
+	rootCmd.PersistentFlags().StringVar(&store.VultrSettings.Region, "vultr-region", store.VultrSettings.Region, "Vultr Object Storage region (e.g., 'ewr1', 'sjc1', 'ams1') or hostname for vultr:// files")
+	rootCmd.PersistentFlags().StringVar(&store.VultrSettings.Prefix, "vultr-prefix", store.VultrSettings.Prefix, "Key prefix applied to every vultr:// object")
+
 	rootCmd.PersistentFlags().BoolP("help", "h", false, "Help for this command")
 
 	rootCmd.MarkFlagRequired("applicationtype")
+	rootCmd.AddCommand(walPushCmd, walFetchCmd)
 }
 
 func scheduleBackup(cronExpr string) {
@@ -76,10 +116,54 @@ func scheduleBackup(cronExpr string) {
 	select {}
 }
 
+// recordVerification stores the outcome of a verify run in the
+// backup_restore_logs table when DATABASE_URL is configured.
+func recordVerification(inputFile string, verifyErr error) {
+	godotenv.Load(".env")
+	connStr := os.Getenv("DATABASE_URL")
+	if connStr == "" {
+		logger.Warning("DATABASE_URL is not set, verification result not recorded in backup_restore_logs")
+		return
+	}
+
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to connect to the log database: %v", err))
+		return
+	}
+	defer db.Close()
+	webapplication.DB = db
+
+	status := "Passed"
+	if verifyErr != nil {
+		status = "Failed"
+	}
+	webapplication.LogBackupRestore("verify", inputFile, "", status)
+}
+
 var rootCmd = &cobra.Command{
 	Use:   filepath.Base(os.Args[0]),
 	Short: "Backup and Restore the database",
 	Long:  "Backup and Restore the database",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		compression, err := coreactions.ParseCompression(BackupCompression)
+		if err != nil {
+			log.Fatalf("Invalid --compress value: %v", err)
+		}
+		coreactions.BackupCompression = compression
+		if err := coreactions.BackupEncryption.Validate(); err != nil {
+			log.Fatalf("Invalid encryption settings: %v", err)
+		}
+		if coreactions.Postgres.Jobs < 1 {
+			log.Fatalf("Invalid --jobs value %d: must be at least 1", coreactions.Postgres.Jobs)
+		}
+		if coreactions.Parallel < 1 {
+			log.Fatalf("Invalid --parallel value %d: must be at least 1", coreactions.Parallel)
+		}
+		if coreactions.DumpEngine != "" && coreactions.DumpEngine != coreactions.EngineTool && coreactions.DumpEngine != coreactions.EngineNative {
+			log.Fatalf("Invalid --engine value %q: use tool or native", coreactions.DumpEngine)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		switch ApplicationType {
 		case "application":
@@ -102,6 +186,8 @@ var rootCmd = &cobra.Command{
 				logger.Info("Scheduling automatic backups...")
 				scheduleBackup(BackupSchedule)
 				select {} // Keep the application running to allow cron jobs to execute
+			} else if ActionType == "backup" && coreactions.BackupMode != coreactions.ModeFull {
+				coreactions.IncrementalBackupDatabase(DatabaseType, DatabaseHost, DatabasePort, DatabaseUsername, DatabasePassword, DatabaseName, DatabaseRestoreOutputFile, PreviousBackup, coreactions.BackupMode)
 			} else if ActionType == "backup" && len(ListOfTables) == 0 {
 				coreactions.BackupDatabase(DatabaseType, DatabaseHost, DatabasePort, DatabaseUsername, DatabasePassword, DatabaseName, DatabaseRestoreOutputFile)
 			} else if ActionType == "restore" && len(ListOfTables) == 0 {
@@ -113,12 +199,60 @@ var rootCmd = &cobra.Command{
 			} else if ActionType == "pittest" {
 				// Point in time restore
 				coreactions.RestoreDatabaseOfSpecificDate(DatabaseType, DatabaseHost, DatabasePort, DatabaseUsername, DatabasePassword, DatabaseName, DatabaseRestoreInputFile, DateToRestore)
+			} else if ActionType == "basebackup" {
+				coreactions.BaseBackupDatabase(DatabaseType, DatabaseHost, DatabasePort, DatabaseUsername, DatabasePassword, DatabaseName, DatabaseRestoreOutputFile)
+			} else if ActionType == "wal-archive" {
+				// Older form of wal-push, kept for existing archive_command settings
+				logger.Warning("-e wal-archive is deprecated, use: dbutility wal-push <path>")
+				walPushCmd.Run(walPushCmd, []string{DatabaseRestoreInputFile})
+			} else if ActionType == "binlog-archive" {
+				// Runs until interrupted
+				if err := coreactions.ArchiveBinlogs(DatabaseType, DatabaseHost, DatabasePort, DatabaseUsername, DatabasePassword); err != nil {
+					log.Fatalf("Failed to archive binlogs: %v", err)
+				}
+			} else if ActionType == "verify" {
+				err := coreactions.VerifyBackup(DatabaseType, DatabaseHost, DatabasePort, DatabaseUsername, DatabasePassword, DatabaseName, DatabaseRestoreInputFile, VerifyAssertions)
+				recordVerification(DatabaseRestoreInputFile, err)
+				if err != nil {
+					log.Fatalf("Backup verification failed: %v", err)
+				}
 			}
 			logger.Info("Database operation completed successfully")
 		}
 	},
 }
 
+// walPushCmd is meant to be the PostgreSQL archive_command:
+// dbutility wal-push %p --wal-archive s3://bucket/wal/
+var walPushCmd = &cobra.Command{
+	Use:   "wal-push <path>",
+	Short: "Archive a WAL file, for use as the PostgreSQL archive_command",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := coreactions.PushWALSegment(args[0]); err != nil {
+			log.Fatalf("Failed to archive WAL file: %v", err)
+		}
+	},
+}
+
+// walFetchCmd is meant to be the PostgreSQL restore_command:
+// dbutility wal-fetch %f %p --wal-archive s3://bucket/wal/
+var walFetchCmd = &cobra.Command{
+	Use:   "wal-fetch <name> <destination>",
+	Short: "Restore an archived WAL file, for use as the PostgreSQL restore_command",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := coreactions.FetchWALSegment(args[0], args[1])
+		if errors.Is(err, os.ErrNotExist) {
+			// PostgreSQL treats this as the end of the archive
+			os.Exit(1)
+		}
+		if err != nil {
+			log.Fatalf("Failed to fetch WAL file: %v", err)
+		}
+	},
+}
+
 func main() {
 	logger.Init()
 	logger.Info("Database Utility Starts")
@@ -1 +1,261 @@
 package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	s3Scheme = "s3"
+
+	// Part size used for streaming uploads of unknown length. With the S3
+	// limit of 10,000 parts this allows backups of up to 640 GB.
+	s3PartSize = 64 * 1024 * 1024
+)
+
+// S3Config describes how to reach an S3-compatible bucket. Endpoint is only
+// needed for non-AWS services such as MinIO; PathStyle forces
+// http://endpoint/bucket/key addressing which most S3 stand-ins expect.
+type S3Config struct {
+	Endpoint     string
+	Region       string
+	Prefix       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool
+	Insecure     bool
+}
+
+// S3Settings is the configuration used for s3:// URIs. main fills it from
+// the environment and the command-line flags.
+var S3Settings = S3ConfigFromEnv()
+
+// S3ConfigFromEnv reads the standard AWS environment variables plus
+// S3_ENDPOINT, S3_PREFIX, S3_PATH_STYLE and S3_INSECURE.
+func S3ConfigFromEnv() S3Config {
+	pathStyle, _ := strconv.ParseBool(os.Getenv("S3_PATH_STYLE"))
+	insecure, _ := strconv.ParseBool(os.Getenv("S3_INSECURE"))
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return S3Config{
+		Endpoint:     os.Getenv("S3_ENDPOINT"),
+		Region:       region,
+		Prefix:       os.Getenv("S3_PREFIX"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:    pathStyle,
+		Insecure:     insecure,
+	}
+}
+
+var _ Store = (*S3)(nil)
+
+// S3 stores backups in a single S3-compatible bucket.
+type S3 struct {
+	client *minio.Client
+	scheme string
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the given bucket. Nothing is sent over the network until
+// the first upload or download.
+func NewS3(bucket string, cfg S3Config) (*S3, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 bucket name is empty")
+	}
+
+	endpoint := cfg.Endpoint
+	secure := !cfg.Insecure
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+		if cfg.Region != "" {
+			endpoint = fmt.Sprintf("s3.%s.amazonaws.com", cfg.Region)
+		}
+	} else if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		// Accept endpoints written as URLs, e.g. http://localhost:9000
+		endpoint = u.Host
+		secure = u.Scheme == "https"
+	}
+
+	creds := credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken)
+	if cfg.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	return &S3{client: client, scheme: s3Scheme, bucket: bucket, prefix: strings.Trim(cfg.Prefix, "/")}, nil
+}
+
+// URI returns the scheme://bucket/key form of key. The configured prefix is
+// left out, as Open applies it again when the URI is opened.
+func (s *S3) URI(key string) string {
+	return fmt.Sprintf("%s://%s/%s", s.scheme, s.bucket, strings.TrimPrefix(key, "/"))
+}
+
+// objectName applies the configured prefix to key.
+func (s *S3) objectName(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+// Put streams everything written to the returned writer into the object at
+// key. Close waits for the upload to finish and returns its error; Abort
+// cancels it so no partial object is left behind.
+func (s *S3) Put(key string) (Writer, error) {
+	name := s.objectName(key)
+	pr, pw := io.Pipe()
+	w := &objectWriter{pipe: pw, done: make(chan error, 1)}
+
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, name, pr, -1, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			PartSize:    s3PartSize,
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to upload %s: %w", s.URI(key), err)
+		}
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+// Get opens the object at key for reading.
+func (s *S3) Get(key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", s.URI(key), err)
+	}
+
+	// GetObject is lazy, so stat the object to surface a missing key now
+	// rather than on the first read.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s.statError(key, err)
+	}
+	return obj, nil
+}
+
+// Stat describes the object at key.
+func (s *S3) Stat(key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.objectName(key), minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s.statError(key, err)
+	}
+	return ObjectInfo{Key: key, Size: info.Size, LastModified: info.LastModified}, nil
+}
+
+// statError maps a missing object to os.ErrNotExist so callers can treat
+// every store alike.
+func (s *S3) statError(key string, err error) error {
+	if code := minio.ToErrorResponse(err).Code; code == "NoSuchKey" || code == "NotFound" {
+		return fmt.Errorf("%s: %w", s.URI(key), os.ErrNotExist)
+	}
+	return fmt.Errorf("failed to stat %s: %w", s.URI(key), err)
+}
+
+// List returns the objects whose key starts with prefix. Keys are returned
+// relative to the configured bucket prefix.
+func (s *S3) List(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	opts := minio.ListObjectsOptions{Prefix: s.objectName(prefix), Recursive: true}
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, opts) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", s.URI(prefix), obj.Err)
+		}
+		key := obj.Key
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: obj.Size, LastModified: obj.LastModified})
+	}
+	return objects, nil
+}
+
+// Delete removes the object at key.
+func (s *S3) Delete(key string) error {
+	if err := s.client.RemoveObject(context.Background(), s.bucket, s.objectName(key), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", s.URI(key), err)
+	}
+	return nil
+}
+
+// objectWriter is the write side of a streaming upload.
+type objectWriter struct {
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+// Close finishes the upload and reports whether it succeeded.
+func (w *objectWriter) Close() error {
+	w.pipe.Close()
+	return <-w.done
+}
+
+// Abort cancels the upload.
+func (w *objectWriter) Abort() {
+	w.pipe.CloseWithError(fmt.Errorf("upload aborted"))
+	<-w.done
+}
+
+// IsS3URI reports whether location is an s3:// URI.
+func IsS3URI(location string) bool {
+	return strings.HasPrefix(location, s3Scheme+"://")
+}
+
+// ParseS3URI splits s3://bucket/key into its bucket and key.
+func ParseS3URI(uri string) (bucket, key string, err error) {
+	return parseBucketURI(s3Scheme, uri)
+}
+
+// parseBucketURI splits scheme://bucket/key into its bucket and key.
+func parseBucketURI(scheme, uri string) (bucket, key string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid %s uri %q: %w", scheme, uri, err)
+	}
+	if u.Scheme != scheme || u.Host == "" {
+		return "", "", fmt.Errorf("invalid %s uri %q: expected %s://bucket/key", scheme, uri, scheme)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
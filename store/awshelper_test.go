@@ -0,0 +1,292 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for an S3 bucket, implementing the
+// requests the S3 store sends with path-style addressing.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	f := &fakeS3{objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string
+			UploadId string
+		}{Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		body, err := readPayload(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		part, _ := strconv.Atoi(query.Get("partNumber"))
+		f.uploads[query.Get("uploadId")][part] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, part))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := f.uploads[query.Get("uploadId")]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, parts[n]...)
+		}
+		f.objects[key] = object
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"object"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		http.ServeContent(w, r, key, time.Unix(1700000000, 0), bytes.NewReader(object))
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+		ETag         string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Prefix: prefix}
+	for key, object := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: len(object), LastModified: "2023-11-14T22:13:20.000Z", ETag: `"object"`})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+// readPayload returns the body of an upload, decoding the aws-chunked
+// encoding used for streaming signatures over plain HTTP.
+func readPayload(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	var body []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk header %q", header)
+		}
+		if size == 0 {
+			return body, nil
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		body = append(body, chunk[:size]...)
+	}
+}
+
+func newTestS3(t *testing.T, prefix string) S3Config {
+	return S3Config{
+		Endpoint:  newFakeS3(t).URL,
+		Region:    "us-east-1",
+		Prefix:    prefix,
+		AccessKey: "test",
+		SecretKey: "testsecret",
+		PathStyle: true,
+	}
+}
+
+func put(t *testing.T, st Store, key, data string) {
+	t.Helper()
+	w, err := st.Put(key)
+	if err != nil {
+		t.Fatalf("Put(%q): %v", key, err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("writing %q: %v", key, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing %q: %v", key, err)
+	}
+}
+
+func get(t *testing.T, st Store, key string) string {
+	t.Helper()
+	r, err := st.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %q: %v", key, err)
+	}
+	return string(data)
+}
+
+func TestS3Store(t *testing.T) {
+	for _, prefix := range []string{"", "team/backups"} {
+		t.Run("prefix="+prefix, func(t *testing.T) {
+			st, err := NewS3("bucket", newTestS3(t, prefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			put(t, st, "mydb/full.sql", "CREATE TABLE users (id int);\n")
+			put(t, st, "mydb/full.sql.manifest.json", "{}")
+			put(t, st, "other/full.sql", "SELECT 1;\n")
+
+			if got := get(t, st, "mydb/full.sql"); got != "CREATE TABLE users (id int);\n" {
+				t.Errorf("Get returned %q", got)
+			}
+
+			info, err := st.Stat("mydb/full.sql")
+			if err != nil {
+				t.Fatalf("Stat: %v", err)
+			}
+			if info.Key != "mydb/full.sql" || info.Size != 29 {
+				t.Errorf("Stat returned %+v", info)
+			}
+
+			objects, err := st.List("mydb/")
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			var keys []string
+			for _, obj := range objects {
+				keys = append(keys, obj.Key)
+			}
+			if want := "mydb/full.sql,mydb/full.sql.manifest.json"; strings.Join(keys, ",") != want {
+				t.Errorf("List returned %v, want %s", keys, want)
+			}
+
+			if err := st.Delete("mydb/full.sql"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := st.Stat("mydb/full.sql"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Stat after Delete returned %v, want os.ErrNotExist", err)
+			}
+			if _, err := st.Get("mydb/full.sql"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Get after Delete returned %v, want os.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestS3StoreAbort(t *testing.T) {
+	st, err := NewS3("bucket", newTestS3(t, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := st.Put("partial.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "CREATE TABLE")
+	w.Abort()
+	if _, err := st.Stat("partial.sql"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat after Abort returned %v, want os.ErrNotExist", err)
+	}
+}
+
+// The URI of a key, as logged after a backup, must open the same object
+// again.
+func TestS3URIRoundTrip(t *testing.T) {
+	saved := S3Settings
+	t.Cleanup(func() { S3Settings = saved })
+	S3Settings = newTestS3(t, "team/backups")
+
+	st, key, err := Open("s3://bucket/mydb/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, st, key+"full.sql", "SELECT 1;\n")
+
+	uri := st.URI(key + "full.sql")
+	if uri != "s3://bucket/mydb/full.sql" {
+		t.Errorf("URI returned %q", uri)
+	}
+	reopened, reopenedKey, err := Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, reopened, reopenedKey); got != "SELECT 1;\n" {
+		t.Errorf("reopened %s and read %q", uri, got)
+	}
+}
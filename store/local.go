@@ -1 +1,133 @@
 package store
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ Store = (*Local)(nil)
+
+// Local stores backups on the local filesystem under root. An empty root
+// means keys are ordinary paths, relative to the working directory or
+// absolute.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a store rooted at the given directory.
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// path maps a key to its location on disk.
+func (l *Local) path(key string) string {
+	if l.root == "" {
+		return filepath.FromSlash(key)
+	}
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+func (l *Local) URI(key string) string {
+	return l.path(key)
+}
+
+// Put writes to a temporary file next to the target and renames it into
+// place on Close, so a failed backup never leaves a truncated file behind.
+func (l *Local) Put(key string) (Writer, error) {
+	target := l.path(key)
+
+	dir := filepath.Dir(target)
+	if dir != "." && dir != "/" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+
+	file, err := os.CreateTemp(dir, filepath.Base(target)+".*.partial")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	return &localWriter{File: file, target: target}, nil
+}
+
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	return os.Open(l.path(key))
+}
+
+func (l *Local) Stat(key string) (ObjectInfo, error) {
+	info, err := os.Stat(l.path(key))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()}, nil
+}
+
+func (l *Local) Delete(key string) error {
+	return os.Remove(l.path(key))
+}
+
+// List walks the directory holding prefix and returns every regular file
+// whose key starts with prefix.
+func (l *Local) List(prefix string) ([]ObjectInfo, error) {
+	base := l.path(prefix)
+	walkRoot := base
+	if info, err := os.Stat(base); err != nil || !info.IsDir() {
+		walkRoot = filepath.Dir(base)
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == walkRoot {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".partial") {
+			return nil
+		}
+		if prefix != "" && !strings.HasPrefix(p, filepath.Clean(base)) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key := p
+		if l.root != "" {
+			if key, err = filepath.Rel(l.root, p); err != nil {
+				return err
+			}
+		}
+		objects = append(objects, ObjectInfo{Key: filepath.ToSlash(key), Size: info.Size(), LastModified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", base, err)
+	}
+	return objects, nil
+}
+
+// localWriter is the Writer returned by Local.Put.
+type localWriter struct {
+	*os.File
+	target string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), w.target)
+}
+
+func (w *localWriter) Abort() {
+	w.File.Close()
+	os.Remove(w.Name())
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"io"
+	"time"
+)
+
+// Store is a place backups are written to and read from. Keys are
+// slash-separated paths relative to the root of the store.
+type Store interface {
+	// Put opens key for writing. Nothing is visible under key until the
+	// returned writer is closed successfully.
+	Put(key string) (Writer, error)
+	// Get opens key for reading.
+	Get(key string) (io.ReadCloser, error)
+	// List returns the objects whose key starts with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete removes key.
+	Delete(key string) error
+	// Stat describes key. A missing key yields an error wrapping
+	// os.ErrNotExist.
+	Stat(key string) (ObjectInfo, error)
+	// URI returns the full location of key, for log messages.
+	URI(key string) string
+}
+
+// Writer is the write side of Store.Put. Close commits the object; Abort
+// discards whatever was written so far.
+type Writer interface {
+	io.Writer
+	Close() error
+	Abort()
+}
+
+// ObjectInfo describes a stored backup object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Open resolves a backup location into the store holding it and the key of
+// the object within that store. Locations are s3://bucket/key,
+// vultr://bucket/key or a path on the local filesystem.
+func Open(location string) (Store, string, error) {
+	switch {
+	case IsS3URI(location):
+		bucket, key, err := ParseS3URI(location)
+		if err != nil {
+			return nil, "", err
+		}
+		s3, err := NewS3(bucket, S3Settings)
+		if err != nil {
+			return nil, "", err
+		}
+		return s3, key, nil
+
+	case IsVultrURI(location):
+		bucket, key, err := ParseVultrURI(location)
+		if err != nil {
+			return nil, "", err
+		}
+		vultr, err := NewVultr(bucket, VultrSettings)
+		if err != nil {
+			return nil, "", err
+		}
+		return vultr, key, nil
+
+	default:
+		return NewLocal(""), location, nil
+	}
+}
@@ -1 +1,99 @@
 package store
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	vultrScheme = "vultr"
+
+	// Vultr Object Storage hostnames follow <region>.vultrobjects.com
+	vultrDomain = "vultrobjects.com"
+
+	// Vultr ignores the signing region, but SigV4 still needs one.
+	vultrSigningRegion = "us-east-1"
+)
+
+var vultrRegionPattern = regexp.MustCompile(`^[a-z]{3}[0-9]$`)
+
+// VultrConfig describes how to reach Vultr Object Storage. Region is either
+// a Vultr location code such as ewr1, sjc1, ams1 or sgp1, or a full
+// hostname for clusters that do not follow the usual naming.
+type VultrConfig struct {
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// VultrSettings is the configuration used for vultr:// URIs. main fills it
+// from the environment and the command-line flags.
+var VultrSettings = VultrConfigFromEnv()
+
+// VultrConfigFromEnv reads VULTR_REGION, VULTR_PREFIX, VULTR_ACCESS_KEY and
+// VULTR_SECRET_KEY. The region defaults to ewr1 (New Jersey).
+func VultrConfigFromEnv() VultrConfig {
+	region := os.Getenv("VULTR_REGION")
+	if region == "" {
+		region = "ewr1"
+	}
+	return VultrConfig{
+		Region:    region,
+		Prefix:    os.Getenv("VULTR_PREFIX"),
+		AccessKey: os.Getenv("VULTR_ACCESS_KEY"),
+		SecretKey: os.Getenv("VULTR_SECRET_KEY"),
+	}
+}
+
+// VultrEndpoint returns the Object Storage hostname for a region code or
+// hostname.
+func VultrEndpoint(region string) (string, error) {
+	region = strings.ToLower(strings.TrimSpace(region))
+	if strings.Contains(region, ".") {
+		return region, nil
+	}
+	if !vultrRegionPattern.MatchString(region) {
+		return "", fmt.Errorf("invalid vultr region %q: expected a location code such as ewr1 or a hostname", region)
+	}
+	return fmt.Sprintf("%s.%s", region, vultrDomain), nil
+}
+
+// NewVultr connects to a bucket in Vultr Object Storage. Vultr speaks the S3
+// protocol, so the returned store supports the same upload, download, list
+// and delete operations as an S3 bucket.
+func NewVultr(bucket string, cfg VultrConfig) (*S3, error) {
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("vultr credentials are missing: set VULTR_ACCESS_KEY and VULTR_SECRET_KEY")
+	}
+
+	endpoint, err := VultrEndpoint(cfg.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	s3, err := NewS3(bucket, S3Config{
+		Endpoint:  endpoint,
+		Region:    vultrSigningRegion,
+		Prefix:    cfg.Prefix,
+		AccessKey: cfg.AccessKey,
+		SecretKey: cfg.SecretKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s3.scheme = vultrScheme
+	return s3, nil
+}
+
+// IsVultrURI reports whether location is a vultr:// URI.
+func IsVultrURI(location string) bool {
+	return strings.HasPrefix(location, vultrScheme+"://")
+}
+
+// ParseVultrURI splits vultr://bucket/key into its bucket and key.
+func ParseVultrURI(uri string) (bucket, key string, err error) {
+	return parseBucketURI(vultrScheme, uri)
+}
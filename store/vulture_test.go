@@ -0,0 +1,89 @@
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVultrEndpoint(t *testing.T) {
+	tests := []struct {
+		region string
+		want   string
+	}{
+		{"ewr1", "ewr1.vultrobjects.com"},
+		{" SJC1 ", "sjc1.vultrobjects.com"},
+		{"blr1.vultrobjects.com", "blr1.vultrobjects.com"},
+		{"http://127.0.0.1:9000", "http://127.0.0.1:9000"},
+	}
+	for _, tt := range tests {
+		got, err := VultrEndpoint(tt.region)
+		if err != nil {
+			t.Errorf("VultrEndpoint(%q): %v", tt.region, err)
+		} else if got != tt.want {
+			t.Errorf("VultrEndpoint(%q) = %q, want %q", tt.region, got, tt.want)
+		}
+	}
+	for _, region := range []string{"", "ewr", "ewr-1", "newark1"} {
+		if got, err := VultrEndpoint(region); err == nil {
+			t.Errorf("VultrEndpoint(%q) = %q, want an error", region, got)
+		}
+	}
+}
+
+func TestNewVultrNeedsCredentials(t *testing.T) {
+	_, err := NewVultr("bucket", VultrConfig{Region: "ewr1"})
+	if err == nil || !strings.Contains(err.Error(), "VULTR_ACCESS_KEY") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestParseVultrURI(t *testing.T) {
+	bucket, key, err := ParseVultrURI("vultr://backups/mydb/full.sql")
+	if err != nil || bucket != "backups" || key != "mydb/full.sql" {
+		t.Errorf("ParseVultrURI returned %q, %q, %v", bucket, key, err)
+	}
+	for _, uri := range []string{"vultr:///mydb/full.sql", "s3://backups/mydb/full.sql"} {
+		if _, _, err := ParseVultrURI(uri); err == nil {
+			t.Errorf("ParseVultrURI(%q) accepted it", uri)
+		}
+	}
+	if !IsVultrURI("vultr://backups/") || IsVultrURI("s3://backups/") {
+		t.Error("IsVultrURI does not tell vultr:// URIs apart")
+	}
+}
+
+// A vultr:// URI opens the bucket through the configured endpoint and
+// prefix, and the URI of a key opens the same object again.
+func TestVultrURIRoundTrip(t *testing.T) {
+	backend := newTestS3(t, "")
+	saved := VultrSettings
+	t.Cleanup(func() { VultrSettings = saved })
+	VultrSettings = VultrConfig{Region: backend.Endpoint, Prefix: "team", AccessKey: "test", SecretKey: "testsecret"}
+
+	st, key, err := Open("vultr://bucket/mydb/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, st, key+"full.sql", "SELECT 1;\n")
+
+	uri := st.URI(key + "full.sql")
+	if uri != "vultr://bucket/mydb/full.sql" {
+		t.Errorf("URI returned %q", uri)
+	}
+	reopened, reopenedKey, err := Open(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, reopened, reopenedKey); got != "SELECT 1;\n" {
+		t.Errorf("reopened %s and read %q", uri, got)
+	}
+
+	// The object is stored under the prefix.
+	raw, err := NewS3("bucket", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := get(t, raw, "team/mydb/full.sql"); got != "SELECT 1;\n" {
+		t.Errorf("bucket holds %q under the prefix", got)
+	}
+}
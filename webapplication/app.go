@@ -43,7 +43,7 @@ func RunWebApp() {
 
 func homePage(w http.ResponseWriter, r *http.Request) {
 	tmpl, _ := template.ParseFiles("templates/index.html")
-	tmpl.Execute(w, nil)
+	tmpl.Execute(w, coreactions.Engines())
 }
 
 func getStatus(err error) string {
@@ -116,10 +116,20 @@ func parseTableList(tableList string) []string {
 	return strings.Split(tableList, ",") // Split the input string by commas and return the slice
 }
 
+// formDatabaseType returns the database type selected in the form, falling
+// back to PostgreSQL for forms that do not send one.
+func formDatabaseType(r *http.Request) string {
+	if dbType := r.FormValue("dbType"); dbType != "" {
+		return dbType
+	}
+	return "postgres"
+}
+
 func backupHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	// Extract input values from form
+	dbType := formDatabaseType(r)
 	dbHost := r.FormValue("dbHost")
 	dbPort, _ := strconv.Atoi(r.FormValue("dbPort"))
 	dbUsername := r.FormValue("dbUsername")
@@ -133,9 +143,9 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Backup all tables or selected tables
 	if tables != "" {
-		err = coreactions.BackupDatabaseTables("postgres", dbHost, dbPort, dbUsername, dbPassword, databasename, backupFile, parseTableList(tables))
+		err = coreactions.BackupDatabaseTables(dbType, dbHost, dbPort, dbUsername, dbPassword, databasename, backupFile, parseTableList(tables))
 	} else {
-		err = coreactions.BackupDatabase("postgres", dbHost, dbPort, dbUsername, dbPassword, databasename, backupFile)
+		err = coreactions.BackupDatabase(dbType, dbHost, dbPort, dbUsername, dbPassword, databasename, backupFile)
 	}
 
 	status = getStatus(err)
@@ -147,6 +157,7 @@ func restoreHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	// Extract input values from form
+	dbType := formDatabaseType(r)
 	dbHost := r.FormValue("dbHost")
 	dbPort, _ := strconv.Atoi(r.FormValue("dbPort"))
 	dbUsername := r.FormValue("dbUsername")
@@ -160,9 +171,9 @@ func restoreHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Perform point-in-time restore if date is provided
 	if restoreDate != "" {
-		err = coreactions.RestoreDatabaseOfSpecificDate("postgres", dbHost, dbPort, dbUsername, dbPassword, databasename, restoreFile, restoreDate)
+		err = coreactions.RestoreDatabaseOfSpecificDate(dbType, dbHost, dbPort, dbUsername, dbPassword, databasename, restoreFile, restoreDate)
 	} else {
-		err = coreactions.RestoreDatabase("postgres", dbHost, dbPort, dbUsername, dbPassword, databasename, restoreFile)
+		err = coreactions.RestoreDatabase(dbType, dbHost, dbPort, dbUsername, dbPassword, databasename, restoreFile)
 	}
 
 	status = getStatus(err)